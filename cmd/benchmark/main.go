@@ -0,0 +1,255 @@
+// Command benchmark crawls a local synthetic web at increasing concurrency and writes
+// throughput, latency and resource use per level as JSON, to track regressions over time.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ardanlabs/conf/v3"
+	"github.com/musabgultekin/quantumscraper/http"
+	"github.com/musabgultekin/quantumscraper/storage"
+	"github.com/musabgultekin/quantumscraper/synthweb"
+	"github.com/musabgultekin/quantumscraper/worker"
+)
+
+var build = "develop"
+
+func main() {
+	if err := run(); err != nil {
+		log.Println("error:", err)
+		os.Exit(1)
+	}
+}
+
+type Config struct {
+	conf.Version    `json:"-"`
+	Concurrency     []int         `conf:"default:1;4;16;64;256"`
+	Duration        time.Duration `conf:"default:10s,help:crawl time per concurrency level"`
+	Hosts           int           `conf:"default:2000"`
+	PagesPerHost    int           `conf:"default:50"`
+	LinksPerPage    int           `conf:"default:20"`
+	ExternalLinks   float64       `conf:"default:0.2"`
+	CompressedPages float64       `conf:"default:0.5"`
+	Seed            int64         `conf:"default:1"`
+	Output          string        `conf:"default:benchmark.json"`
+}
+
+// Report is what gets written to the output file.
+type Report struct {
+	Build     string    `json:"build"`
+	GoVersion string    `json:"go_version"`
+	CPUs      int       `json:"cpus"`
+	Started   time.Time `json:"started"`
+	Config    Config    `json:"config"`
+	Levels    []Level   `json:"levels"`
+}
+
+// Level is the result of crawling at one concurrency. CPU, allocations and GC include
+// the synthetic web, which runs in the same process.
+type Level struct {
+	Concurrency   int     `json:"concurrency"`
+	Pages         int     `json:"pages"`
+	Errors        int     `json:"errors"`
+	Seconds       float64 `json:"seconds"`
+	PagesPerSec   float64 `json:"pages_per_sec"`
+	LatencyP50Ms  float64 `json:"latency_p50_ms"`
+	LatencyP99Ms  float64 `json:"latency_p99_ms"`
+	CPUMsPerPage  float64 `json:"cpu_ms_per_page"`
+	AllocsPerPage float64 `json:"allocs_per_page"`
+	BytesPerPage  float64 `json:"bytes_per_page"`
+	GCCount       uint32  `json:"gc_count"`
+	GCPauseMs     float64 `json:"gc_pause_ms"`
+}
+
+func run() error {
+	cfg := Config{Version: conf.Version{Build: build, Desc: "MIT"}}
+	help, err := conf.Parse("BENCHMARK", &cfg)
+	if err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			fmt.Println(help)
+			return nil
+		}
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	// The synthetic hosts don't resolve, don't send their lookups anywhere
+	http.SetDNSCache(http.NewDNSCache(http.DNSCacheConfig{NegativeTTL: time.Hour, MaxEntries: 1_000_000, Timeout: time.Second}, offlineDNS{}))
+
+	report := Report{
+		Build:     build,
+		GoVersion: runtime.Version(),
+		CPUs:      runtime.NumCPU(),
+		Started:   time.Now(),
+		Config:    cfg,
+	}
+	for _, concurrency := range cfg.Concurrency {
+		level, err := runLevel(cfg, concurrency)
+		if err != nil {
+			return fmt.Errorf("concurrency %d: %w", concurrency, err)
+		}
+		log.Printf("concurrency %d: %.0f pages/s, p50 %.1fms, p99 %.1fms, %.2f cpu ms/page, %.0f allocs/page",
+			concurrency, level.PagesPerSec, level.LatencyP50Ms, level.LatencyP99Ms, level.CPUMsPerPage, level.AllocsPerPage)
+		report.Levels = append(report.Levels, level)
+	}
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+	if err := os.WriteFile(cfg.Output, output, 0o644); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+// runLevel crawls a fresh synthetic web with a fresh frontier for the configured duration.
+func runLevel(cfg Config, concurrency int) (Level, error) {
+	level := Level{Concurrency: concurrency}
+	web, err := synthweb.Start(synthweb.Config{
+		Seed:            cfg.Seed,
+		Hosts:           cfg.Hosts,
+		PagesPerHost:    cfg.PagesPerHost,
+		LinksPerPage:    cfg.LinksPerPage,
+		ExternalLinks:   cfg.ExternalLinks,
+		CompressedPages: cfg.CompressedPages,
+	})
+	if err != nil {
+		return level, err
+	}
+	defer web.Close()
+	pool, err := http.NewProxyPool([]string{web.ProxyURL}, http.ProxyRoundRobin, 1_000_000)
+	if err != nil {
+		return level, fmt.Errorf("proxy pool: %w", err)
+	}
+	http.SetProxyPool(pool)
+
+	dir, err := os.MkdirTemp("", "benchmark")
+	if err != nil {
+		return level, fmt.Errorf("temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	frontier, err := storage.NewFrontier(dir+"/frontier", storage.DepthScorer{}, 0, time.Hour)
+	if err != nil {
+		return level, fmt.Errorf("frontier: %w", err)
+	}
+	defer frontier.Close()
+	seen, err := storage.NewSeenSet(dir + "/seen")
+	if err != nil {
+		return level, fmt.Errorf("seen set: %w", err)
+	}
+	defer seen.Close()
+	for i, seed := range web.Seeds() {
+		if _, err := seen.Add(seed, web.Host(i), 0, cfg.PagesPerHost*2); err != nil {
+			return level, fmt.Errorf("seen add: %w", err)
+		}
+		if _, err := frontier.Push(storage.URLInfo{URL: seed}); err != nil {
+			return level, fmt.Errorf("frontier push: %w", err)
+		}
+	}
+
+	fetcher := &timingFetcher{fetcher: http.FastFetcher{}}
+	crawlConfig := &worker.Config{
+		Concurrency: concurrency,
+		Fetcher:     fetcher,
+		Frontier:    frontier,
+		Seen:        seen,
+		Links:       worker.LinkPolicy{Scope: worker.ScopeDomain, MaxDepth: 100, MaxPagesPerHost: cfg.PagesPerHost * 2},
+	}
+
+	runtime.GC()
+	var memBefore, memAfter runtime.MemStats
+	runtime.ReadMemStats(&memBefore)
+	cpuBefore := cpuTime()
+	startTime := time.Now()
+
+	stop := make(chan struct{})
+	time.AfterFunc(cfg.Duration, func() { close(stop) })
+	if err := worker.CrawlFrontier(crawlConfig, stop); err != nil {
+		return level, err
+	}
+
+	level.Seconds = time.Since(startTime).Seconds()
+	cpu := cpuTime() - cpuBefore
+	runtime.ReadMemStats(&memAfter)
+
+	latencies, errorCount := fetcher.results()
+	level.Pages, level.Errors = len(latencies), errorCount
+	if level.Pages == 0 {
+		return level, errors.New("no pages crawled")
+	}
+	pages := float64(level.Pages)
+	level.PagesPerSec = pages / level.Seconds
+	level.LatencyP50Ms = percentile(latencies, 0.50)
+	level.LatencyP99Ms = percentile(latencies, 0.99)
+	level.CPUMsPerPage = float64(cpu.Milliseconds()) / pages
+	level.AllocsPerPage = float64(memAfter.Mallocs-memBefore.Mallocs) / pages
+	level.BytesPerPage = float64(memAfter.TotalAlloc-memBefore.TotalAlloc) / pages
+	level.GCCount = memAfter.NumGC - memBefore.NumGC
+	level.GCPauseMs = float64(memAfter.PauseTotalNs-memBefore.PauseTotalNs) / 1e6
+	return level, nil
+}
+
+// timingFetcher records the latency of successful fetches.
+type timingFetcher struct {
+	fetcher http.Fetcher
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (f *timingFetcher) Fetch(req *http.FetchRequest) (*http.FetchResult, error) {
+	startTime := time.Now()
+	result, err := f.fetcher.Fetch(req)
+	latency := time.Since(startTime)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		f.errors++
+	} else {
+		f.latencies = append(f.latencies, latency)
+	}
+	return result, err
+}
+
+func (f *timingFetcher) results() ([]time.Duration, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	latencies := append([]time.Duration(nil), f.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies, f.errors
+}
+
+// percentile of sorted latencies, in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return float64(sorted[int(float64(len(sorted)-1)*p)].Microseconds()) / 1000
+}
+
+// cpuTime is the user and system CPU time of the process so far.
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// offlineDNS fails every query right away.
+type offlineDNS struct{}
+
+func (offlineDNS) Exchange(context.Context, []byte) ([]byte, error) {
+	return nil, errors.New("benchmark: offline")
+}
@@ -3,6 +3,7 @@ module github.com/musabgultekin/quantumscraper
 go 1.20
 
 require (
+	github.com/andybalholm/brotli v1.0.5
 	github.com/ardanlabs/conf/v3 v3.1.5
 	github.com/dgraph-io/badger/v3 v3.2103.5
 	github.com/klauspost/compress v1.16.5
@@ -18,7 +19,6 @@ require (
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.5 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/blang/semver v3.5.1+incompatible // indirect
 	github.com/bmizerany/perks v0.0.0-20230307044200-03f9df79da1e // indirect
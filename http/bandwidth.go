@@ -0,0 +1,187 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"golang.org/x/time/rate"
+)
+
+// BandwidthLimits are in bytes per second, over all connections, those to one host,
+// and those through one proxy. Zero means no limit.
+type BandwidthLimits struct {
+	Global   int64 `json:"global"`
+	PerHost  int64 `json:"per_host"`
+	PerProxy int64 `json:"per_proxy"`
+}
+
+// Bandwidth throttles and counts the bytes of connections. Limits can be changed
+// while connections are open, and apply to them right away.
+type Bandwidth struct {
+	mu      sync.Mutex
+	limits  BandwidthLimits
+	global  *rate.Limiter
+	hosts   map[string]*rate.Limiter
+	proxies map[string]*rate.Limiter
+}
+
+const (
+	minBandwidthBurst = 64 << 10 // Reads and writes go through in chunks of at most the burst
+	maxBandwidthHosts = 100_000
+)
+
+var bandwidth = NewBandwidth(BandwidthLimits{})
+
+// BandwidthControl returns the bandwidth of all dialed connections, to change its limits.
+func BandwidthControl() *Bandwidth {
+	return bandwidth
+}
+
+func NewBandwidth(limits BandwidthLimits) *Bandwidth {
+	return &Bandwidth{
+		limits:  limits,
+		global:  newBandwidthLimiter(limits.Global),
+		hosts:   make(map[string]*rate.Limiter),
+		proxies: make(map[string]*rate.Limiter),
+	}
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, minBandwidthBurst)
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), bandwidthBurst(bytesPerSecond))
+}
+
+func bandwidthBurst(bytesPerSecond int64) int {
+	if bytesPerSecond < minBandwidthBurst {
+		return minBandwidthBurst
+	}
+	return int(bytesPerSecond)
+}
+
+func setBandwidthLimit(limiter *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+	limiter.SetBurst(bandwidthBurst(bytesPerSecond))
+}
+
+func (bw *Bandwidth) Limits() BandwidthLimits {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.limits
+}
+
+// SetLimits changes the limits, including those of open connections.
+func (bw *Bandwidth) SetLimits(limits BandwidthLimits) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	bw.limits = limits
+	setBandwidthLimit(bw.global, limits.Global)
+	for _, limiter := range bw.hosts {
+		setBandwidthLimit(limiter, limits.PerHost)
+	}
+	for _, limiter := range bw.proxies {
+		setBandwidthLimit(limiter, limits.PerProxy)
+	}
+	metrics.BandwidthLimit.WithLabelValues("global").Set(float64(limits.Global))
+	metrics.BandwidthLimit.WithLabelValues("host").Set(float64(limits.PerHost))
+	metrics.BandwidthLimit.WithLabelValues("proxy").Set(float64(limits.PerProxy))
+}
+
+// Conn wraps a connection to the host through the proxy, which is empty for direct connections.
+func (bw *Bandwidth) Conn(conn net.Conn, host, proxyName string) net.Conn {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	limiters := []*rate.Limiter{bw.global, bw.limiter(bw.hosts, host, bw.limits.PerHost)}
+	if proxyName != "" {
+		limiters = append(limiters, bw.limiter(bw.proxies, proxyName, bw.limits.PerProxy))
+	}
+	return &bandwidthConn{Conn: conn, limiters: limiters}
+}
+
+func (bw *Bandwidth) limiter(limiters map[string]*rate.Limiter, key string, bytesPerSecond int64) *rate.Limiter {
+	limiter, ok := limiters[key]
+	if ok {
+		return limiter
+	}
+	if len(limiters) >= maxBandwidthHosts {
+		for evicted := range limiters {
+			delete(limiters, evicted) // Evict any, its connections keep their limiter
+			break
+		}
+	}
+	limiter = newBandwidthLimiter(bytesPerSecond)
+	limiters[key] = limiter
+	return limiter
+}
+
+// bandwidthConn waits for its limiters after reading and before writing.
+type bandwidthConn struct {
+	net.Conn
+	limiters []*rate.Limiter
+}
+
+func (conn *bandwidthConn) Read(p []byte) (int, error) {
+	if len(p) > minBandwidthBurst {
+		p = p[:minBandwidthBurst]
+	}
+	n, err := conn.Conn.Read(p)
+	if n > 0 {
+		metrics.NetworkBytes.WithLabelValues("in").Add(float64(n))
+		conn.wait(n)
+	}
+	return n, err
+}
+
+func (conn *bandwidthConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > minBandwidthBurst {
+			chunk = chunk[:minBandwidthBurst]
+		}
+		conn.wait(len(chunk))
+		n, err := conn.Conn.Write(chunk)
+		written += n
+		metrics.NetworkBytes.WithLabelValues("out").Add(float64(n))
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (conn *bandwidthConn) wait(n int) {
+	for _, limiter := range conn.limiters {
+		// Only fails if n is over the burst, which a concurrent SetLimits may have lowered
+		if err := limiter.WaitN(context.Background(), n); err != nil {
+			limiter.WaitN(context.Background(), limiter.Burst())
+		}
+	}
+}
+
+// ServeHTTP shows the limits as JSON, and changes them on POST with the same JSON.
+func (bw *Bandwidth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var limits BandwidthLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, fmt.Sprintf("decode limits: %v", err), http.StatusBadRequest)
+			return
+		}
+		bw.SetLimits(limits)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bw.Limits())
+}
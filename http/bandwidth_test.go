@@ -0,0 +1,39 @@
+package http
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthLimits(t *testing.T) {
+	bw := NewBandwidth(BandwidthLimits{PerHost: minBandwidthBurst})
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := bw.Conn(client, "a.test", "")
+	defer conn.Close()
+	go io.Copy(io.Discard, server)
+
+	// The burst goes through right away, the rest at the host limit
+	payload := make([]byte, minBandwidthBurst*3/2)
+	startTime := time.Now()
+	n, err := conn.Write(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+	assert.GreaterOrEqual(t, time.Since(startTime), time.Millisecond*400)
+
+	// Other hosts have their own limit
+	other := bw.Conn(client, "b.test", "")
+	startTime = time.Now()
+	other.Write(payload[:minBandwidthBurst])
+	assert.Less(t, time.Since(startTime), time.Millisecond*200)
+
+	// Lifting the limit applies to the open connection
+	bw.SetLimits(BandwidthLimits{})
+	startTime = time.Now()
+	conn.Write(make([]byte, minBandwidthBurst*16))
+	assert.Less(t, time.Since(startTime), time.Millisecond*200)
+}
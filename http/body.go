@@ -0,0 +1,209 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/musabgultekin/quantumscraper/metrics"
+)
+
+// BodyLimit bounds how much of a response body is kept.
+type BodyLimit struct {
+	Compressed   int64 // Bytes read off the wire
+	Decompressed int64 // Bytes produced by decoding
+}
+
+// BodyLimits holds the default body limit and overrides per media type.
+type BodyLimits struct {
+	Default BodyLimit
+	ByType  map[string]BodyLimit
+
+	// MaxWire is the most fasthttp buffers for a single response. Responses over it are fetched
+	// again with net/http, which streams them and cuts them off at the limits above. fasthttp 1.47
+	// can't stream safely: it hands the connection's bufio.Reader back to its pool while the stream
+	// still reads from it.
+	MaxWire int64
+}
+
+var bodyLimits = BodyLimits{
+	Default: BodyLimit{Compressed: 10 << 20, Decompressed: 50 << 20},
+	MaxWire: 64 << 20,
+}
+
+// SetBodyLimits sets the body limits.
+// It must be called before the proxy pool is created, since clients are configured once.
+func SetBodyLimits(limits BodyLimits) {
+	bodyLimits = limits
+}
+
+// NewBodyLimits parses body limits from sizes like "10MB".
+// Per type limits are given as "compressed/decompressed", keyed by media type.
+func NewBodyLimits(maxCompressed, maxDecompressed, maxWire string, byType map[string]string) (BodyLimits, error) {
+	var limits BodyLimits
+	var err error
+	if limits.Default, err = parseBodyLimit(maxCompressed + "/" + maxDecompressed); err != nil {
+		return limits, err
+	}
+	if limits.MaxWire, err = ParseSize(maxWire); err != nil {
+		return limits, err
+	}
+	limits.ByType = make(map[string]BodyLimit)
+	for mediaType, spec := range byType {
+		limit, err := parseBodyLimit(spec)
+		if err != nil {
+			return limits, fmt.Errorf("%s: %w", mediaType, err)
+		}
+		limits.ByType[strings.ToLower(mediaType)] = limit
+	}
+	return limits, nil
+}
+
+func parseBodyLimit(spec string) (BodyLimit, error) {
+	compressed, decompressed, ok := strings.Cut(spec, "/")
+	if !ok {
+		return BodyLimit{}, fmt.Errorf("body limit %q: expected compressed/decompressed", spec)
+	}
+	var limit BodyLimit
+	var err error
+	if limit.Compressed, err = ParseSize(compressed); err != nil {
+		return limit, err
+	}
+	if limit.Decompressed, err = ParseSize(decompressed); err != nil {
+		return limit, err
+	}
+	return limit, nil
+}
+
+// ParseSize parses byte sizes like "512", "64KB", "10MB" or "1GB".
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSuffix(s, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// For returns the limit for the media type of the given Content-Type header.
+func (limits BodyLimits) For(contentType string) BodyLimit {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return limits.Default
+	}
+	if limit, ok := limits.ByType[mediaType]; ok {
+		return limit
+	}
+	return limits.Default
+}
+
+// readBody decodes the body, keeping at most limit.Compressed bytes off the wire and
+// limit.Decompressed bytes of decoded output. Anything over is cut off and reported as truncated,
+// which also keeps decompression bombs from inflating without bound.
+func readBody(r io.Reader, contentEncoding string, limit BodyLimit) (body []byte, truncated bool, err error) {
+	wire := &cappedReader{r: r, n: limit.Compressed}
+
+	var decoded io.Reader = wire
+	switch contentEncoding {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, false, fmt.Errorf("gzip reader: %w", err)
+		}
+		defer gzipReader.Close()
+		decoded = gzipReader
+	case "deflate":
+		// The spec says zlib, but plenty of servers send raw deflate
+		buffered := bufio.NewReader(wire)
+		if header, _ := buffered.Peek(2); zlibHeader(header) {
+			zlibReader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return nil, false, fmt.Errorf("zlib reader: %w", err)
+			}
+			defer zlibReader.Close()
+			decoded = zlibReader
+		} else {
+			flateReader := flate.NewReader(buffered)
+			defer flateReader.Close()
+			decoded = flateReader
+		}
+	case "br":
+		decoded = brotli.NewReader(wire)
+	}
+
+	body, err = io.ReadAll(io.LimitReader(decoded, limit.Decompressed+1))
+	if int64(len(body)) > limit.Decompressed {
+		body, truncated = body[:limit.Decompressed], true
+	}
+	countBodyBytes(contentEncoding, limit.Compressed-wire.n, len(body))
+	if wire.truncated {
+		truncated, err = true, nil // Decoders fail on a cut stream, keep what was decoded so far
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("read body: %w", err)
+	}
+	if truncated {
+		metrics.TruncatedBodyCount.Inc()
+	}
+
+	return body, truncated, nil
+}
+
+// zlibHeader tells whether the bytes start a zlib stream: deflate with a valid header checksum.
+func zlibHeader(header []byte) bool {
+	return len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// countBodyBytes counts the bytes read off the wire and decoded, by content encoding.
+func countBodyBytes(contentEncoding string, wire int64, decoded int) {
+	encoding := contentEncoding
+	switch contentEncoding {
+	case "gzip", "deflate", "br":
+	case "":
+		encoding = "identity"
+	default:
+		encoding = "other"
+	}
+	metrics.BodyBytes.WithLabelValues(encoding, "wire").Add(float64(wire))
+	metrics.BodyBytes.WithLabelValues(encoding, "decoded").Add(float64(decoded))
+}
+
+// cappedReader reads at most n bytes and remembers whether there was more.
+type cappedReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		var probe [1]byte
+		if n, _ := c.r.Read(probe[:]); n > 0 {
+			c.truncated = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBodyTruncates(t *testing.T) {
+	plain := bytes.Repeat([]byte("a"), 1000)
+
+	body, truncated, err := readBody(bytes.NewReader(plain), "", BodyLimit{Compressed: 100, Decompressed: 1000})
+	assert.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Len(t, body, 100)
+
+	body, truncated, err = readBody(bytes.NewReader(plain), "", BodyLimit{Compressed: 1000, Decompressed: 1000})
+	assert.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Len(t, body, 1000)
+}
+
+func TestReadBodyDecompressionBomb(t *testing.T) {
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(make([]byte, 100<<20)) // 100MB of zeros, ~100KB compressed
+	gzipWriter.Close()
+
+	body, truncated, err := readBody(&compressed, "gzip", BodyLimit{Compressed: 10 << 20, Decompressed: 1 << 20})
+	assert.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Len(t, body, 1<<20)
+}
+
+func TestBodyLimitsFor(t *testing.T) {
+	limits, err := NewBodyLimits("1MB", "5MB", "64MB", map[string]string{"text/html": "2MB/10MB"})
+	assert.NoError(t, err)
+	assert.Equal(t, BodyLimit{Compressed: 2 << 20, Decompressed: 10 << 20}, limits.For("text/html; charset=utf-8"))
+	assert.Equal(t, BodyLimit{Compressed: 1 << 20, Decompressed: 5 << 20}, limits.For("application/xhtml+xml"))
+}
+
+func TestReadBodyDeflate(t *testing.T) {
+	plain := bytes.Repeat([]byte("deflate "), 100)
+
+	var zlibbed, raw bytes.Buffer
+	zlibWriter := zlib.NewWriter(&zlibbed)
+	zlibWriter.Write(plain)
+	zlibWriter.Close()
+	flateWriter, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	flateWriter.Write(plain)
+	flateWriter.Close()
+
+	for name, compressed := range map[string][]byte{"zlib": zlibbed.Bytes(), "raw": raw.Bytes()} {
+		body, truncated, err := readBody(bytes.NewReader(compressed), "deflate", BodyLimit{Compressed: 1 << 20, Decompressed: 1 << 20})
+		assert.NoError(t, err, name)
+		assert.False(t, truncated, name)
+		assert.Equal(t, plain, body, name)
+	}
+}
+
+func TestFastFetcherTruncatesOverWire(t *testing.T) {
+	page := append([]byte("<html>"), bytes.Repeat([]byte("a"), 100<<10)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/length" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		}
+		w.Write(page) // Chunked otherwise
+	}))
+	defer server.Close()
+
+	previousLimits, previousPool := bodyLimits, proxyPool
+	t.Cleanup(func() {
+		SetBodyLimits(previousLimits)
+		SetProxyPool(previousPool)
+	})
+	SetBodyLimits(BodyLimits{Default: BodyLimit{Compressed: 20 << 10, Decompressed: 1 << 20}, MaxWire: 8 << 10})
+	pool, err := NewProxyPool([]string{"direct://"}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	SetProxyPool(pool)
+
+	for _, path := range []string{"/length", "/chunked"} {
+		result, err := FastFetcher{}.Fetch(&FetchRequest{URL: server.URL + path})
+		assert.NoError(t, err, path)
+		assert.True(t, result.Truncated, path)
+		assert.Equal(t, page[:20<<10], result.Body, path)
+	}
+}
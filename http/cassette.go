@@ -0,0 +1,318 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Exchange is one request and its response, with the body as it came off the wire,
+// before decoding. Failed requests only have their error.
+type Exchange struct {
+	URL         string      `json:"url"`
+	StatusCode  int         `json:"status,omitempty"`
+	Protocol    string      `json:"protocol,omitempty"`
+	Header      [][2]string `json:"header,omitempty"` // In order, repeated for headers like Set-Cookie
+	Body        []byte      `json:"body,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Proxy       string      `json:"proxy,omitempty"`        // Of a proxy that refused the CONNECT
+	ProxyStatus int         `json:"proxy_status,omitempty"` // Its status, to rebuild the ProxyConnectError
+}
+
+// Cassette holds recorded exchanges, stored as JSON lines. Exchanges of a URL are replayed
+// in the order they were recorded, the last one repeating once all were replayed.
+type Cassette struct {
+	mu        sync.Mutex
+	exchanges []*Exchange
+	replayed  map[string]int // Exchanges of each URL replayed so far
+	file      *os.File       // Of cassettes created with CreateCassette, written as exchanges are recorded
+	encoder   *json.Encoder
+	err       error // First failed write to the file
+}
+
+func NewCassette() *Cassette {
+	return &Cassette{replayed: make(map[string]int)}
+}
+
+// CreateCassette returns a cassette that appends each exchange to the file as it's recorded instead of
+// keeping it, so crawls that never finish, or get killed, still leave what they fetched. It must be closed.
+func CreateCassette(path string) (*Cassette, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create cassette: %w", err)
+	}
+	cassette := NewCassette()
+	cassette.file, cassette.encoder = file, json.NewEncoder(file)
+	return cassette, nil
+}
+
+// Close closes the file of a cassette created with CreateCassette, returning the first failed write.
+func (cassette *Cassette) Close() error {
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+	if cassette.file == nil {
+		return nil
+	}
+	if err := cassette.file.Close(); err != nil && cassette.err == nil {
+		cassette.err = fmt.Errorf("close cassette: %w", err)
+	}
+	cassette.file = nil
+	return cassette.err
+}
+
+// LoadCassette reads a cassette saved with Save.
+func LoadCassette(path string) (*Cassette, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open cassette: %w", err)
+	}
+	defer file.Close()
+
+	cassette := NewCassette()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var exchange Exchange
+		if err := decoder.Decode(&exchange); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("decode cassette: %w", err)
+		}
+		cassette.exchanges = append(cassette.exchanges, &exchange)
+	}
+	return cassette, nil
+}
+
+// Save writes the exchanges recorded by a cassette from NewCassette to the file.
+func (cassette *Cassette) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create cassette: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, exchange := range cassette.Exchanges() {
+		if err := encoder.Encode(exchange); err != nil {
+			file.Close()
+			return fmt.Errorf("encode cassette: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("write cassette: %w", err)
+	}
+	return file.Close()
+}
+
+func (cassette *Cassette) Record(exchange *Exchange) {
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+	if cassette.encoder == nil {
+		cassette.exchanges = append(cassette.exchanges, exchange)
+		return
+	}
+	if cassette.file == nil || cassette.err != nil {
+		return // Closed, or broken
+	}
+	if err := cassette.encoder.Encode(exchange); err != nil {
+		cassette.err = fmt.Errorf("write cassette: %w", err)
+	}
+}
+
+func (cassette *Cassette) Exchanges() []*Exchange {
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+	return append([]*Exchange(nil), cassette.exchanges...)
+}
+
+// replay returns the next exchange of the URL.
+func (cassette *Cassette) replay(url string) (*Exchange, bool) {
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+
+	var last *Exchange
+	seen := 0
+	for _, exchange := range cassette.exchanges {
+		if exchange.URL != url {
+			continue
+		}
+		if seen == cassette.replayed[url] {
+			cassette.replayed[url]++
+			return exchange, true
+		}
+		last = exchange
+		seen++
+	}
+	return last, last != nil
+}
+
+func newFastExchange(url string, res *fasthttp.Response, err error) *Exchange {
+	exchange := &Exchange{URL: url}
+	if err != nil {
+		exchange.setError(err)
+		return exchange
+	}
+	exchange.StatusCode = res.StatusCode()
+	exchange.Protocol = "HTTP/1.1"
+	res.Header.VisitAll(func(key, value []byte) {
+		exchange.Header = append(exchange.Header, [2]string{string(key), string(value)})
+	})
+	exchange.Body = append([]byte(nil), res.Body()...)
+	return exchange
+}
+
+func (exchange *Exchange) setError(err error) {
+	exchange.Error = err.Error()
+	var connectErr *ProxyConnectError
+	if errors.As(err, &connectErr) {
+		exchange.Proxy, exchange.ProxyStatus = connectErr.Proxy, connectErr.StatusCode
+	}
+}
+
+// cassetteError restores the errors the worker tells apart, the rest only keep their message.
+func cassetteError(exchange *Exchange) error {
+	if exchange.ProxyStatus != 0 {
+		return &ProxyConnectError{Proxy: exchange.Proxy, StatusCode: exchange.ProxyStatus}
+	}
+	message := exchange.Error
+	for _, err := range []error{
+		fasthttp.ErrConnectionClosed,
+		fasthttp.ErrTimeout,
+		fasthttp.ErrDialTimeout,
+		fasthttp.ErrNoFreeConns,
+		fasthttp.ErrTooManyRedirects,
+		fasthttp.ErrMissingLocation,
+	} {
+		if message == err.Error() {
+			return err
+		}
+	}
+	return errors.New(message)
+}
+
+// RecordingFetcher records the exchanges of the fetches of a FastFetcher or HTTPFetcher,
+// including each redirect, to a cassette.
+type RecordingFetcher struct {
+	fetcher  Fetcher
+	cassette *Cassette
+}
+
+func NewRecordingFetcher(fetcher Fetcher, cassette *Cassette) *RecordingFetcher {
+	return &RecordingFetcher{fetcher: fetcher, cassette: cassette}
+}
+
+func (f *RecordingFetcher) Fetch(fetchReq *FetchRequest) (*FetchResult, error) {
+	recorded := *fetchReq
+	recorded.cassette = f.cassette
+	return f.fetcher.Fetch(&recorded)
+}
+
+// ReplayFetcher serves the exchanges of a cassette without a network, following the recorded
+// redirects and decoding bodies the way FastFetcher does.
+type ReplayFetcher struct {
+	cassette *Cassette
+}
+
+func NewReplayFetcher(cassette *Cassette) *ReplayFetcher {
+	return &ReplayFetcher{cassette: cassette}
+}
+
+func (f *ReplayFetcher) Fetch(fetchReq *FetchRequest) (*FetchResult, error) {
+	result := &FetchResult{}
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+	uri := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(uri)
+
+	if err := uri.Parse(nil, []byte(fetchReq.URL)); err != nil {
+		return result, fmt.Errorf("parse url: %w", err)
+	}
+	for redirects := 0; ; redirects++ {
+		exchange, ok := f.cassette.replay(uri.String())
+		if !ok {
+			return result, fmt.Errorf("client do: no recorded exchange for %s", uri.String())
+		}
+		if exchange.Error != "" {
+			return result, fmt.Errorf("client do: %w", cassetteError(exchange))
+		}
+
+		res.Reset()
+		res.SetStatusCode(exchange.StatusCode)
+		for _, header := range exchange.Header {
+			res.Header.Add(header[0], header[1])
+		}
+		res.SetBodyRaw(exchange.Body)
+		result.StatusCode, result.Protocol = exchange.StatusCode, exchange.Protocol
+
+		if !fasthttp.StatusCodeIsRedirect(exchange.StatusCode) {
+			break
+		}
+		if redirects >= 10 {
+			return result, fmt.Errorf("client do: %w", fasthttp.ErrTooManyRedirects)
+		}
+		location := res.Header.Peek(fasthttp.HeaderLocation)
+		if len(location) == 0 {
+			return result, fmt.Errorf("client do: %w", fasthttp.ErrMissingLocation)
+		}
+		uri.UpdateBytes(location)
+	}
+	return fastResult(fetchReq, res, result)
+}
+
+// recordingTransport records the exchanges of requests whose context carries a cassette.
+type recordingTransport struct {
+	http.RoundTripper
+}
+
+type cassetteKey struct{}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+	cassette, _ := req.Context().Value(cassetteKey{}).(*Cassette)
+	if cassette == nil {
+		return res, err
+	}
+	exchange := &Exchange{URL: req.URL.String()}
+	if err != nil {
+		exchange.setError(err)
+		cassette.Record(exchange)
+		return res, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, bodyLimits.MaxWire))
+	res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read body to record: %w", err)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	exchange.StatusCode, exchange.Protocol, exchange.Body = res.StatusCode, res.Proto, body
+	names := make([]string, 0, len(res.Header))
+	for name := range res.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names) // net/http doesn't keep the order
+	for _, name := range names {
+		for _, value := range res.Header[name] {
+			exchange.Header = append(exchange.Header, [2]string{name, value})
+		}
+	}
+	cassette.Record(exchange)
+	return res, nil
+}
+
+func withCassette(ctx context.Context, cassette *Cassette) context.Context {
+	if cassette == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cassetteKey{}, cassette)
+}
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "/gzip", http.StatusMovedPermanently)
+			return
+		case "/gzip":
+			writer := gzip.NewWriter(&body)
+			writer.Write([]byte("<html>gzip</html>"))
+			writer.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+		case "/br":
+			writer := brotli.NewWriter(&body)
+			writer.Write([]byte("<html>br</html>"))
+			writer.Close()
+			w.Header().Set("Content-Encoding", "br")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(body.Bytes())
+	}))
+
+	previousPool := proxyPool
+	t.Cleanup(func() { SetProxyPool(previousPool) })
+	pool, err := NewProxyPool([]string{"direct://"}, ProxyRoundRobin, 100) // The refused fetches shouldn't take it out
+	assert.NoError(t, err)
+	SetProxyPool(pool)
+
+	// A port nothing listens on, for a connection error
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	refused := "http://" + ln.Addr().String() + "/"
+	ln.Close()
+
+	urls := []string{server.URL + "/", server.URL + "/br", server.URL + "/missing", refused}
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	for _, backend := range []string{BackendFasthttp, BackendHTTP2} {
+		fetcher, err := NewFetcher(backend)
+		assert.NoError(t, err)
+		recorder := NewCassette()
+		if backend == BackendHTTP2 {
+			recorder, err = CreateCassette(path) // Written as the exchanges are recorded
+			assert.NoError(t, err)
+		}
+		recording := NewRecordingFetcher(fetcher, recorder)
+
+		var recorded []*FetchResult
+		var recordedErrs []error
+		for _, url := range urls {
+			result, err := recording.Fetch(&FetchRequest{URL: url})
+			recorded, recordedErrs = append(recorded, result), append(recordedErrs, err)
+		}
+		if backend == BackendHTTP2 {
+			assert.NoError(t, recorder.Close())
+		} else {
+			assert.Len(t, recorder.Exchanges(), 5, "a redirect is two exchanges")
+			assert.NoError(t, recorder.Save(path))
+		}
+
+		cassette, err := LoadCassette(path)
+		assert.NoError(t, err)
+		replay := NewReplayFetcher(cassette)
+		for i, url := range urls {
+			result, err := replay.Fetch(&FetchRequest{URL: url})
+			assert.Equal(t, string(recorded[i].Body), string(result.Body), url)
+			if assert.Equal(t, recordedErrs[i] == nil, err == nil, url) && err == nil {
+				assert.Equal(t, recorded[i].StatusCode, result.StatusCode, url)
+			}
+		}
+		assert.Equal(t, "<html>gzip</html>", string(recorded[0].Body), backend)
+		assert.Equal(t, "<html>br</html>", string(recorded[1].Body), backend)
+		assert.ErrorContains(t, recordedErrs[2], "not HTML", backend)
+	}
+
+	// Replays don't need the server
+	server.Close()
+	cassette, err := LoadCassette(path)
+	assert.NoError(t, err)
+	result, err := NewReplayFetcher(cassette).Fetch(&FetchRequest{URL: server.URL + "/"})
+	assert.NoError(t, err)
+	assert.Equal(t, "<html>gzip</html>", string(result.Body))
+	_, err = NewReplayFetcher(cassette).Fetch(&FetchRequest{URL: server.URL + "/unrecorded"})
+	assert.ErrorContains(t, err, "no recorded exchange")
+}
+
+func TestReplayProxyConnectError(t *testing.T) {
+	previousPool := proxyPool
+	t.Cleanup(func() { SetProxyPool(previousPool) })
+	var status atomic.Int32
+	status.Store(http.StatusForbidden)
+	pool, err := NewProxyPool([]string{"http://" + connectProxy(t, &status)}, ProxyRoundRobin, 100)
+	assert.NoError(t, err)
+	SetProxyPool(pool)
+
+	for _, backend := range []string{BackendFasthttp, BackendHTTP2} {
+		fetcher, err := NewFetcher(backend)
+		assert.NoError(t, err)
+		recorder := NewCassette()
+		_, err = NewRecordingFetcher(fetcher, recorder).Fetch(&FetchRequest{URL: "http://blocked.test/"})
+		assert.Error(t, err, backend)
+
+		// The worker tells a proxy refusing the target apart by its status
+		_, err = NewReplayFetcher(recorder).Fetch(&FetchRequest{URL: "http://blocked.test/"})
+		var connectErr *ProxyConnectError
+		if assert.True(t, errors.As(err, &connectErr), backend) {
+			assert.Equal(t, http.StatusForbidden, connectErr.StatusCode, backend)
+		}
+	}
+}
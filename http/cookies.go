@@ -0,0 +1,210 @@
+package http
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"golang.org/x/net/publicsuffix"
+)
+
+// CookieJarConfig bounds the cookies kept. Sites are keyed by registrable domain,
+// so cookies set by example.com are sent after a redirect to www.example.com.
+type CookieJarConfig struct {
+	MaxSites   int
+	MaxCookies int           // Per site, cookies over it are ignored
+	MaxAge     time.Duration // Sites are forgotten this long after their first cookie
+}
+
+// CookieJar keeps cookies per site. It implements http.CookieJar for the net/http fetcher.
+type CookieJar struct {
+	config CookieJarConfig
+
+	mu    sync.Mutex
+	sites map[string]*siteCookies
+}
+
+type siteCookies struct {
+	jar     *cookiejar.Jar
+	entries map[cookieKey]time.Time // Cookies in the jar by when they expire, zero for session cookies
+	batches int                     // Host batches of the site in progress, it's dropped when the last is done
+	created time.Time
+}
+
+// cookieKey identifies a cookie like the jar does, a cookie with the same key replaces it.
+type cookieKey struct {
+	name, domain, path string
+}
+
+// cookieJar is nil when cookies are off, requests are then anonymous.
+var cookieJar *CookieJar
+
+// SetCookieJar turns cookies on, or off if the jar is nil.
+// It must be called before fetchers are created, since the net/http client is configured once.
+func SetCookieJar(jar *CookieJar) {
+	cookieJar = jar
+}
+
+func NewCookieJar(config CookieJarConfig) *CookieJar {
+	return &CookieJar{config: config, sites: make(map[string]*siteCookies)}
+}
+
+func cookieSite(host string) string {
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host // IPs and public suffixes themselves
+	}
+	return site
+}
+
+// site returns the cookies of the URL's site, creating them if create is set. It must be called with mu held.
+// Sites of host batches in progress are never expired or evicted, there's one per worker at most.
+func (jar *CookieJar) site(u *url.URL, create bool) *siteCookies {
+	key := cookieSite(u.Hostname())
+	site, ok := jar.sites[key]
+	if ok && site.batches == 0 && time.Since(site.created) > jar.config.MaxAge {
+		delete(jar.sites, key)
+		site, ok = nil, false
+	}
+	if ok || !create {
+		return site
+	}
+	if len(jar.sites) >= jar.config.MaxSites {
+		for evicted, evictedSite := range jar.sites {
+			if evictedSite.batches == 0 {
+				delete(jar.sites, evicted) // Evict an idle one
+				break
+			}
+		}
+	}
+	cookies, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List}) // Never fails
+	site = &siteCookies{jar: cookies, entries: make(map[cookieKey]time.Time), created: time.Now()}
+	jar.sites[key] = site
+	return site
+}
+
+// SetCookies stores the cookies a response to the URL set, up to MaxCookies distinct cookies per site.
+// Cookies replacing one already kept, or deleting it, always go through.
+func (jar *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if len(cookies) == 0 {
+		return
+	}
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	site := jar.site(u, true)
+
+	now := time.Now()
+	for key, expires := range site.entries {
+		if !expires.IsZero() && !expires.After(now) {
+			delete(site.entries, key)
+		}
+	}
+	kept := make([]*http.Cookie, 0, len(cookies))
+	for _, cookie := range cookies {
+		key := newCookieKey(u, cookie)
+		expires, deleted := cookieExpiry(cookie, now)
+		_, known := site.entries[key]
+		switch {
+		case deleted:
+			delete(site.entries, key)
+		case known || len(site.entries) < jar.config.MaxCookies:
+			site.entries[key] = expires
+		default:
+			metrics.CookieDropCount.Inc()
+			continue
+		}
+		kept = append(kept, cookie)
+	}
+	site.jar.SetCookies(u, kept)
+}
+
+// newCookieKey returns the key of a cookie set by a response to the URL, defaulting its domain
+// to the host and its path to the directory of the URL like the jar does.
+func newCookieKey(u *url.URL, cookie *http.Cookie) cookieKey {
+	domain := strings.ToLower(strings.TrimPrefix(cookie.Domain, "."))
+	if domain == "" {
+		domain = strings.ToLower(u.Hostname())
+	}
+	path := cookie.Path
+	if path == "" || path[0] != '/' {
+		path = "/"
+		if i := strings.LastIndexByte(u.Path, '/'); i > 0 {
+			path = u.Path[:i]
+		}
+	}
+	return cookieKey{name: cookie.Name, domain: domain, path: path}
+}
+
+// cookieExpiry returns when the cookie expires, zero for session cookies, or whether it deletes the cookie.
+func cookieExpiry(cookie *http.Cookie, now time.Time) (expires time.Time, deleted bool) {
+	switch {
+	case cookie.MaxAge < 0:
+		return time.Time{}, true
+	case cookie.MaxAge > 0:
+		return now.Add(time.Duration(cookie.MaxAge) * time.Second), false
+	case !cookie.Expires.IsZero():
+		return cookie.Expires, !cookie.Expires.After(now)
+	}
+	return time.Time{}, false
+}
+
+// Cookies returns the cookies to send with a request to the URL.
+func (jar *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	jar.mu.Lock()
+	site := jar.site(u, false)
+	jar.mu.Unlock()
+	if site == nil {
+		return nil
+	}
+	return site.jar.Cookies(u)
+}
+
+// Hold keeps the cookies of the URL's site while a host batch of it is in progress.
+func (jar *CookieJar) Hold(u *url.URL) {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	jar.site(u, true).batches++
+}
+
+// Forget ends a host batch of the URL's site, and drops its cookies once no other batch of the site,
+// like one of a sibling host, is in progress.
+func (jar *CookieJar) Forget(u *url.URL) {
+	key := cookieSite(u.Hostname())
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	site, ok := jar.sites[key]
+	if !ok {
+		return
+	}
+	if site.batches > 0 {
+		site.batches--
+	}
+	if site.batches == 0 {
+		delete(jar.sites, key)
+	}
+}
+
+// HoldCookies keeps the cookies of the site of the URL while its host batch is in progress.
+// Every call must be matched by a ForgetCookies.
+func HoldCookies(rawURL string) {
+	if cookieJar == nil {
+		return
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		cookieJar.Hold(u)
+	}
+}
+
+// ForgetCookies drops the cookies of the site of the URL, once its host batch is done.
+func ForgetCookies(rawURL string) {
+	if cookieJar == nil {
+		return
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		cookieJar.Forget(u)
+	}
+}
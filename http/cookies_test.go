@@ -0,0 +1,92 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestCookieJarRedirects(t *testing.T) {
+	// A consent wall that redirects until its cookie comes back
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("consent"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "consent", Value: "yes", Path: "/"})
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	jar := NewCookieJar(CookieJarConfig{MaxSites: 10, MaxCookies: 10, MaxAge: time.Hour})
+	client := &fasthttp.Client{}
+	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(server.URL + "/page")
+	assert.NoError(t, doRedirects(client, req, res, 10, jar, nil))
+	assert.Equal(t, fasthttp.StatusOK, res.StatusCode())
+	assert.Equal(t, "ok", string(res.Body()))
+
+	// Without cookies the wall never lets go
+	req.SetRequestURI(server.URL + "/page")
+	assert.ErrorIs(t, doRedirects(client, req, res, 3, NewCookieJar(CookieJarConfig{MaxSites: 10, MaxAge: time.Hour}), nil), fasthttp.ErrTooManyRedirects)
+}
+
+func TestCookieJarBounds(t *testing.T) {
+	jar := NewCookieJar(CookieJarConfig{MaxSites: 1, MaxCookies: 2, MaxAge: time.Hour})
+	a, _ := url.Parse("http://www.a.test/")
+	b, _ := url.Parse("http://b.test/")
+
+	jar.SetCookies(a, []*http.Cookie{{Name: "1", Value: "1"}, {Name: "2", Value: "2"}, {Name: "3", Value: "3"}})
+	assert.Len(t, jar.Cookies(a), 2)
+	sameSite, _ := url.Parse("http://a.test/")
+	assert.Len(t, jar.Cookies(sameSite), 0, "host only cookies stay on their host")
+
+	jar.SetCookies(b, []*http.Cookie{{Name: "1", Value: "1"}})
+	assert.Len(t, jar.Cookies(a), 0, "evicted over MaxSites")
+	assert.Len(t, jar.Cookies(b), 1)
+
+	jar.config.MaxAge = 0
+	assert.Len(t, jar.Cookies(b), 0, "expired over MaxAge")
+
+	// Sites of batches in progress are kept past both
+	jar.Hold(b)
+	jar.SetCookies(b, []*http.Cookie{{Name: "1", Value: "1"}})
+	jar.SetCookies(a, []*http.Cookie{{Name: "1", Value: "1"}})
+	assert.Len(t, jar.Cookies(b), 1, "held over MaxSites and MaxAge")
+	jar.Forget(b)
+	jar.Forget(b)
+	jar.Hold(b)
+	jar.SetCookies(b, []*http.Cookie{{Name: "1", Value: "1"}})
+	assert.Len(t, jar.Cookies(b), 1, "an extra Forget doesn't leave the next Hold unheld")
+}
+
+func TestCookieJarCounts(t *testing.T) {
+	jar := NewCookieJar(CookieJarConfig{MaxSites: 10, MaxCookies: 2, MaxAge: time.Hour})
+	a, _ := url.Parse("http://www.a.test/")
+
+	// Setting the same cookie again, or deleting one, doesn't use up room
+	for i := 0; i < 5; i++ {
+		jar.SetCookies(a, []*http.Cookie{{Name: "session", Value: "1"}})
+	}
+	jar.SetCookies(a, []*http.Cookie{{Name: "consent", Value: "yes"}})
+	jar.SetCookies(a, []*http.Cookie{{Name: "consent", MaxAge: -1}})
+	jar.SetCookies(a, []*http.Cookie{{Name: "lang", Value: "en"}})
+	assert.Len(t, jar.Cookies(a), 2)
+
+	// Sibling hosts share the site, its cookies stay until the last batch is done
+	sibling, _ := url.Parse("http://blog.a.test/")
+	jar.Hold(a)
+	jar.Hold(sibling)
+	jar.Forget(sibling)
+	assert.Len(t, jar.Cookies(a), 2)
+	jar.Forget(a)
+	assert.Len(t, jar.Cookies(a), 0)
+}
@@ -0,0 +1,180 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// Address family preferences of direct dials
+const (
+	FamilyPreferIPv4    = "prefer-ipv4"
+	FamilyPreferIPv6    = "prefer-ipv6"
+	FamilyHappyEyeballs = "happy-eyeballs" // RFC 8305, IPv6 first and IPv4 raced after a short delay
+)
+
+// Address families
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+var dialFamily = FamilyPreferIPv4
+
+// happyEyeballsDelay is how long IPv6 gets before IPv4 is dialed in parallel.
+const happyEyeballsDelay = time.Millisecond * 300
+
+// SetDialFamily sets the address family preference of direct dials.
+func SetDialFamily(family string) error {
+	switch family {
+	case FamilyPreferIPv4, FamilyPreferIPv6, FamilyHappyEyeballs:
+		dialFamily = family
+		return nil
+	default:
+		return fmt.Errorf("unknown address family preference: %q", family)
+	}
+}
+
+// ResolveHost resolves the host with the DNS cache, ordering the IPs the way direct dials try them.
+func ResolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	ipAddrs, err := dnsCache.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ipv4, ipv6 []net.IP
+	for _, ipAddr := range ipAddrs {
+		if ipAddr.IP.To4() != nil {
+			ipv4 = append(ipv4, ipAddr.IP)
+		} else {
+			ipv6 = append(ipv6, ipAddr.IP)
+		}
+	}
+	if dialFamily == FamilyPreferIPv4 {
+		return append(ipv4, ipv6...), nil
+	}
+	return append(ipv6, ipv4...), nil
+}
+
+// dialDirect resolves the host and dials its addresses in the order of the family preference.
+func dialDirect(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("split host port: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ips, err := ResolveHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	primaries := 0 // Of the preferred family
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries++
+		}
+	}
+	if dialFamily == FamilyHappyEyeballs && primaries < len(addrs) {
+		return dialRace(addrs[:primaries], addrs[primaries:], deadline)
+	}
+	return dialSequential(addrs, deadline)
+}
+
+// dialSequential dials the addresses one by one until one connects.
+func dialSequential(addrs []string, deadline time.Time) (net.Conn, error) {
+	err := fmt.Errorf("no addresses to dial")
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = FasthttpDialer.DialDualStackTimeout(addr, time.Until(deadline))
+		family := addrFamily(addr)
+		if err == nil {
+			metrics.DialCount.WithLabelValues(family, "success").Inc()
+			return conn, nil
+		}
+		metrics.DialCount.WithLabelValues(family, "error").Inc()
+		if err == fasthttp.ErrDialTimeout {
+			break
+		}
+	}
+	return nil, err
+}
+
+// dialRace dials the primary addresses, and the fallback ones once the primaries fail
+// or take longer than happyEyeballsDelay. The first connection wins.
+func dialRace(primaries, fallbacks []string, deadline time.Time) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	start := func(addrs []string) {
+		go func() {
+			conn, err := dialSequential(addrs, deadline)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	start(primaries)
+	pending := 1
+	fallbackTimer := time.NewTimer(happyEyeballsDelay)
+	defer fallbackTimer.Stop()
+	fallbackStarted := false
+	var firstErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close() // Lost the race
+						}
+					}()
+				}
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// ipFamily returns the address family of an IP, or an empty string if it isn't one.
+func ipFamily(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.To4() != nil:
+		return FamilyIPv4
+	default:
+		return FamilyIPv6
+	}
+}
+
+func addrFamily(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	return ipFamily(host)
+}
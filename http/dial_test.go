@@ -0,0 +1,74 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectDialerRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+	}()
+
+	dial, err := NewDialer(&url.URL{Scheme: "http", Host: ln.Addr().String()}, time.Second)
+	assert.NoError(t, err)
+
+	_, err = dial("example.com:443")
+	var proxyErr *ProxyConnectError
+	assert.True(t, errors.As(err, &proxyErr))
+	assert.Equal(t, 403, proxyErr.StatusCode)
+}
+
+func TestNewDialerUnsupportedScheme(t *testing.T) {
+	_, err := NewDialer(&url.URL{Scheme: "ftp", Host: "localhost:21"}, time.Second)
+	assert.Error(t, err)
+}
+
+func TestDialRaceFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closed.Close()
+
+	// The primary is refused, so the fallback starts without waiting for the delay
+	startTime := time.Now()
+	conn, err := dialRace([]string{closed.Addr().String()}, []string{ln.Addr().String()}, time.Now().Add(time.Second*5))
+	assert.NoError(t, err)
+	if assert.NotNil(t, conn) {
+		assert.Equal(t, ln.Addr().String(), conn.RemoteAddr().String())
+		conn.Close()
+	}
+	assert.Less(t, time.Since(startTime), happyEyeballsDelay)
+
+	assert.Equal(t, FamilyIPv4, ipFamily("10.0.0.1"))
+	assert.Equal(t, FamilyIPv6, ipFamily("2001:db8::1"))
+	assert.Equal(t, "", ipFamily("example.com"))
+}
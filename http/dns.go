@@ -56,29 +56,23 @@ func FetchReliableDNSRecords(url string) ([]string, error) {
 		return nil, errors.New("failed to read response body: " + err.Error())
 	}
 
-	var records []DNSRecord
-	err = json.Unmarshal(body, &records)
+	candidates, err := parseReliableDNSRecords(body)
 	if err != nil {
-		return nil, errors.New("failed to unmarshal JSON: " + err.Error())
+		return nil, err
 	}
 
 	var reliableIPs []string
 	var wg sync.WaitGroup
 	ipChan := make(chan string)
 
-	for _, record := range records {
-		if record.Reliability == 1 {
-			ip := net.ParseIP(record.IP)
-			if ip != nil && ip.To4() != nil {
-				wg.Add(1)
-				go func(ip string) {
-					defer wg.Done()
-					if checkDNS(ip) {
-						ipChan <- ip
-					}
-				}(record.IP)
+	for _, candidate := range candidates {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			if checkDNS(ip) {
+				ipChan <- ip
 			}
-		}
+		}(candidate)
 	}
 
 	go func() {
@@ -95,13 +89,28 @@ func FetchReliableDNSRecords(url string) ([]string, error) {
 	return reliableIPs, nil
 }
 
+// parseReliableDNSRecords returns the resolvers with full reliability from public-dns.info style JSON.
+func parseReliableDNSRecords(data []byte) ([]string, error) {
+	var records []DNSRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, errors.New("failed to unmarshal JSON: " + err.Error())
+	}
+	var ips []string
+	for _, record := range records {
+		if record.Reliability == 1 && net.ParseIP(record.IP) != nil {
+			ips = append(ips, record.IP)
+		}
+	}
+	return ips, nil
+}
+
 func checkDNS(ip string) bool {
 	r := &net.Resolver{
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			d := net.Dialer{
 				Timeout: time.Millisecond * 5000,
 			}
-			return d.DialContext(ctx, "udp", ip+":53")
+			return d.DialContext(ctx, "udp", net.JoinHostPort(ip, "53"))
 		},
 	}
 
@@ -115,9 +124,8 @@ var DnsResolver = &net.Resolver{
 		d := &net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
-			DualStack: true,
 		}
 		i := int(atomic.AddUint64(&currentResolverIndex, 1)) % len(dnsResolvers)
-		return d.DialContext(ctx, "udp", dnsResolvers[i]+":53")
+		return d.DialContext(ctx, "udp", net.JoinHostPort(dnsResolvers[i], "53"))
 	},
 }
@@ -0,0 +1,434 @@
+package http
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSExchanger sends a DNS query message to a resolver and returns its response message.
+type DNSExchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// UDPExchanger round-robins queries over resolvers on port 53, falling back to TCP for truncated answers.
+type UDPExchanger struct {
+	Servers []string
+	next    uint64
+}
+
+func (exchanger *UDPExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(exchanger.Servers) == 0 {
+		return nil, errors.New("no dns servers")
+	}
+	i := int(atomic.AddUint64(&exchanger.next, 1)) % len(exchanger.Servers)
+	return exchangeUDP(ctx, exchanger.Servers[i], query)
+}
+
+// exchangeUDP sends the query to the server, which is an IP or "IP:port".
+func exchangeUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	addr := withDefaultPort(server, "53")
+	response, err := exchangeConn(ctx, "udp", addr, query)
+	if err != nil {
+		return nil, err
+	}
+	var parser dnsmessage.Parser
+	if header, err := parser.Start(response); err == nil && header.Truncated {
+		return exchangeConn(ctx, "tcp", addr, query)
+	}
+	return response, nil
+}
+
+func exchangeConn(ctx context.Context, network, addr string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial dns %s: %w", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, fmt.Errorf("write dns query: %w", err)
+		}
+		response := make([]byte, dnsUDPSize)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, fmt.Errorf("read dns response: %w", err)
+		}
+		return response[:n], nil
+	}
+	return exchangeStream(conn, query)
+}
+
+// exchangeStream exchanges length prefixed messages, as over TCP and TLS.
+func exchangeStream(conn io.ReadWriter, query []byte) ([]byte, error) {
+	message := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(message, query...)); err != nil {
+		return nil, fmt.Errorf("write dns query: %w", err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("read dns response: %w", err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("read dns response: %w", err)
+	}
+	return response, nil
+}
+
+func withDefaultPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+const dnsUDPSize = 4096
+
+// DNSCacheConfig holds how long answers are cached.
+type DNSCacheConfig struct {
+	MinTTL      time.Duration // Answers with lower TTLs are kept this long
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration // For NXDOMAIN answers without a SOA record
+	MaxEntries  int
+	Timeout     time.Duration // Of a lookup, retries included
+}
+
+// DNSCache resolves hosts with its own queries, caching answers for their TTL and
+// NXDOMAIN answers for the SOA minimum. Concurrent lookups of a host share one query.
+type DNSCache struct {
+	config    DNSCacheConfig
+	exchanger DNSExchanger
+
+	mu       sync.Mutex
+	entries  map[string]*dnsEntry
+	inflight map[string]*dnsCall
+}
+
+type dnsEntry struct {
+	addrs     []net.IPAddr
+	notFound  bool
+	expires   time.Time
+	refreshAt time.Time // Prefetching renews the entry after this
+}
+
+type dnsCall struct {
+	done  chan struct{}
+	entry *dnsEntry
+	err   error
+}
+
+var dnsCache = NewDNSCache(DNSCacheConfig{
+	MinTTL:      time.Minute,
+	MaxTTL:      time.Hour,
+	NegativeTTL: time.Minute * 10,
+	MaxEntries:  1_000_000,
+	Timeout:     time.Second * 10,
+}, &UDPExchanger{Servers: dnsResolvers})
+
+// SetDNSCache sets the resolver of direct dials. It must be called before dialing.
+func SetDNSCache(cache *DNSCache) {
+	dnsCache = cache
+	FasthttpDialer.Resolver = cache
+}
+
+// PrefetchDNS resolves the host in the background, unless its answer is cached and fresh,
+// or fetches go through proxies, which resolve it themselves.
+func PrefetchDNS(host string) {
+	if proxyPool != nil && !proxyPool.resolvesLocally() {
+		return
+	}
+	dnsCache.Prefetch(host)
+}
+
+func NewDNSCache(config DNSCacheConfig, exchanger DNSExchanger) *DNSCache {
+	return &DNSCache{
+		config:    config,
+		exchanger: exchanger,
+		entries:   make(map[string]*dnsEntry),
+		inflight:  make(map[string]*dnsCall),
+	}
+}
+
+// LookupIPAddr resolves the host, so the cache can stand in for net.Resolver in fasthttp dialers.
+func (cache *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return net.DefaultResolver.LookupIPAddr(ctx, host) // Public resolvers don't know it, e.g. for local proxies
+	}
+
+	cache.mu.Lock()
+	if entry, ok := cache.entries[host]; ok && time.Now().Before(entry.expires) {
+		cache.mu.Unlock()
+		if entry.notFound {
+			metrics.DNSLookupCount.WithLabelValues("negative_hit").Inc()
+			return nil, notFoundError(host)
+		}
+		metrics.DNSLookupCount.WithLabelValues("hit").Inc()
+		return entry.addrs, nil
+	}
+	call, coalesced := cache.inflight[host]
+	if !coalesced {
+		call = cache.start(host)
+	}
+	cache.mu.Unlock()
+
+	if coalesced {
+		metrics.DNSLookupCount.WithLabelValues("coalesced").Inc()
+	} else {
+		metrics.DNSLookupCount.WithLabelValues("miss").Inc()
+	}
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	if call.entry.notFound {
+		return nil, notFoundError(host)
+	}
+	return call.entry.addrs, nil
+}
+
+// Prefetch resolves the host in the background if it isn't cached, or its answer is about to expire.
+func (cache *DNSCache) Prefetch(host string) {
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if entry, ok := cache.entries[host]; ok && time.Now().Before(entry.refreshAt) {
+		return
+	}
+	if _, ok := cache.inflight[host]; ok {
+		return
+	}
+	metrics.DNSPrefetchCount.Inc()
+	cache.start(host)
+}
+
+// start resolves the host in the background. It's detached from callers, so one giving up
+// doesn't fail the others. Must be called with the lock held.
+func (cache *DNSCache) start(host string) *dnsCall {
+	call := &dnsCall{done: make(chan struct{})}
+	cache.inflight[host] = call
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cache.config.Timeout)
+		defer cancel()
+		call.entry, call.err = cache.resolve(ctx, host)
+
+		cache.mu.Lock()
+		delete(cache.inflight, host)
+		if call.err == nil {
+			if _, ok := cache.entries[host]; !ok && len(cache.entries) >= cache.config.MaxEntries {
+				for evicted := range cache.entries {
+					delete(cache.entries, evicted) // Evict any
+					break
+				}
+			}
+			cache.entries[host] = call.entry
+		}
+		cache.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// resolve queries A and AAAA records of the host in parallel.
+func (cache *DNSCache) resolve(ctx context.Context, host string) (*dnsEntry, error) {
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]*dnsAnswer, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			answers[i], errs[i] = cache.query(ctx, host, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	entry := &dnsEntry{}
+	ttl := time.Duration(-1)
+	notFound := false
+	for i, answer := range answers {
+		if errs[i] != nil {
+			continue
+		}
+		entry.addrs = append(entry.addrs, answer.addrs...)
+		if len(answer.addrs) > 0 && (ttl < 0 || answer.ttl < ttl) {
+			ttl = answer.ttl
+		}
+		notFound = notFound || answer.notFound
+	}
+
+	switch {
+	case len(entry.addrs) > 0:
+		metrics.DNSLookupCount.WithLabelValues("resolved").Inc()
+	case notFound || (errs[0] == nil && errs[1] == nil):
+		// NXDOMAIN, or the host has no addresses at all
+		metrics.DNSLookupCount.WithLabelValues("nxdomain").Inc()
+		entry.notFound = true
+		ttl = cache.config.NegativeTTL
+		for i, answer := range answers {
+			if errs[i] == nil && answer.negativeTTL >= 0 && answer.negativeTTL < ttl {
+				ttl = answer.negativeTTL
+			}
+		}
+	default:
+		metrics.DNSLookupCount.WithLabelValues("error").Inc()
+		return nil, &net.DNSError{Err: errors.Join(errs...).Error(), Name: host, IsTemporary: true}
+	}
+
+	if ttl < cache.config.MinTTL {
+		ttl = cache.config.MinTTL
+	}
+	if ttl > cache.config.MaxTTL {
+		ttl = cache.config.MaxTTL
+	}
+	now := time.Now()
+	entry.expires = now.Add(ttl)
+	entry.refreshAt = now.Add(ttl * 9 / 10)
+	return entry, nil
+}
+
+type dnsAnswer struct {
+	addrs       []net.IPAddr
+	ttl         time.Duration // Lowest of the address records
+	notFound    bool
+	negativeTTL time.Duration // From the SOA record of negative answers, -1 if there's none
+}
+
+func (cache *DNSCache) query(ctx context.Context, host string, qtype dnsmessage.Type) (*dnsAnswer, error) {
+	query, id, err := buildDNSQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	response, err := cache.exchanger.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSAnswer(response, id)
+}
+
+// buildDNSQuery returns a recursive query for the host with a random ID.
+func buildDNSQuery(host string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("dns name: %w", err)
+	}
+	id := uint16(rand.Uint32())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, fmt.Errorf("dns question: %w", err)
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, 0, fmt.Errorf("dns query: %w", err)
+	}
+	return query, id, nil
+}
+
+func parseDNSAnswer(response []byte, id uint16) (*dnsAnswer, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, fmt.Errorf("parse dns response: %w", err)
+	}
+	if header.ID != id {
+		return nil, errors.New("dns response id mismatch")
+	}
+	answer := &dnsAnswer{negativeTTL: -1}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		answer.notFound = true
+	default:
+		return nil, fmt.Errorf("dns response code: %s", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("parse dns response: %w", err)
+	}
+
+	// CNAME chains come with the records of their target, so all address records are the host's
+	for {
+		resource, err := parser.Answer()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse dns answer: %w", err)
+		}
+		ttl := time.Duration(resource.Header.TTL) * time.Second
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			answer.addrs = append(answer.addrs, net.IPAddr{IP: net.IP(body.A[:])})
+		case *dnsmessage.AAAAResource:
+			answer.addrs = append(answer.addrs, net.IPAddr{IP: net.IP(body.AAAA[:])})
+		default:
+			continue
+		}
+		if len(answer.addrs) == 1 || ttl < answer.ttl {
+			answer.ttl = ttl
+		}
+	}
+
+	if len(answer.addrs) == 0 {
+		for {
+			resource, err := parser.Authority()
+			if err != nil {
+				break // Done, or nothing we need
+			}
+			if soa, ok := resource.Body.(*dnsmessage.SOAResource); ok {
+				negativeTTL := resource.Header.TTL
+				if soa.MinTTL < negativeTTL {
+					negativeTTL = soa.MinTTL
+				}
+				answer.negativeTTL = time.Duration(negativeTTL) * time.Second
+			}
+		}
+	}
+	return answer, nil
+}
+
+func notFoundError(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type stubDNS struct {
+	addr    string
+	queries atomic.Int32
+	mute    atomic.Bool // Don't answer
+	refuse  atomic.Bool // Answer REFUSED
+}
+
+// startStubDNS answers A queries from records with a 300s TTL, and NXDOMAIN for other names.
+// A "*" record answers all names.
+func startStubDNS(t *testing.T, records map[string]string) *stubDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	stub := &stubDNS{addr: conn.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			stub.queries.Add(1)
+			if stub.mute.Load() {
+				continue
+			}
+			if response := stubDNSResponse(buf[:n], records); response != nil {
+				if stub.refuse.Load() {
+					response[3] = response[3]&0xf0 | byte(dnsmessage.RCodeRefused) // RCODE is the low half of the 4th header byte
+				}
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return stub
+}
+
+func stubDNSResponse(query []byte, records map[string]string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	name := question.Name.String()
+	ip, found := records[name[:len(name)-1]]
+	if wildcard, ok := records["*"]; ok {
+		ip, found = wildcard, true
+	}
+
+	responseHeader := dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true}
+	if !found {
+		responseHeader.RCode = dnsmessage.RCodeNameError
+	}
+	builder := dnsmessage.NewBuilder(nil, responseHeader)
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+	if found && question.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], net.ParseIP(ip).To4())
+		builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 300}, a)
+	}
+	builder.StartAuthorities()
+	if !found {
+		builder.SOAResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Class: dnsmessage.ClassINET, TTL: 3600},
+			dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("admin.test."), MinTTL: 60})
+	}
+	response, _ := builder.Finish()
+	return response
+}
+
+func TestDNSCache(t *testing.T) {
+	server := startStubDNS(t, map[string]string{"a.test": "10.0.0.1"})
+	cache := NewDNSCache(DNSCacheConfig{MaxTTL: time.Hour, NegativeTTL: time.Hour, MaxEntries: 10, Timeout: time.Second},
+		&UDPExchanger{Servers: []string{server.addr}})
+
+	// Concurrent lookups share one query per record type
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := cache.LookupIPAddr(context.Background(), "a.test")
+			assert.NoError(t, err)
+			if assert.Len(t, addrs, 1) {
+				assert.Equal(t, "10.0.0.1", addrs[0].IP.String())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), server.queries.Load())
+
+	_, err := cache.LookupIPAddr(context.Background(), "A.test.")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), server.queries.Load(), "cached")
+
+	// NXDOMAIN is cached too, for the SOA minimum
+	for i := 0; i < 2; i++ {
+		_, err = cache.LookupIPAddr(context.Background(), "missing.test")
+		var dnsErr *net.DNSError
+		assert.True(t, errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+		assert.Contains(t, err.Error(), "no such host")
+	}
+	assert.Equal(t, int32(4), server.queries.Load())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), cache.entries["missing.test"].expires, time.Second)
+
+	// Prefetch skips fresh entries
+	cache.Prefetch("a.test")
+	assert.Equal(t, int32(4), server.queries.Load())
+}
+
+func TestPrefetchDNSSkipsProxies(t *testing.T) {
+	server := startStubDNS(t, map[string]string{"*": "10.0.0.1"})
+	previousCache, previousResolver, previousPool := dnsCache, FasthttpDialer.Resolver, proxyPool
+	t.Cleanup(func() {
+		dnsCache, FasthttpDialer.Resolver, proxyPool = previousCache, previousResolver, previousPool
+	})
+	SetDNSCache(NewDNSCache(DNSCacheConfig{MaxTTL: time.Hour, NegativeTTL: time.Hour, MaxEntries: 10, Timeout: time.Second},
+		&UDPExchanger{Servers: []string{server.addr}}))
+
+	// Proxies resolve the host themselves
+	pool, err := NewProxyPool([]string{"http://proxy.test:8080", "socks5://proxy.test:1080"}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	SetProxyPool(pool)
+	PrefetchDNS("a.test")
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int32(0), server.queries.Load())
+
+	// Direct dials don't
+	pool, err = NewProxyPool([]string{"http://proxy.test:8080", "direct://"}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	SetProxyPool(pool)
+	PrefetchDNS("a.test")
+	assert.Eventually(t, func() bool { return server.queries.Load() > 0 }, time.Second, time.Millisecond*10)
+}
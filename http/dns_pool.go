@@ -0,0 +1,415 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var ErrNoHealthyDNSServer = errors.New("no healthy dns server available")
+
+// DNS server drop reasons
+const (
+	DNSDropErrors   = "errors"   // Too many timeouts or failed queries
+	DNSDropLatency  = "latency"  // Too slow
+	DNSDropHijack   = "hijack"   // Answers names that don't exist
+	DNSDropMismatch = "mismatch" // Answers disagree with trusted resolvers
+)
+
+// DNSPoolConfig decides when resolvers are dropped from the pool.
+type DNSPoolConfig struct {
+	MaxErrorRate  float64       // Of timeouts and failed queries, as a moving average
+	MaxLatency    time.Duration // Moving average
+	MinQueries    int           // Before the error rate and latency count
+	Timeout       time.Duration // Of a query to one resolver
+	CheckInterval time.Duration
+	ProbeName     string   // A name every resolver should resolve
+	Trusted       []string // Resolvers trusted from the start. Others are cross-checked first, unless there are none.
+	CrossChecks   int      // Answers of a new resolver compared with a trusted one's before it's trusted
+}
+
+// DNSPool spreads queries over resolvers, preferring the fast and reliable ones. Resolvers that
+// keep failing, answer SERVFAIL or REFUSED, are too slow or answer names that don't exist are dropped,
+// and re-admitted once they pass the periodic checks again. New resolvers don't answer queries until
+// a sample of trusted answers was sent to them too, and they mostly agreed.
+type DNSPool struct {
+	config DNSPoolConfig
+
+	mu      sync.Mutex
+	servers []*dnsServer
+}
+
+type dnsServer struct {
+	addr      string
+	latency   time.Duration // Moving average
+	errorRate float64       // Moving average
+	queries   int
+	dropped   bool
+
+	trusted    bool
+	checking   bool // A cross-check is in flight
+	checks     int  // Cross-checked answers
+	mismatches int  // Cross-checked answers that disagreed
+}
+
+const dnsPoolSmoothing = 0.1 // Weight of the latest query in the moving averages
+
+func NewDNSPool(servers []string, config DNSPoolConfig) (*DNSPool, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no dns servers")
+	}
+	pool := &DNSPool{config: config}
+	trusted := make(map[string]bool)
+	for _, addr := range config.Trusted {
+		trusted[addr] = true
+	}
+	seen := make(map[string]bool)
+	for _, addr := range servers {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if strings.HasPrefix(addr, "https://") || strings.HasPrefix(addr, "tls://") {
+			if _, _, err := secureDNSAddr(addr); err != nil {
+				return nil, err
+			}
+		}
+		pool.servers = append(pool.servers, &dnsServer{addr: addr, trusted: trusted[addr] || len(trusted) == 0 || config.CrossChecks == 0})
+	}
+	metrics.DNSServerCount.WithLabelValues("healthy").Set(float64(len(pool.servers)))
+	metrics.DNSServerCount.WithLabelValues("dropped").Set(0)
+	return pool, nil
+}
+
+// Exchange sends the query to a healthy resolver, retrying once with another one.
+func (pool *DNSPool) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var tried *dnsServer
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		server := pool.pick(tried)
+		if server == nil {
+			break
+		}
+		tried = server
+
+		queryCtx, cancel := context.WithTimeout(ctx, pool.config.Timeout)
+		startTime := time.Now()
+		response, err := exchangeServer(queryCtx, server.addr, query)
+		cancel()
+		if err == nil {
+			err = dnsServerFailure(response)
+		}
+		pool.report(server, time.Since(startTime), err)
+		if err == nil {
+			if unchecked := pool.uncheckedServer(server); unchecked != nil {
+				go pool.crossCheck(unchecked, query, response)
+			}
+			return response, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		return nil, ErrNoHealthyDNSServer
+	}
+	return nil, lastErr
+}
+
+// exchangeServer sends the query over the protocol of the server:
+//
+//	1.1.1.1 or 1.1.1.1:53                          UDP, TCP for truncated answers
+//	tls://1.1.1.1 or tls://1.1.1.1:853             DNS-over-TLS
+//	https://cloudflare-dns.com/dns-query#1.1.1.1   DNS-over-HTTPS, dialing the bootstrap IP after #
+func exchangeServer(ctx context.Context, server string, query []byte) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		return exchangeDoH(ctx, server, query)
+	case strings.HasPrefix(server, "tls://"):
+		return exchangeDoT(ctx, server, query)
+	default:
+		return exchangeUDP(ctx, server, query)
+	}
+}
+
+// dnsServerFailure returns an error for SERVFAIL and REFUSED answers, which are the resolver's failure
+// rather than an answer about the name.
+func dnsServerFailure(response []byte) error {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return fmt.Errorf("parse dns response: %w", err)
+	}
+	if header.RCode == dnsmessage.RCodeServerFailure || header.RCode == dnsmessage.RCodeRefused {
+		return fmt.Errorf("dns response code: %s", header.RCode)
+	}
+	return nil
+}
+
+// pick returns the better scored of two random healthy resolvers, other than the excluded one.
+// Resolvers not trusted yet are only picked if no trusted one is healthy.
+func (pool *DNSPool) pick(exclude *dnsServer) *dnsServer {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	healthy := make([]*dnsServer, 0, len(pool.servers))
+	for _, trusted := range []bool{true, false} {
+		for _, server := range pool.servers {
+			if !server.dropped && server != exclude && server.trusted == trusted {
+				healthy = append(healthy, server)
+			}
+		}
+		if len(healthy) > 0 {
+			break
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	first, second := healthy[rand.Intn(len(healthy))], healthy[rand.Intn(len(healthy))]
+	if second.score() < first.score() {
+		return second
+	}
+	return first
+}
+
+// score is the expected cost of a query, lower is better. Resolvers without queries go first.
+func (server *dnsServer) score() float64 {
+	return float64(server.latency) * (1 + 10*server.errorRate)
+}
+
+func (pool *DNSPool) report(server *dnsServer, latency time.Duration, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.record(server, latency, err)
+}
+
+// record updates the moving averages of the resolver, dropping it if it's unhealthy.
+// Must be called with the lock held.
+func (pool *DNSPool) record(server *dnsServer, latency time.Duration, err error) {
+	server.queries++
+	failed := 0.0
+	if err != nil {
+		failed = 1
+		latency = pool.config.Timeout
+	}
+	server.errorRate += dnsPoolSmoothing * (failed - server.errorRate)
+	if server.latency == 0 {
+		server.latency = latency
+	} else {
+		server.latency += time.Duration(dnsPoolSmoothing * float64(latency-server.latency))
+	}
+
+	if server.dropped || server.queries < pool.config.MinQueries {
+		return
+	}
+	switch {
+	case server.errorRate > pool.config.MaxErrorRate:
+		pool.drop(server, DNSDropErrors, false)
+	case pool.config.MaxLatency > 0 && server.latency > pool.config.MaxLatency:
+		pool.drop(server, DNSDropLatency, false)
+	}
+}
+
+// uncheckedServer returns a healthy resolver that isn't trusted yet and has no cross-check
+// in flight, marking it as being checked. It returns nil if there is none, or if the resolver
+// that answered isn't trusted either.
+func (pool *DNSPool) uncheckedServer(answered *dnsServer) *dnsServer {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if !answered.trusted {
+		return nil
+	}
+	for _, server := range pool.servers {
+		if !server.trusted && !server.dropped && !server.checking {
+			server.checking = true
+			return server
+		}
+	}
+	return nil
+}
+
+// crossCheck sends a query a trusted resolver answered to a resolver that isn't trusted yet. Once it
+// answered CrossChecks of them, it's trusted if most answers agreed, and dropped otherwise.
+func (pool *DNSPool) crossCheck(server *dnsServer, query, trustedResponse []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), pool.config.Timeout)
+	startTime := time.Now()
+	response, err := exchangeServer(ctx, server.addr, query)
+	cancel()
+	if err == nil {
+		err = dnsServerFailure(response)
+	}
+	agreed := err == nil && dnsAnswersAgree(query, trustedResponse, response)
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	server.checking = false
+	pool.record(server, time.Since(startTime), err)
+	if err != nil || server.dropped {
+		return
+	}
+	server.checks++
+	if !agreed {
+		server.mismatches++
+	}
+	if server.checks < pool.config.CrossChecks {
+		return
+	}
+	if server.mismatches*2 > server.checks {
+		pool.drop(server, DNSDropMismatch, true)
+		return
+	}
+	server.trusted = true
+	log.Println("DNS server trusted:", server.addr)
+}
+
+// dnsAnswersAgree tells whether the checked answer to the query agrees with the trusted one: both find
+// the name or both don't, and they share an address. CDNs answer differently by resolver, but mostly overlap.
+func dnsAnswersAgree(query, trustedResponse, checkedResponse []byte) bool {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return false
+	}
+	trusted, err := parseDNSAnswer(trustedResponse, header.ID)
+	if err != nil {
+		return true // Nothing to compare with
+	}
+	checked, err := parseDNSAnswer(checkedResponse, header.ID)
+	if err != nil || checked.notFound != trusted.notFound {
+		return false
+	}
+	if len(trusted.addrs) == 0 || len(checked.addrs) == 0 {
+		return len(trusted.addrs) == len(checked.addrs)
+	}
+	for _, checkedAddr := range checked.addrs {
+		for _, trustedAddr := range trusted.addrs {
+			if checkedAddr.IP.Equal(trustedAddr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drop takes the resolver out of rotation. Unless forced, the last healthy one is kept.
+// Must be called with the lock held.
+func (pool *DNSPool) drop(server *dnsServer, reason string, force bool) {
+	if !force && pool.healthyCount() <= 1 {
+		return
+	}
+	server.dropped = true
+	metrics.DNSServerDropCount.WithLabelValues(reason).Inc()
+	pool.updateCounts()
+	log.Println("DNS server dropped:", server.addr, reason)
+}
+
+func (pool *DNSPool) healthyCount() int {
+	healthy := 0
+	for _, server := range pool.servers {
+		if !server.dropped {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+func (pool *DNSPool) updateCounts() {
+	healthy := pool.healthyCount()
+	metrics.DNSServerCount.WithLabelValues("healthy").Set(float64(healthy))
+	metrics.DNSServerCount.WithLabelValues("dropped").Set(float64(len(pool.servers) - healthy))
+}
+
+// StartHealthChecks checks all resolvers periodically.
+func (pool *DNSPool) StartHealthChecks() {
+	ticker := time.NewTicker(pool.config.CheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pool.Check()
+	}
+}
+
+// Check probes every resolver with the probe name, which it must resolve, and a random name that
+// doesn't exist, which it must not. Dropped resolvers passing both are re-admitted.
+func (pool *DNSPool) Check() {
+	pool.mu.Lock()
+	servers := append([]*dnsServer(nil), pool.servers...)
+	pool.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *dnsServer) {
+			defer wg.Done()
+			pool.check(server)
+		}(server)
+	}
+	wg.Wait()
+}
+
+func (pool *DNSPool) check(server *dnsServer) {
+	startTime := time.Now()
+	answer, err := pool.probe(server.addr, pool.config.ProbeName)
+	if err == nil && len(answer.addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", pool.config.ProbeName)
+	}
+	latency := time.Since(startTime)
+
+	var hijacked bool
+	if err == nil {
+		missing, missingErr := pool.probe(server.addr, fmt.Sprintf("qs-%08x.invalid", rand.Uint32()))
+		hijacked = missingErr == nil && len(missing.addrs) > 0
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	switch {
+	case hijacked:
+		if !server.dropped {
+			pool.drop(server, DNSDropHijack, true)
+		}
+	case server.dropped:
+		if err == nil && (pool.config.MaxLatency == 0 || latency <= pool.config.MaxLatency) {
+			server.dropped, server.queries, server.errorRate, server.latency = false, 0, 0, latency
+			server.checks, server.mismatches = 0, 0 // Untrusted ones are cross-checked again
+			pool.updateCounts()
+			log.Println("DNS server back in rotation:", server.addr)
+		}
+	default:
+		pool.record(server, latency, err)
+	}
+}
+
+func (pool *DNSPool) probe(server, name string) (*dnsAnswer, error) {
+	query, id, err := buildDNSQuery(name, dnsmessage.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pool.config.Timeout)
+	defer cancel()
+	response, err := exchangeServer(ctx, server, query)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSAnswer(response, id)
+}
+
+// LoadDNSServerFile reads the reliable resolvers of a public-dns.info style JSON file.
+// They aren't checked up front like FetchReliableDNSRecords does, the pool checks them.
+func LoadDNSServerFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read dns server file: %w", err)
+	}
+	return parseReliableDNSRecords(data)
+}
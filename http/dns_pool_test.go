@@ -0,0 +1,99 @@
+package http
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSPool(t *testing.T) {
+	good := startStubDNS(t, map[string]string{"probe.test": "10.0.0.1"})
+	hijacking := startStubDNS(t, map[string]string{"*": "10.6.6.6"})
+	flaky := startStubDNS(t, map[string]string{"probe.test": "10.0.0.1"})
+	flaky.mute.Store(true)
+
+	pool, err := NewDNSPool([]string{good.addr, hijacking.addr, flaky.addr}, DNSPoolConfig{
+		MaxErrorRate: 0.15,
+		MinQueries:   2,
+		Timeout:      time.Millisecond * 100,
+		ProbeName:    "probe.test",
+	})
+	assert.NoError(t, err)
+
+	// The hijacking resolver goes at once, the flaky one once it has enough failures
+	pool.Check()
+	assert.True(t, pool.servers[1].dropped, "hijacking")
+	assert.False(t, pool.servers[2].dropped, "flaky after one failure")
+	pool.Check()
+	assert.True(t, pool.servers[2].dropped, "flaky after two failures")
+	assert.False(t, pool.servers[0].dropped, "good")
+
+	before := good.queries.Load()
+	for i := 0; i < 5; i++ {
+		query, id, err := buildDNSQuery("probe.test", dnsmessage.TypeA)
+		assert.NoError(t, err)
+		response, err := pool.Exchange(context.Background(), query)
+		assert.NoError(t, err)
+		answer, err := parseDNSAnswer(response, id)
+		assert.NoError(t, err)
+		assert.Len(t, answer.addrs, 1)
+	}
+	assert.Equal(t, before+5, good.queries.Load(), "only the good resolver is used")
+
+	// Re-admitted once it answers again
+	flaky.mute.Store(false)
+	pool.Check()
+	assert.False(t, pool.servers[2].dropped, "recovered")
+	assert.True(t, pool.servers[1].dropped, "still hijacking")
+}
+
+func TestDNSPoolCrossChecks(t *testing.T) {
+	good := startStubDNS(t, map[string]string{"a.test": "10.0.0.1"})
+	refusing := startStubDNS(t, map[string]string{"a.test": "10.0.0.1"})
+	refusing.refuse.Store(true)
+	honest := startStubDNS(t, map[string]string{"a.test": "10.0.0.1"})
+	lying := startStubDNS(t, map[string]string{"*": "10.6.6.6"})
+
+	pool, err := NewDNSPool([]string{good.addr, refusing.addr, honest.addr, lying.addr}, DNSPoolConfig{
+		MaxErrorRate: 0.15,
+		MinQueries:   2,
+		Timeout:      time.Millisecond * 100,
+		Trusted:      []string{good.addr, refusing.addr},
+		CrossChecks:  2,
+	})
+	assert.NoError(t, err)
+	state := func(i int) (trusted, dropped bool) {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.servers[i].trusted, pool.servers[i].dropped
+	}
+
+	// REFUSED counts as a failure, new resolvers answer once they agree with trusted ones
+	for i := 0; i < 200; i++ {
+		query, id, err := buildDNSQuery("a.test", dnsmessage.TypeA)
+		assert.NoError(t, err)
+		response, err := pool.Exchange(context.Background(), query)
+		assert.NoError(t, err)
+		answer, err := parseDNSAnswer(response, id)
+		if assert.NoError(t, err) && assert.Len(t, answer.addrs, 1) {
+			assert.Equal(t, "10.0.0.1", answer.addrs[0].IP.String())
+		}
+		time.Sleep(time.Millisecond * 5)
+
+		_, refusingDropped := state(1)
+		honestTrusted, _ := state(2)
+		_, lyingDropped := state(3)
+		if refusingDropped && honestTrusted && lyingDropped {
+			break
+		}
+	}
+	_, dropped := state(1)
+	assert.True(t, dropped, "refusing")
+	trusted, dropped := state(2)
+	assert.True(t, trusted && !dropped, "honest")
+	trusted, dropped = state(3)
+	assert.True(t, !trusted && dropped, "lying")
+}
@@ -0,0 +1,188 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsTLSConfig verifies DoH and DoT resolvers, independent of the TLS mode of crawling.
+var dnsTLSConfig = &tls.Config{}
+
+var dohClient = newDoHClient()
+
+// dohIPs keeps the IP to dial each DoH resolver at, by the host:port of its URL.
+var dohIPs sync.Map
+
+func newDoHClient() *http.Client {
+	return &http.Client{
+		Timeout: time.Second * 10,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				ip, ok := dohIPs.Load(addr)
+				if !ok {
+					return nil, fmt.Errorf("no ip to dial doh resolver %s", addr)
+				}
+				_, port, _ := net.SplitHostPort(addr)
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ip.(string), port))
+			},
+			TLSClientConfig:     dnsTLSConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     time.Second * 90,
+		},
+	}
+}
+
+// secureDNSAddr returns the host:port of a DoH or DoT resolver, and the IP to dial it at: its host if that's
+// an IP, or the bootstrap IP after #, as in https://dns.google/dns-query#8.8.8.8. Resolver names are never
+// looked up with the system resolver, that would leak them over the plain DNS these protocols avoid.
+func secureDNSAddr(server string) (addr, ip string, err error) {
+	var host, port, bootstrap string
+	if strings.HasPrefix(server, "https://") {
+		u, err := url.Parse(server)
+		if err != nil {
+			return "", "", fmt.Errorf("parse doh url: %w", err)
+		}
+		host, port, bootstrap = u.Hostname(), u.Port(), u.Fragment
+		if port == "" {
+			port = "443"
+		}
+	} else {
+		var target string
+		target, bootstrap, _ = strings.Cut(strings.TrimPrefix(server, "tls://"), "#")
+		if host, port, err = net.SplitHostPort(withDefaultPort(target, "853")); err != nil {
+			return "", "", fmt.Errorf("split host port: %w", err)
+		}
+	}
+	addr = net.JoinHostPort(host, port)
+	switch {
+	case bootstrap != "":
+		if net.ParseIP(bootstrap) == nil {
+			return "", "", fmt.Errorf("bootstrap of dns server %s is not an ip", server)
+		}
+		return addr, bootstrap, nil
+	case net.ParseIP(host) != nil:
+		return addr, host, nil
+	default:
+		return "", "", fmt.Errorf("dns server %s needs an ip, or a bootstrap ip after #", server)
+	}
+}
+
+const dnsMessageType = "application/dns-message"
+
+// exchangeDoH posts the query to a DNS-over-HTTPS resolver URL (RFC 8484).
+func exchangeDoH(ctx context.Context, server string, query []byte) ([]byte, error) {
+	// ID 0 makes responses cacheable by HTTP caches, the caller's ID is put back on the response
+	id := query[:2:2]
+	query = append([]byte{0, 0}, query[2:]...)
+
+	addr, ip, err := secureDNSAddr(server)
+	if err != nil {
+		return nil, err
+	}
+	dohIPs.Store(addr, ip)
+	server, _, _ = strings.Cut(server, "#")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("new doh request: %w", err)
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	res, err := dohClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("doh request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status not 200: %d", res.StatusCode)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != dnsMessageType {
+		return nil, fmt.Errorf("doh content type: %q", contentType)
+	}
+	response, err := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err != nil {
+		return nil, fmt.Errorf("read doh response: %w", err)
+	}
+	if len(response) < 2 {
+		return nil, errors.New("doh response too short")
+	}
+	copy(response, id)
+	return response, nil
+}
+
+// dotConns keeps idle DNS-over-TLS connections per resolver, since handshakes cost more than queries.
+var dotConns sync.Map // Resolver address to chan *tls.Conn
+
+const dotIdleConns = 4
+
+// exchangeDoT sends the query to a DNS-over-TLS resolver (RFC 7858), reusing an idle connection if there is one.
+func exchangeDoT(ctx context.Context, server string, query []byte) ([]byte, error) {
+	addr, ip, err := secureDNSAddr(server)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := dotConns.LoadOrStore(server, make(chan *tls.Conn, dotIdleConns))
+	idle := value.(chan *tls.Conn)
+
+	for {
+		var conn *tls.Conn
+		reused := false
+		select {
+		case conn = <-idle:
+			reused = true
+		default:
+			var err error
+			if conn, err = dialDoT(ctx, addr, ip); err != nil {
+				return nil, err
+			}
+		}
+
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(time.Second * 10)
+		}
+		conn.SetDeadline(deadline)
+		response, err := exchangeStream(conn, query)
+		if err != nil {
+			conn.Close()
+			if reused && ctx.Err() == nil {
+				continue // The resolver may have closed the idle connection, retry on a new one
+			}
+			return nil, err
+		}
+
+		select {
+		case idle <- conn:
+		default:
+			conn.Close()
+		}
+		return response, nil
+	}
+}
+
+// dialDoT connects to the resolver at ip, verifying it as the host of addr.
+func dialDoT(ctx context.Context, addr, ip string) (*tls.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("split host port: %w", err)
+	}
+	config := dnsTLSConfig.Clone()
+	config.ServerName = host
+	dialer := tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		return nil, fmt.Errorf("dial dot %s: %w", addr, err)
+	}
+	return conn.(*tls.Conn), nil
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSOverHTTPSAndTLS(t *testing.T) {
+	records := map[string]string{"a.test": "10.0.0.1"}
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		if query[0] != 0 || query[1] != 0 {
+			w.WriteHeader(http.StatusBadRequest) // RFC 8484 clients should send ID 0
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(stubDNSResponse(query, records))
+	}))
+	defer doh.Close()
+
+	// DoT with the certificate of the DoH server
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	assert.NoError(t, err)
+	defer ln.Close()
+	var dotConnections atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			dotConnections.Add(1)
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(reader, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(reader, query); err != nil {
+						return
+					}
+					response := stubDNSResponse(query, records)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+
+	previousConfig, previousClient := dnsTLSConfig, dohClient
+	defer func() { dnsTLSConfig, dohClient = previousConfig, previousClient }()
+	dnsTLSConfig = doh.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	dohClient = newDoHClient()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	_, dohPort, _ := net.SplitHostPort(doh.Listener.Addr().String())
+	_, err = NewDNSPool([]string{"https://example.com:" + dohPort + "/dns-query"}, DNSPoolConfig{})
+	assert.ErrorContains(t, err, "bootstrap", "resolver names aren't looked up")
+	for _, server := range []string{
+		doh.URL + "/dns-query",
+		"https://example.com:" + dohPort + "/dns-query#127.0.0.1",
+		"tls://127.0.0.1:" + port,
+		"tls://example.com:" + port + "#127.0.0.1",
+	} {
+		pool, err := NewDNSPool([]string{server}, DNSPoolConfig{MaxErrorRate: 0.5, Timeout: time.Second})
+		assert.NoError(t, err)
+		cache := NewDNSCache(DNSCacheConfig{MaxTTL: time.Hour, NegativeTTL: time.Hour, MaxEntries: 10, Timeout: time.Second}, pool)
+
+		addrs, err := cache.LookupIPAddr(context.Background(), "a.test")
+		assert.NoError(t, err, server)
+		if assert.Len(t, addrs, 1, server) {
+			assert.Equal(t, "10.0.0.1", addrs[0].IP.String())
+		}
+		_, err = cache.LookupIPAddr(context.Background(), "missing.test")
+		assert.ErrorContains(t, err, "no such host", server)
+	}
+	assert.LessOrEqual(t, dotConnections.Load(), int32(4), "idle DoT connections are reused, two per resolver for A and AAAA")
+}
@@ -2,7 +2,9 @@ package http
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/base64"
+	"fmt"
 	"net"
 	"strings"
 	"time"
@@ -10,6 +12,29 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
+// ProxyConnectError is returned when the proxy answers the CONNECT request with a non 200 status.
+type ProxyConnectError struct {
+	Proxy      string
+	StatusCode int
+}
+
+func (e *ProxyConnectError) Error() string {
+	return fmt.Sprintf("could not connect to proxy: %s status code: %d", e.Proxy, e.StatusCode)
+}
+
+// proxyError is a failure to reach the proxy itself, rather than the target behind it.
+type proxyError struct {
+	err error
+}
+
+func (e *proxyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.err
+}
+
 // FasthttpHTTPDialer returns a fasthttp.DialFunc that dials using
 // the provided HTTP proxy.
 //
@@ -30,6 +55,16 @@ func FasthttpHTTPDialerProxy(proxy string) fasthttp.DialFunc {
 //	c := &fasthttp.Client{
 //		Dial: fasthttpproxy.FasthttpHTTPDialerTimeout("username:password@localhost:9050", time.Second * 2),
 func FasthttpHTTPDialerProxyTimeout(proxy string, timeout time.Duration) fasthttp.DialFunc {
+	return fasthttpConnectDialer(proxy, timeout, false)
+}
+
+// FasthttpHTTPSDialerProxyTimeout is like FasthttpHTTPDialerProxyTimeout,
+// but the connection to the proxy itself is wrapped in TLS.
+func FasthttpHTTPSDialerProxyTimeout(proxy string, timeout time.Duration) fasthttp.DialFunc {
+	return fasthttpConnectDialer(proxy, timeout, true)
+}
+
+func fasthttpConnectDialer(proxy string, timeout time.Duration, proxyTLS bool) fasthttp.DialFunc {
 	var auth string
 	if strings.Contains(proxy, "@") {
 		index := strings.LastIndex(proxy, "@")
@@ -46,7 +81,21 @@ func FasthttpHTTPDialerProxyTimeout(proxy string, timeout time.Duration) fasthtt
 			conn, err = FasthttpDialer.DialTimeout(proxy, timeout)
 		}
 		if err != nil {
-			return nil, err
+			return nil, &proxyError{err}
+		}
+
+		if proxyTLS {
+			host, _, _ := net.SplitHostPort(proxy)
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+			if timeout != 0 {
+				tlsConn.SetDeadline(time.Now().Add(timeout))
+			}
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, &proxyError{fmt.Errorf("proxy tls handshake: %w", err)}
+			}
+			tlsConn.SetDeadline(time.Time{})
+			conn = tlsConn
 		}
 
 		req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
@@ -56,6 +105,7 @@ func FasthttpHTTPDialerProxyTimeout(proxy string, timeout time.Duration) fasthtt
 		req += "\r\n"
 
 		if _, err := conn.Write([]byte(req)); err != nil {
+			conn.Close()
 			return nil, err
 		}
 
@@ -68,10 +118,10 @@ func FasthttpHTTPDialerProxyTimeout(proxy string, timeout time.Duration) fasthtt
 			conn.Close()
 			return nil, err
 		}
-		// if res.Header.StatusCode() != 200 {
-		// 	conn.Close()
-		// 	return nil, fmt.Errorf("could not connect to proxy: %s status code: %d", proxy, res.Header.StatusCode())
-		// }
+		if res.Header.StatusCode() != 200 {
+			conn.Close()
+			return nil, &ProxyConnectError{Proxy: proxy, StatusCode: res.Header.StatusCode()}
+		}
 		return conn, nil
 	}
 }
@@ -0,0 +1,76 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Fetcher backends
+const (
+	BackendFasthttp = "fasthttp" // HTTP/1.1 only, fastest
+	BackendHTTP2    = "http2"    // HTTP/2 for https, HTTP/1.1 for plain http
+	BackendAuto     = "auto"     // HTTP/2 or HTTP/1.1, negotiated via ALPN
+)
+
+// Fetcher fetches a single URL.
+type Fetcher interface {
+	Fetch(req *FetchRequest) (*FetchResult, error)
+}
+
+// FetchRequest describes a fetch. ETag and LastModified come from the previous fetch
+// and make it a conditional request.
+type FetchRequest struct {
+	URL            string
+	ETag           string
+	LastModified   string
+	AnyContentType bool // Accept bodies other than HTML and XML, e.g. for robots.txt
+
+	cassette *Cassette // Records the exchanges of the fetch, set by RecordingFetcher
+}
+
+// FetchResult is the outcome of a fetch. It's returned even if the fetch fails,
+// so the status code and connection details are still available.
+type FetchResult struct {
+	Body         []byte
+	StatusCode   int
+	Protocol     string
+	TLS          *TLSInfo
+	Truncated    bool // Body was cut off at the configured body limits
+	ETag         string
+	LastModified string
+	NotModified  bool          // Conditional request answered with 304, Body is empty
+	RetryAfter   time.Duration // How long a 429 or 503 asked to wait, zero if it didn't
+	RemoteIP     string        // IP of the server, only known for direct connections
+	Family       string        // Address family of RemoteIP, FamilyIPv4 or FamilyIPv6
+}
+
+// retryAfter parses the Retry-After header of 429 and 503 responses, given in seconds or as a date.
+func retryAfter(statusCode int, value string, now time.Time) time.Duration {
+	if (statusCode != http.StatusTooManyRequests && statusCode != http.StatusServiceUnavailable) || value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// NewFetcher creates the fetcher for the given backend.
+func NewFetcher(backend string) (Fetcher, error) {
+	switch backend {
+	case BackendFasthttp:
+		return FastFetcher{}, nil
+	case BackendHTTP2, BackendAuto:
+		return NewHTTPFetcher(backend), nil
+	default:
+		return nil, fmt.Errorf("unknown fetcher backend: %s", backend)
+	}
+}
+
+// FastFetcher fetches with fasthttp.
+type FastFetcher struct{}
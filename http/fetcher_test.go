@@ -0,0 +1,19 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Second*2, retryAfter(http.StatusTooManyRequests, "2", now))
+	assert.Equal(t, time.Minute, retryAfter(http.StatusServiceUnavailable, now.Add(time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, retryAfter(http.StatusServiceUnavailable, now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, retryAfter(http.StatusTooManyRequests, "soon", now))
+	assert.Zero(t, retryAfter(http.StatusOK, "2", now))
+}
@@ -1,25 +1,23 @@
 package http
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
-	"github.com/klauspost/compress/flate"
-	"github.com/klauspost/compress/gzip"
 	"golang.org/x/net/html/charset"
 )
 
 var client = &http.Client{
 	Timeout: time.Second * 180,
 	Transport: &http.Transport{
-		Proxy: GetProxyUrl(),
+		Proxy: pickProxyURL,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
 		},
@@ -29,15 +27,18 @@ var client = &http.Client{
 	},
 }
 
-const DefaultMaxBody int64 = 1024 * 1024 * 1024 // 1GB
-
-func GetProxyUrl() func(*http.Request) (*url.URL, error) {
-	proxyUrlStr := os.Getenv("PROXY_URL")
-	proxyUrl, err := url.Parse(proxyUrlStr)
+func pickProxyURL(req *http.Request) (*url.URL, error) {
+	if proxyPool == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	proxy, err := proxyPool.Pick(req.URL.Hostname())
 	if err != nil {
-		return http.ProxyFromEnvironment
+		return nil, fmt.Errorf("pick proxy: %w", err)
+	}
+	if proxy.URL.Scheme == "direct" {
+		return nil, nil
 	}
-	return http.ProxyURL(proxyUrl)
+	return proxy.URL, nil
 }
 
 func Get(requestURI string) ([]byte, int, error) {
@@ -46,18 +47,7 @@ func Get(requestURI string) ([]byte, int, error) {
 	if err != nil {
 		return nil, 0, fmt.Errorf("new request: %w", err)
 	}
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
-	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	req.Header.Set("Sec-Ch-Ua", `"Google Chrome";v="113", "Chromium";v="113", "Not-A.Brand";v="24"`)
-	req.Header.Set("Sec-Ch-Ua-Mobile", "?0")
-	req.Header.Set("Sec-Ch-Ua-Platform", `"macOS"`)
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "none")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36")
+	profileFor(req.URL.Host).set(req.Header)
 
 	// Do request
 	res, err := client.Do(req)
@@ -66,7 +56,7 @@ func Get(requestURI string) ([]byte, int, error) {
 	}
 	defer res.Body.Close()
 
-	body, err := handleResponse(res)
+	body, _, err := handleResponse(res, false)
 	if err != nil {
 		return nil, res.StatusCode, fmt.Errorf("handle response err: %w", err)
 	}
@@ -74,61 +64,44 @@ func Get(requestURI string) ([]byte, int, error) {
 	return body, res.StatusCode, nil
 }
 
-func handleResponse(res *http.Response) ([]byte, error) {
-	// Check if its HTML
+func handleResponse(res *http.Response, anyContentType bool) ([]byte, bool, error) {
+	// Check if its HTML, or XML for sitemaps
 	contentType := res.Header.Get("Content-Type")
-	if !strings.Contains(contentType, "html") {
-		return nil, fmt.Errorf("not HTML")
+	if !anyContentType && !strings.Contains(contentType, "html") && !strings.Contains(contentType, "xml") {
+		return nil, false, fmt.Errorf("not HTML")
 	}
 
 	// Check status code
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("status not 200: %v", res.Status)
+		return nil, false, fmt.Errorf("status not 200: %v", res.Status)
 	}
 
 	// Read and decode response body
-	body, err := decodeResponse(res)
+	body, truncated, err := decodeResponse(res)
 	if err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+		return nil, false, fmt.Errorf("decode response: %w", err)
 	}
 
-	return body, nil
+	return body, truncated, nil
 }
 
-func decodeResponse(resp *http.Response) ([]byte, error) {
-
-	// Limit response body reading
-	// bodyReader := io.LimitReader(resp.Body, DefaultMaxBody)
-
-	// Fast Decompress
-	var err error
-	var bodyReadCloser io.ReadCloser
-	switch resp.Header.Get("Content-Encoding") {
-	case "gzip":
-		bodyReadCloser, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("gzip reader: %w", err)
-		}
-		defer bodyReadCloser.Close()
-	case "deflate":
-		bodyReadCloser = flate.NewReader(resp.Body)
-		defer bodyReadCloser.Close()
-	default:
-		bodyReadCloser = resp.Body
+func decodeResponse(resp *http.Response) ([]byte, bool, error) {
+	// Limited read and decompress
+	contentType := resp.Header.Get("Content-Type")
+	body, truncated, err := readBody(resp.Body, resp.Header.Get("Content-Encoding"), bodyLimits.For(contentType))
+	if err != nil {
+		return nil, false, err
 	}
 
 	// Charset Decoding
-	contentType := resp.Header.Get("Content-Type")
-	bodyReader, err := charset.NewReader(bodyReadCloser, contentType)
+	bodyReader, err := charset.NewReader(bytes.NewReader(body), contentType)
 	if err != nil {
-		return nil, fmt.Errorf("charset detection error on content-type %s: %w", contentType, err)
+		return nil, false, fmt.Errorf("charset detection error on content-type %s: %w", contentType, err)
 	}
-
-	// Read Body
-	body, err := io.ReadAll(bodyReader)
+	body, err = io.ReadAll(bodyReader)
 	if err != nil {
-		return nil, fmt.Errorf("reading body: %w", err)
+		return nil, false, fmt.Errorf("reading body: %w", err)
 	}
 
-	return body, nil
+	return body, truncated, nil
 }
@@ -0,0 +1,177 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTPFetcher fetches with net/http and golang.org/x/net/http2.
+// Connections are pooled per host and HTTP/2 requests to the same host are multiplexed on them.
+type HTTPFetcher struct {
+	client *http.Client
+}
+
+func NewHTTPFetcher(backend string) *HTTPFetcher {
+	transport := &http.Transport{
+		DialContext:         dialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Second * 90,
+		DisableCompression:  true, // We decode ourselves, like the fasthttp path
+	}
+
+	switch backend {
+	case BackendHTTP2:
+		transport.RegisterProtocol("https", &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dialTLSContext(ctx, addr, []string{http2.NextProtoTLS})
+				if err != nil {
+					return nil, err
+				}
+				if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+					conn.Close()
+					return nil, fmt.Errorf("server does not support http2: %s", addr)
+				}
+				return conn, nil
+			},
+			DisableCompression: true,
+			ReadIdleTimeout:    time.Second * 30,
+		})
+	default:
+		// net/http only switches to HTTP/2 if the dialed connection is a *tls.Conn that negotiated h2
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLSContext(ctx, addr, []string{http2.NextProtoTLS, "http/1.1"})
+		}
+		transport.ForceAttemptHTTP2 = true
+		if _, err := http2.ConfigureTransports(transport); err != nil {
+			panic(err) // Only fails if the transport was already configured for HTTP/2
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   time.Second * 180,
+		Transport: recordingTransport{transport},
+	}
+	if cookieJar != nil {
+		client.Jar = cookieJar
+	}
+	return &HTTPFetcher{client: client}
+}
+
+func (f *HTTPFetcher) Fetch(fetchReq *FetchRequest) (*FetchResult, error) {
+	result := &FetchResult{}
+
+	req, err := http.NewRequest(http.MethodGet, fetchReq.URL, nil)
+	if err != nil {
+		return result, fmt.Errorf("new request: %w", err)
+	}
+	profileFor(req.URL.Host).set(req.Header)
+	if fetchReq.ETag != "" {
+		req.Header.Set("If-None-Match", fetchReq.ETag)
+	}
+	if fetchReq.LastModified != "" {
+		req.Header.Set("If-Modified-Since", fetchReq.LastModified)
+	}
+
+	// The connection tells which proxy it went through, and if it's direct, the server IP
+	var proxy *Proxy
+	req = req.WithContext(httptrace.WithClientTrace(withCassette(req.Context(), fetchReq.cassette), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+			if pooled, ok := conn.(*proxyConn); ok {
+				proxy = pooled.proxy
+				if proxy.direct() {
+					result.RemoteIP = remoteIP(pooled.RemoteAddr())
+					result.Family = ipFamily(result.RemoteIP)
+				}
+			}
+		},
+	}))
+
+	requestStartTime := time.Now()
+	res, err := f.client.Do(req)
+	if proxy != nil {
+		statusCode := 0
+		if err == nil {
+			statusCode = res.StatusCode
+		}
+		proxy.Report(statusCode, err, time.Since(requestStartTime))
+	}
+	if err != nil {
+		result.TLS = tlsInfoFromError(err)
+		return result, fmt.Errorf("client do: %w", err)
+	}
+	defer res.Body.Close()
+
+	result.StatusCode = res.StatusCode
+	result.RetryAfter = retryAfter(res.StatusCode, res.Header.Get("Retry-After"), time.Now())
+	result.Protocol = res.Proto
+	if res.TLS != nil && tlsMode != TLSVerifyOff {
+		result.TLS = newTLSInfo(*res.TLS, nil) // Verified by the handshake
+	}
+	result.ETag = res.Header.Get("ETag")
+	result.LastModified = res.Header.Get("Last-Modified")
+	if res.StatusCode == http.StatusNotModified {
+		result.NotModified = true
+		return result, nil
+	}
+
+	body, truncated, err := handleResponse(res, fetchReq.AnyContentType)
+	if err != nil {
+		return result, fmt.Errorf("handle response err: %w", err)
+	}
+	result.Body, result.Truncated = body, truncated
+
+	return result, nil
+}
+
+// dialContext dials through a proxy from the pool.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxyPool == nil {
+		return nil, fmt.Errorf("proxy pool not set")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("split host port: %w", err)
+	}
+	proxy, err := proxyPool.Pick(host)
+	if err != nil {
+		return nil, fmt.Errorf("pick proxy: %w", err)
+	}
+	conn, err := proxy.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{conn, proxy}, nil
+}
+
+// proxyConn remembers the proxy a connection goes through, to report requests made on it.
+type proxyConn struct {
+	net.Conn
+	proxy *Proxy
+}
+
+// dialTLSContext dials through a proxy from the pool and does the TLS handshake offering nextProtos.
+func dialTLSContext(ctx context.Context, addr string, nextProtos []string) (*tls.Conn, error) {
+	conn, err := dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	tlsConn, err := tlsHandshake(ctx, conn, host, nextProtos)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	return tlsConn, nil
+}
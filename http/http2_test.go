@@ -0,0 +1,36 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPFetcherProtocols(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>" + r.Proto + "</html>"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	pool, err := NewProxyPool([]string{"direct://"}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	previousPool := proxyPool
+	SetProxyPool(pool)
+	t.Cleanup(func() { SetProxyPool(previousPool) })
+
+	for _, backend := range []string{BackendHTTP2, BackendAuto} {
+		fetcher, err := NewFetcher(backend)
+		assert.NoError(t, err)
+		result, err := fetcher.Fetch(&FetchRequest{URL: server.URL})
+		assert.NoError(t, err, backend)
+		assert.Equal(t, "HTTP/2.0", result.Protocol, backend)
+		assert.Equal(t, "127.0.0.1", result.RemoteIP, backend)
+		assert.Equal(t, FamilyIPv4, result.Family, backend)
+		assert.Equal(t, "<html>HTTP/2.0</html>", string(result.Body), backend)
+	}
+}
@@ -3,37 +3,49 @@ package http
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"os"
-	"strings"
-
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
 var FasthttpDialer = &fasthttp.TCPDialer{
-	Concurrency:      1000, // Concurrent Dials
-	DNSCacheDuration: fasthttp.DefaultDNSCacheDuration * 60,
-	Resolver:         DnsResolver,
+	Concurrency:      1000,        // Concurrent Dials
+	DNSCacheDuration: time.Second, // dnsCache keeps answers for their TTL
+	Resolver:         dnsCache,
+}
+
+func newClientFast(dial fasthttp.DialFunc) *fasthttp.Client {
+	return &fasthttp.Client{
+		NoDefaultUserAgentHeader:      true,
+		DisableHeaderNamesNormalizing: true,
+		MaxResponseBodySize:           int(bodyLimits.MaxWire),
+		ReadBufferSize:                4096 * 3,
+		ReadTimeout:                   time.Second * 180,
+		Dial:                          dial,
+		// Dial: func(addr string) (net.Conn, error) {
+		// 	return FasthttpDialer.DialTimeout(addr, time.Second*60)
+		// },
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, // Unless verification is off, configureTLSRecording verifies
+		},
+		ConfigureClient: configureTLSRecording,
+	}
 }
 
-var clientFast = &fasthttp.Client{
-	NoDefaultUserAgentHeader:      true,
-	DisableHeaderNamesNormalizing: true,
-	MaxResponseBodySize:           1024 * 1024 * 10,
-	ReadBufferSize:                4096 * 3,
-	ReadTimeout:                   time.Second * 180,
-	Dial:                          FasthttpHTTPDialerProxyTimeout(strings.TrimPrefix(os.Getenv("PROXY_URL"), "http://"), time.Second*60),
-	// Dial: func(addr string) (net.Conn, error) {
-	// 	return FasthttpDialer.DialTimeout(addr, time.Second*60)
-	// },
-	TLSConfig: &tls.Config{
-		InsecureSkipVerify: true,
-	},
+func GetFast(requestURI string) (*FetchResult, error) {
+	return FastFetcher{}.Fetch(&FetchRequest{URL: requestURI})
 }
 
-func GetFast(requestURI string) ([]byte, int, error) {
+func (FastFetcher) Fetch(fetchReq *FetchRequest) (*FetchResult, error) {
+	result := &FetchResult{Protocol: "HTTP/1.1"}
+	if proxyPool == nil {
+		return result, errors.New("proxy pool not set")
+	}
 
 	// Acquire request and response from pool
 	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
@@ -43,104 +55,149 @@ func GetFast(requestURI string) ([]byte, int, error) {
 	}()
 
 	// Set new request
-	req.SetRequestURI(requestURI)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	req.Header.Set("Sec-Ch-Ua", `"Google Chrome";v="113", "Chromium";v="113", "Not-A.Brand";v="24"`)
-	req.Header.Set("Sec-Ch-Ua-Mobile", "?0")
-	req.Header.Set("Sec-Ch-Ua-Platform", `"macOS"`)
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "none")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36")
+	req.SetRequestURI(fetchReq.URL)
+	profileFor(string(req.URI().Host())).setFast(&req.Header)
+	if fetchReq.ETag != "" {
+		req.Header.Set(fasthttp.HeaderIfNoneMatch, fetchReq.ETag)
+	}
+	if fetchReq.LastModified != "" {
+		req.Header.Set(fasthttp.HeaderIfModifiedSince, fetchReq.LastModified)
+	}
+
+	// Pick proxy
+	proxy, err := proxyPool.Pick(string(req.URI().Host()))
+	if err != nil {
+		return result, fmt.Errorf("pick proxy: %w", err)
+	}
 
 	// Do request
-	err := clientFast.DoRedirects(req, res, 10)
+	requestStartTime := time.Now()
+	err = doRedirects(proxy.client, req, res, 10, cookieJar, fetchReq.cassette)
+	proxy.Report(res.StatusCode(), err, time.Since(requestStartTime))
+	if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+		return streamingFetcher().Fetch(fetchReq)
+	}
+	result.StatusCode = res.StatusCode()
+	if addr, ok := res.RemoteAddr().(*connAddr); ok {
+		result.TLS = addr.tls
+	}
+	if proxy.direct() {
+		result.RemoteIP = remoteIP(res.RemoteAddr())
+		result.Family = ipFamily(result.RemoteIP)
+	}
 	if err != nil {
-		return nil, res.StatusCode(), fmt.Errorf("client do: %w", err)
+		if tlsInfo := tlsInfoFromError(err); tlsInfo != nil {
+			result.TLS = tlsInfo
+		}
+		return result, fmt.Errorf("client do: %w", err)
+	}
+	return fastResult(fetchReq, res, result)
+}
+
+// fastResult fills the result from the final response of a fetch.
+func fastResult(fetchReq *FetchRequest, res *fasthttp.Response, result *FetchResult) (*FetchResult, error) {
+	result.RetryAfter = retryAfter(result.StatusCode, string(res.Header.Peek(fasthttp.HeaderRetryAfter)), time.Now())
+	result.ETag = string(res.Header.Peek(fasthttp.HeaderETag))
+	result.LastModified = string(res.Header.Peek(fasthttp.HeaderLastModified))
+	if result.StatusCode == fasthttp.StatusNotModified {
+		result.NotModified = true
+		return result, nil
 	}
 
-	body, err := handleResponseFast(res)
+	body, truncated, err := handleResponseFast(res, fetchReq.AnyContentType)
 	if err != nil {
-		return nil, res.StatusCode(), fmt.Errorf("handle response err: %w", err)
+		return result, fmt.Errorf("handle response err: %w", err)
+	}
+	result.Body, result.Truncated = body, truncated
+
+	return result, nil
+}
+
+// doRedirects follows redirects like fasthttp's DoRedirects. With a cookie jar it sends the jar's
+// cookies with each request and stores the ones each response sets, with a cassette it records each exchange.
+func doRedirects(client *fasthttp.Client, req *fasthttp.Request, res *fasthttp.Response, maxRedirects int, jar *CookieJar, cassette *Cassette) error {
+	for redirects := 0; ; redirects++ {
+		requestURL := req.URI().String()
+		var u *url.URL
+		if jar != nil {
+			var err error
+			if u, err = url.Parse(requestURL); err != nil {
+				return err
+			}
+			req.Header.DelAllCookies()
+			for _, cookie := range jar.Cookies(u) {
+				req.Header.SetCookie(cookie.Name, cookie.Value)
+			}
+		}
+
+		err := client.Do(req, res)
+		if cassette != nil && err != fasthttp.ErrBodyTooLarge { // Refetched by the streaming fetcher, which records it
+			cassette.Record(newFastExchange(requestURL, res, err))
+		}
+		if err != nil {
+			return err
+		}
+		if jar != nil {
+			var setCookies []string
+			res.Header.VisitAllCookie(func(_, value []byte) {
+				setCookies = append(setCookies, string(value))
+			})
+			jar.SetCookies(u, (&http.Response{Header: http.Header{"Set-Cookie": setCookies}}).Cookies())
+		}
+
+		if !fasthttp.StatusCodeIsRedirect(res.StatusCode()) {
+			return nil
+		}
+		if redirects >= maxRedirects {
+			return fasthttp.ErrTooManyRedirects
+		}
+		location := res.Header.Peek(fasthttp.HeaderLocation)
+		if len(location) == 0 {
+			return fasthttp.ErrMissingLocation
+		}
+		req.URI().UpdateBytes(location)
 	}
+}
 
-	return body, res.StatusCode(), nil
+var streaming struct {
+	once    sync.Once
+	fetcher *HTTPFetcher
 }
 
-func handleResponseFast(res *fasthttp.Response) ([]byte, error) {
+// streamingFetcher fetches the responses too large for fasthttp to buffer.
+func streamingFetcher() *HTTPFetcher {
+	streaming.once.Do(func() {
+		streaming.fetcher = NewHTTPFetcher(BackendAuto)
+	})
+	return streaming.fetcher
+}
+
+func handleResponseFast(res *fasthttp.Response, anyContentType bool) ([]byte, bool, error) {
 
-	// Check if its HTML
+	// Check if its HTML, or XML for sitemaps
 	contentType := res.Header.Peek(fasthttp.HeaderContentType)
-	if !bytes.Contains(contentType, []byte("html")) {
-		return nil, fmt.Errorf("not HTML")
+	if !anyContentType && !bytes.Contains(contentType, []byte("html")) && !bytes.Contains(contentType, []byte("xml")) {
+		return nil, false, fmt.Errorf("not HTML")
 	}
 
 	// Check status code
 	if res.StatusCode() != 200 {
-		return nil, fmt.Errorf("status not 200: %v", res.StatusCode())
+		return nil, false, fmt.Errorf("status not 200: %v", res.StatusCode())
 	}
 
 	// Read and decode response body
-	body, err := decodeResponseFast(res)
+	body, truncated, err := decodeResponseFast(res)
 	if err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+		return nil, false, fmt.Errorf("decode response: %w", err)
 	}
 
-	return body, nil
+	return body, truncated, nil
 }
 
-func decodeResponseFast(res *fasthttp.Response) ([]byte, error) {
-	var err error
-	var body []byte
-
+func decodeResponseFast(res *fasthttp.Response) ([]byte, bool, error) {
 	contentEncoding := res.Header.Peek(fasthttp.HeaderContentEncoding)
-	switch string(contentEncoding) {
-	case "gzip":
-		body, err = res.BodyGunzip()
-		if err != nil {
-			return nil, fmt.Errorf("gunzip: %w", err)
-		}
-	case "deflate":
-		body, err = res.BodyInflate()
-		if err != nil {
-			return nil, fmt.Errorf("inflate: %w", err)
-		}
-	case "br":
-		body, err = res.BodyUnbrotli()
-		if err != nil {
-			return nil, fmt.Errorf("unbrotli: %w", err)
-		}
-	default:
-		body = res.Body()
-	}
+	limit := bodyLimits.For(string(res.Header.Peek(fasthttp.HeaderContentType)))
 
-	// Charset Decoding
-	// contentType := res.Header.Peek(fasthttp.HeaderContentType)
-	// _, params, err := mime.ParseMediaType(string(contentType))
-	// if err != nil {
-	// 	return nil, fmt.Errorf("parse media type: %w", err)
-	// }
-	// if cs, ok := params["charset"]; ok {
-	// 	encoding, name := charset.Lookup(cs)
-	// 	if encoding == nil {
-	// 		return nil, fmt.Errorf("charset lookup: %v", name)
-	// 	}
-
-	// 	if encoding != nil {
-	// 		// If encoding is not nil, wrap body in a reader that converts from the given encoding to UTF-8.
-	// 		bodyReader := transform.NewReader(bytes.NewReader(body), encoding.NewDecoder())
-	// 		// Read the entire body, now decoded to UTF-8.
-	// 		var err error
-	// 		body, err = io.ReadAll(bodyReader)
-	// 		if err != nil {
-	// 			return nil, fmt.Errorf("read all: %w", err)
-	// 		}
-	// 	}
-	// }
-
-	return body, nil
+	// readBody copies, so the body outlives the response going back to the pool
+	return readBody(bytes.NewReader(res.Body()), string(contentEncoding), limit)
 }
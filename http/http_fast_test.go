@@ -7,7 +7,10 @@ import (
 )
 
 func TestGetBrotli(t *testing.T) {
-	resp, _, err := GetFast("https://httpbin.org/brotli")
+	// Recorded from https://httpbin.org/brotli
+	cassette, err := LoadCassette("testdata/brotli.jsonl")
 	assert.NoError(t, err)
-	assert.NotNil(t, resp)
+	result, err := NewReplayFetcher(cassette).Fetch(&FetchRequest{URL: "https://httpbin.org/brotli", AnyContentType: true})
+	assert.NoError(t, err)
+	assert.Contains(t, string(result.Body), `"brotli": true`)
 }
@@ -0,0 +1,174 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Request profiles
+const (
+	ProfileBot            = "bot" // Honest crawler User-Agent with a contact URL
+	ProfileChromeMac      = "chrome-mac"
+	ProfileChromeWindows  = "chrome-windows"
+	ProfileFirefoxWindows = "firefox-windows"
+	ProfileSafariMac      = "safari-mac"
+)
+
+// RequestProfile is the set of headers a client sends, in the order and casing it sends them.
+// fasthttp always writes User-Agent and Host first, and net/http sorts headers, so the order
+// only holds for the other headers.
+type RequestProfile struct {
+	Name    string
+	Headers []ProfileHeader
+}
+
+type ProfileHeader struct {
+	Name  string
+	Value string
+}
+
+const (
+	chromeAccept   = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"
+	chromeSecChUa  = `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`
+	acceptEncoding = "gzip, deflate, br" // What readBody decodes
+)
+
+func chromeProfile(name, platform, userAgent string) *RequestProfile {
+	return &RequestProfile{Name: name, Headers: []ProfileHeader{
+		{"sec-ch-ua", chromeSecChUa},
+		{"sec-ch-ua-mobile", "?0"},
+		{"sec-ch-ua-platform", platform},
+		{"Upgrade-Insecure-Requests", "1"},
+		{"User-Agent", userAgent},
+		{"Accept", chromeAccept},
+		{"Sec-Fetch-Site", "none"},
+		{"Sec-Fetch-Mode", "navigate"},
+		{"Sec-Fetch-User", "?1"},
+		{"Sec-Fetch-Dest", "document"},
+		{"Accept-Encoding", acceptEncoding},
+		{"Accept-Language", "en-US,en;q=0.9"},
+	}}
+}
+
+var browserProfiles = map[string]*RequestProfile{
+	ProfileChromeMac: chromeProfile(ProfileChromeMac, `"macOS"`,
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"),
+	ProfileChromeWindows: chromeProfile(ProfileChromeWindows, `"Windows"`,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"),
+	ProfileFirefoxWindows: {Name: ProfileFirefoxWindows, Headers: []ProfileHeader{
+		{"User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0"},
+		{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"},
+		{"Accept-Language", "en-US,en;q=0.5"},
+		{"Accept-Encoding", acceptEncoding},
+		{"Upgrade-Insecure-Requests", "1"},
+		{"Sec-Fetch-Dest", "document"},
+		{"Sec-Fetch-Mode", "navigate"},
+		{"Sec-Fetch-Site", "none"},
+		{"Sec-Fetch-User", "?1"},
+	}},
+	ProfileSafariMac: {Name: ProfileSafariMac, Headers: []ProfileHeader{
+		{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		{"Sec-Fetch-Site", "none"},
+		{"Sec-Fetch-Dest", "document"},
+		{"Accept-Language", "en-US,en;q=0.9"},
+		{"Sec-Fetch-Mode", "navigate"},
+		{"User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15"},
+		{"Accept-Encoding", acceptEncoding},
+	}},
+}
+
+// BotProfile identifies the crawler, with a URL site owners can find out about it and reach us at.
+func BotProfile(contactURL string) *RequestProfile {
+	return &RequestProfile{Name: ProfileBot, Headers: []ProfileHeader{
+		{"User-Agent", fmt.Sprintf("quantumscraper/1.0 (+%s)", contactURL)},
+		{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		{"Accept-Encoding", acceptEncoding},
+		{"Accept-Language", "en-US,en;q=0.9"},
+	}}
+}
+
+// requestProfiles selects the profile of each host.
+type requestProfiles struct {
+	defaultProfile *RequestProfile
+	byHost         []hostProfile // Longest pattern first, so the most specific one wins
+}
+
+type hostProfile struct {
+	pattern string
+	profile *RequestProfile
+}
+
+var profiles = requestProfiles{defaultProfile: browserProfiles[ProfileChromeMac]}
+
+// SetRequestProfiles sets the profile of requests by name, and the profiles of hosts matching
+// patterns like "*.example.com". contactURL goes into the bot profile.
+func SetRequestProfiles(defaultName string, byHost map[string]string, contactURL string) error {
+	lookup := func(name string) (*RequestProfile, error) {
+		if name == ProfileBot {
+			return BotProfile(contactURL), nil
+		}
+		profile, ok := browserProfiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown request profile: %q", name)
+		}
+		return profile, nil
+	}
+
+	var selected requestProfiles
+	var err error
+	if selected.defaultProfile, err = lookup(defaultName); err != nil {
+		return err
+	}
+	for pattern, name := range byHost {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("request profile host pattern %q: %w", pattern, err)
+		}
+		profile, err := lookup(name)
+		if err != nil {
+			return err
+		}
+		selected.byHost = append(selected.byHost, hostProfile{pattern: pattern, profile: profile})
+	}
+	sort.Slice(selected.byHost, func(i, j int) bool {
+		a, b := selected.byHost[i].pattern, selected.byHost[j].pattern
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	profiles = selected
+	return nil
+}
+
+// profileFor returns the profile of requests to the host, with or without a port.
+func profileFor(host string) *RequestProfile {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	for _, hostProfile := range profiles.byHost {
+		if matched, _ := path.Match(hostProfile.pattern, host); matched {
+			return hostProfile.profile
+		}
+	}
+	return profiles.defaultProfile
+}
+
+// setFast sets the headers on a fasthttp request, keeping their casing.
+func (profile *RequestProfile) setFast(header *fasthttp.RequestHeader) {
+	header.DisableNormalizing()
+	for _, h := range profile.Headers {
+		header.Set(h.Name, h.Value)
+	}
+}
+
+// set sets the headers on a net/http request. HTTP/1.1 keeps their casing, HTTP/2 lowercases them.
+func (profile *RequestProfile) set(header http.Header) {
+	for _, h := range profile.Headers {
+		header[h.Name] = []string{h.Value}
+	}
+}
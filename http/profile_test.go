@@ -0,0 +1,72 @@
+package http
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRequestProfiles(t *testing.T) {
+	previous := profiles
+	t.Cleanup(func() { profiles = previous })
+	assert.Error(t, SetRequestProfiles("netscape", nil, ""))
+	assert.NoError(t, SetRequestProfiles(ProfileChromeMac, map[string]string{
+		"*.example.com":    ProfileBot,
+		"shop.example.com": ProfileSafariMac,
+	}, "https://example.net/bot"))
+
+	assert.Equal(t, ProfileChromeMac, profileFor("example.net").Name)
+	assert.Equal(t, ProfileBot, profileFor("www.example.com:8080").Name)
+	assert.Equal(t, ProfileSafariMac, profileFor("shop.example.com").Name)
+	assert.Equal(t, "quantumscraper/1.0 (+https://example.net/bot)", profileFor("a.example.com").Headers[0].Value)
+
+	// Headers go out in the profile's order and casing
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := textproto.NewReader(bufio.NewReader(conn))
+		reader.ReadLine() // Request line
+		var names []string
+		for {
+			line, err := reader.ReadLine()
+			if err != nil || line == "" {
+				break
+			}
+			name, _, _ := strings.Cut(line, ":")
+			names = append(names, name)
+		}
+		received <- names
+		conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	}()
+
+	client := &fasthttp.Client{NoDefaultUserAgentHeader: true, DisableHeaderNamesNormalizing: true}
+	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+	req.SetRequestURI("http://" + ln.Addr().String() + "/")
+	profile := browserProfiles[ProfileChromeWindows]
+	profile.setFast(&req.Header)
+	assert.NoError(t, client.Do(req, res))
+
+	var expected []string
+	for _, header := range profile.Headers {
+		if header.Name != "User-Agent" {
+			expected = append(expected, header.Name)
+		}
+	}
+	names := <-received
+	assert.Equal(t, []string{"User-Agent", "Host"}, names[:2])
+	assert.Equal(t, expected, names[2:len(expected)+2])
+}
@@ -0,0 +1,315 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+)
+
+// Proxy selection strategies
+const (
+	ProxyRoundRobin = "round-robin"
+	ProxyWeighted   = "weighted"
+	ProxySticky     = "sticky"
+)
+
+var ErrNoHealthyProxy = errors.New("no healthy proxy available")
+
+// Proxy is a single upstream proxy with its own fasthttp client, so every
+// request can be attributed to the proxy that served it.
+type Proxy struct {
+	Name   string // host:port, used as metric label. Credentials are never exposed, only told apart by a hash.
+	URL    *url.URL
+	Weight int
+
+	dial        fasthttp.DialFunc
+	client      *fasthttp.Client
+	maxFailures int32
+	failures    atomic.Int32
+	healthy     atomic.Bool
+}
+
+// ProxyPool rotates requests over a set of proxies and takes the ones that
+// keep failing out of rotation until a probe succeeds again.
+type ProxyPool struct {
+	proxies  []*Proxy
+	strategy string
+	next     atomic.Uint64
+}
+
+var proxyPool *ProxyPool
+
+// SetProxyPool sets the pool used by GetFast and Get.
+func SetProxyPool(pool *ProxyPool) {
+	proxyPool = pool
+}
+
+// NewProxyPool creates a pool from proxy entries in the form "url [weight]".
+// See NewDialer for the supported URL schemes.
+func NewProxyPool(entries []string, strategy string, maxFailures int) (*ProxyPool, error) {
+	switch strategy {
+	case ProxyRoundRobin, ProxyWeighted, ProxySticky:
+	default:
+		return nil, fmt.Errorf("unknown proxy strategy: %s", strategy)
+	}
+	if maxFailures <= 0 {
+		maxFailures = 1
+	}
+
+	pool := &ProxyPool{strategy: strategy}
+	for _, entry := range entries {
+		proxy, err := newProxy(entry, maxFailures)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %q: %w", entry, err)
+		}
+		pool.proxies = append(pool.proxies, proxy)
+	}
+	if len(pool.proxies) == 0 {
+		return nil, errors.New("proxy pool is empty")
+	}
+
+	return pool, nil
+}
+
+func newProxy(entry string, maxFailures int) (*Proxy, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, errors.New("expected \"url [weight]\"")
+	}
+
+	rawURL := fields[0]
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+
+	weight := 1
+	if len(fields) == 2 {
+		weight, err = strconv.Atoi(fields[1])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight: %s", fields[1])
+		}
+	}
+
+	connect, err := NewDialer(proxyURL, time.Second*60)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &Proxy{
+		Name:        proxyName(proxyURL),
+		URL:         proxyURL,
+		Weight:      weight,
+		maxFailures: int32(maxFailures),
+	}
+	proxy.dial = func(addr string) (net.Conn, error) {
+		conn, err := connect(addr)
+		if err != nil {
+			metrics.ProxyErrorCount.With(prometheus.Labels{"proxy": proxy.Name}).Inc()
+			if proxyFault(err) {
+				proxy.fail()
+			}
+			return nil, err
+		}
+		return conn, nil
+	}
+	proxy.client = newClientFast(proxy.dial)
+	proxy.healthy.Store(true)
+	metrics.ProxyHealthy.With(prometheus.Labels{"proxy": proxy.Name}).Set(1)
+
+	return proxy, nil
+}
+
+// proxyName names the proxy for metrics and logs. Proxies on the same host:port with different
+// credentials, like sessions of a rotating proxy, get a hash of their credentials appended.
+func proxyName(proxyURL *url.URL) string {
+	if proxyURL.Scheme == "direct" {
+		return "direct"
+	}
+	if proxyURL.User == nil {
+		return proxyURL.Host
+	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(proxyURL.User.String()))
+	return fmt.Sprintf("%s#%08x", proxyURL.Host, hasher.Sum32())
+}
+
+// proxyFault tells whether a dial error is the proxy's fault: the proxy couldn't be reached,
+// or it refused our credentials or the CONNECT. Targets that don't resolve or answer aren't.
+func proxyFault(err error) bool {
+	var unreachable *proxyError
+	if errors.As(err, &unreachable) {
+		return true
+	}
+	var connectErr *ProxyConnectError
+	return errors.As(err, &connectErr) &&
+		(connectErr.StatusCode == fasthttp.StatusProxyAuthRequired || connectErr.StatusCode == fasthttp.StatusForbidden)
+}
+
+// ProxyFailed tells whether a fetch failed on the proxy side without reaching the target: no proxy
+// could be picked, the proxy couldn't be reached, or it refused our credentials or the target.
+func ProxyFailed(err error) bool {
+	return errors.Is(err, ErrNoHealthyProxy) || proxyFault(err)
+}
+
+// resolvesLocally tells whether some fetches resolve their host here, because they connect directly.
+func (pool *ProxyPool) resolvesLocally() bool {
+	for _, proxy := range pool.proxies {
+		if proxy.URL.Scheme == "direct" {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadProxyFile reads proxy entries from a file, one per line.
+// Empty lines and lines starting with # are skipped.
+func LoadProxyFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open proxy file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read proxy file: %w", err)
+	}
+
+	return entries, nil
+}
+
+// Pick selects a healthy proxy for the given host using the pool strategy.
+func (pool *ProxyPool) Pick(host string) (*Proxy, error) {
+	switch pool.strategy {
+	case ProxySticky:
+		// Same host always lands on the same proxy while it's healthy
+		hasher := fnv.New64a()
+		hasher.Write([]byte(host))
+		start := int(hasher.Sum64() % uint64(len(pool.proxies)))
+		for i := 0; i < len(pool.proxies); i++ {
+			proxy := pool.proxies[(start+i)%len(pool.proxies)]
+			if proxy.healthy.Load() {
+				return proxy, nil
+			}
+		}
+		return nil, ErrNoHealthyProxy
+	case ProxyWeighted:
+		healthy, totalWeight := pool.healthyProxies()
+		if len(healthy) == 0 {
+			return nil, ErrNoHealthyProxy
+		}
+		n := rand.Intn(totalWeight)
+		for _, proxy := range healthy {
+			n -= proxy.Weight
+			if n < 0 {
+				return proxy, nil
+			}
+		}
+		return healthy[len(healthy)-1], nil
+	default:
+		healthy, _ := pool.healthyProxies()
+		if len(healthy) == 0 {
+			return nil, ErrNoHealthyProxy
+		}
+		i := pool.next.Add(1) % uint64(len(healthy))
+		return healthy[i], nil
+	}
+}
+
+func (pool *ProxyPool) healthyProxies() (healthy []*Proxy, totalWeight int) {
+	for _, proxy := range pool.proxies {
+		if proxy.healthy.Load() {
+			healthy = append(healthy, proxy)
+			totalWeight += proxy.Weight
+		}
+	}
+	return
+}
+
+// Report records the outcome of a request made through the proxy.
+// Forbidden responses count as failures since that's how most proxies signal a ban.
+func (proxy *Proxy) Report(statusCode int, err error, latency time.Duration) {
+	labels := prometheus.Labels{"proxy": proxy.Name}
+	metrics.ProxyRequestCount.With(prometheus.Labels{"proxy": proxy.Name, "code": strconv.Itoa(statusCode)}).Inc()
+	metrics.ProxyLatency.With(labels).Observe(latency.Seconds())
+	if err != nil {
+		return // Dial errors are counted by the dialer itself, target errors aren't the proxy's fault
+	}
+	if statusCode == fasthttp.StatusForbidden || statusCode == fasthttp.StatusProxyAuthRequired {
+		proxy.fail()
+		return
+	}
+	proxy.failures.Store(0)
+}
+
+// direct reports whether the proxy is no proxy at all.
+func (proxy *Proxy) direct() bool {
+	return proxy.URL.Scheme == "direct"
+}
+
+// fail counts a failure of the proxy, taking it out of rotation after maxFailures in a row.
+// Direct is never taken out, there's nothing to fall back to.
+func (proxy *Proxy) fail() {
+	if proxy.direct() {
+		return
+	}
+	if proxy.failures.Add(1) < proxy.maxFailures || !proxy.healthy.Swap(false) {
+		return
+	}
+	log.Println("Proxy taken out of rotation:", proxy.Name)
+	metrics.ProxyHealthy.With(prometheus.Labels{"proxy": proxy.Name}).Set(0)
+}
+
+// StartHealthChecks periodically probes unhealthy proxies by tunneling to probeAddr
+// and brings them back into rotation when the tunnel succeeds.
+func (pool *ProxyPool) StartHealthChecks(interval time.Duration, probeAddr string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pool.probe(probeAddr)
+	}
+}
+
+// probe brings the unhealthy proxies that can tunnel to probeAddr back into rotation.
+func (pool *ProxyPool) probe(probeAddr string) {
+	for _, proxy := range pool.proxies {
+		if proxy.healthy.Load() {
+			continue
+		}
+		conn, err := proxy.dial(probeAddr)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		proxy.failures.Store(0)
+		proxy.healthy.Store(true)
+		metrics.ProxyHealthy.With(prometheus.Labels{"proxy": proxy.Name}).Set(1)
+		log.Println("Proxy back in rotation:", proxy.Name)
+	}
+}
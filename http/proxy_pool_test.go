@@ -0,0 +1,153 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectProxy answers CONNECT requests with the status it's set to, keeping the tunnel open on 200.
+func connectProxy(t *testing.T, status *atomic.Int32) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				code := int(status.Load())
+				conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n\r\n"))
+				if code == http.StatusOK {
+					conn.Read(make([]byte, 1)) // Until the client closes the tunnel
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func refusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func TestProxyPoolPick(t *testing.T) {
+	pool, err := NewProxyPool([]string{"http://a.test:1", "http://b.test:2", "http://c.test:3"}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	picked := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		proxy, err := pool.Pick("example.com")
+		assert.NoError(t, err)
+		picked[proxy.Name]++
+	}
+	assert.Equal(t, map[string]int{"a.test:1": 10, "b.test:2": 10, "c.test:3": 10}, picked)
+
+	pool, err = NewProxyPool([]string{"http://a.test:1 1", "http://b.test:2 3"}, ProxyWeighted, 1)
+	assert.NoError(t, err)
+	picked = make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		proxy, err := pool.Pick("example.com")
+		assert.NoError(t, err)
+		picked[proxy.Name]++
+	}
+	assert.InDelta(t, 3000, picked["b.test:2"], 200)
+
+	pool, err = NewProxyPool([]string{"http://a.test:1", "http://b.test:2", "http://c.test:3"}, ProxySticky, 1)
+	assert.NoError(t, err)
+	first, err := pool.Pick("example.com")
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		proxy, _ := pool.Pick("example.com")
+		assert.Same(t, first, proxy)
+	}
+	first.fail()
+	moved, err := pool.Pick("example.com")
+	assert.NoError(t, err)
+	assert.NotSame(t, first, moved)
+
+	for _, proxy := range pool.proxies {
+		proxy.fail()
+	}
+	_, err = pool.Pick("example.com")
+	assert.ErrorIs(t, err, ErrNoHealthyProxy)
+}
+
+func TestProxyName(t *testing.T) {
+	pool, err := NewProxyPool([]string{"direct://", "http://a.test:1", "http://user-1:pw@a.test:1", "http://user-2:pw@a.test:1"}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "direct", pool.proxies[0].Name)
+	assert.Equal(t, "a.test:1", pool.proxies[1].Name)
+	assert.NotEqual(t, pool.proxies[2].Name, pool.proxies[3].Name)
+	assert.NotContains(t, pool.proxies[2].Name, "user")
+}
+
+func TestProxyFailures(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusBadGateway)
+	addr := connectProxy(t, &status)
+	pool, err := NewProxyPool([]string{"http://" + addr, "direct://"}, ProxyRoundRobin, 2)
+	assert.NoError(t, err)
+	proxy, direct := pool.proxies[0], pool.proxies[1]
+
+	// Dead targets are not the fault of the proxy, or of direct
+	for i := 0; i < 5; i++ {
+		_, err := proxy.dial("dead.test:80")
+		var connectErr *ProxyConnectError
+		assert.True(t, errors.As(err, &connectErr))
+		assert.False(t, ProxyFailed(err))
+		_, err = direct.dial(refusedAddr(t))
+		assert.Error(t, err)
+		assert.False(t, ProxyFailed(err))
+	}
+	assert.True(t, proxy.healthy.Load())
+	assert.True(t, direct.healthy.Load())
+
+	// Rejected credentials are
+	status.Store(http.StatusProxyAuthRequired)
+	for i := 0; i < 2; i++ {
+		_, err := proxy.dial("example.com:80")
+		assert.Error(t, err)
+	}
+	assert.False(t, proxy.healthy.Load())
+
+	// And refused CONNECTs
+	status.Store(http.StatusForbidden)
+	forbidding, err := NewProxyPool([]string{"http://" + addr}, ProxyRoundRobin, 2)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := forbidding.proxies[0].dial("example.com:80")
+		assert.True(t, ProxyFailed(err))
+	}
+	assert.False(t, forbidding.proxies[0].healthy.Load())
+
+	// So is a proxy that can't be reached
+	unreachable, err := NewProxyPool([]string{"http://" + refusedAddr(t)}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	_, err = unreachable.proxies[0].dial("example.com:80")
+	assert.True(t, ProxyFailed(err))
+	_, err = unreachable.Pick("example.com")
+	assert.ErrorIs(t, err, ErrNoHealthyProxy)
+	assert.True(t, ProxyFailed(err))
+
+	// Health checks bring it back once it tunnels again
+	status.Store(http.StatusOK)
+	go pool.StartHealthChecks(time.Millisecond*10, "example.com:80")
+	assert.Eventually(t, proxy.healthy.Load, time.Second*2, time.Millisecond*10)
+	assert.Equal(t, int32(0), proxy.failures.Load())
+}
@@ -0,0 +1,208 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+)
+
+// TLS verification modes
+const (
+	TLSVerifyOff    = "off"    // Accept any certificate, capture nothing
+	TLSVerify       = "verify" // Fail the fetch on invalid certificates, capture TLS metadata per fetch
+	TLSVerifyRecord = "record" // Like verify, and also count every handshake by version and outcome
+)
+
+var tlsMode = TLSVerifyOff
+
+// tlsRoots are the trusted roots, nil for the system ones.
+var tlsRoots *x509.CertPool
+
+// SetTLSMode sets the certificate verification mode.
+// It must be called before the proxy pool is created, since clients are configured once.
+func SetTLSMode(mode string) error {
+	switch mode {
+	case TLSVerifyOff, TLSVerify, TLSVerifyRecord:
+	default:
+		return fmt.Errorf("unknown tls mode: %s", mode)
+	}
+	tlsMode = mode
+	client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = mode == TLSVerifyOff
+	return nil
+}
+
+// TLSInfo is the TLS metadata captured for a fetch.
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ALPN        string
+	Subject     string
+	Issuer      string
+	DNSNames    []string
+	NotAfter    time.Time
+	VerifyError string
+}
+
+func newTLSInfo(state tls.ConnectionState, verifyErr error) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		info.Subject = leaf.Subject.String()
+		info.Issuer = leaf.Issuer.String()
+		info.DNSNames = leaf.DNSNames
+		info.NotAfter = leaf.NotAfter
+	}
+	if verifyErr != nil {
+		info.VerifyError = verifyErr.Error()
+	}
+	return info
+}
+
+func countTLSConnection(state tls.ConnectionState, verifyErr error) {
+	metrics.TLSConnectionCount.With(prometheus.Labels{
+		"version":  tlsVersionName(state.Version),
+		"verified": fmt.Sprint(verifyErr == nil),
+	}).Inc()
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// verifyPeer does the same verification crypto/tls would do with InsecureSkipVerify disabled.
+func verifyPeer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no peer certificates")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         tlsRoots,
+		DNSName:       state.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// tlsHandshake does the client handshake on conn. Unless verification is off, it verifies the
+// certificate the way crypto/tls would, but itself, so a certificate failing verification is still
+// described in the returned *TLSVerifyError.
+func tlsHandshake(ctx context.Context, conn net.Conn, serverName string, nextProtos []string) (*tls.Conn, error) {
+	config := &tls.Config{ServerName: serverName, NextProtos: nextProtos, InsecureSkipVerify: true}
+	if tlsMode != TLSVerifyOff {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			verifyErr := verifyPeer(state)
+			if tlsMode == TLSVerifyRecord {
+				countTLSConnection(state, verifyErr)
+			}
+			if verifyErr != nil {
+				return &TLSVerifyError{Err: verifyErr, TLS: newTLSInfo(state, verifyErr)}
+			}
+			return nil
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// TLSVerifyError is a certificate failing verification, with the metadata of the handshake.
+type TLSVerifyError struct {
+	Err error
+	TLS *TLSInfo
+}
+
+func (e *TLSVerifyError) Error() string {
+	return "tls verify: " + e.Err.Error()
+}
+
+func (e *TLSVerifyError) Unwrap() error {
+	return e.Err
+}
+
+// configureTLSRecording makes TLS host clients do the handshake themselves unless verification is off,
+// so the captured TLS metadata can travel with the connection.
+func configureTLSRecording(hc *fasthttp.HostClient) error {
+	if !hc.IsTLS || tlsMode == TLSVerifyOff {
+		return nil
+	}
+	serverName, _, err := net.SplitHostPort(hc.Addr)
+	if err != nil {
+		serverName = hc.Addr
+	}
+
+	dial := hc.Dial
+	hc.Dial = func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+		defer cancel()
+		tlsConn, err := tlsHandshake(ctx, conn, serverName, nil)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return &tlsInfoConn{
+			Conn: tlsConn,
+			addr: &connAddr{Addr: tlsConn.RemoteAddr(), tls: newTLSInfo(tlsConn.ConnectionState(), nil)},
+		}, nil
+	}
+	return nil
+}
+
+// tlsInfoConn embeds *tls.Conn so fasthttp sees an already established TLS connection.
+type tlsInfoConn struct {
+	*tls.Conn
+	addr *connAddr
+}
+
+func (c *tlsInfoConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// connAddr carries connection metadata. fasthttp copies the connection's RemoteAddr
+// onto every response read from it, which is how the metadata reaches the fetch result.
+type connAddr struct {
+	net.Addr
+	tls *TLSInfo
+}
+
+// tlsInfoFromError extracts the metadata of certificates failing verification.
+func tlsInfoFromError(err error) *TLSInfo {
+	var verifyErr *TLSVerifyError
+	if errors.As(err, &verifyErr) {
+		return verifyErr.TLS
+	}
+	return nil
+}
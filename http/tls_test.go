@@ -0,0 +1,65 @@
+package http
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	previousPool := proxyPool
+	t.Cleanup(func() {
+		SetProxyPool(previousPool)
+		SetTLSMode(TLSVerifyOff)
+		tlsRoots = nil
+	})
+
+	for _, mode := range []string{TLSVerify, TLSVerifyRecord} {
+		assert.NoError(t, SetTLSMode(mode))
+		pool, err := NewProxyPool([]string{"direct://"}, ProxyRoundRobin, 1) // Clients pick the mode up when created
+		assert.NoError(t, err)
+		SetProxyPool(pool)
+		for name, fetcher := range map[string]Fetcher{"fast": FastFetcher{}, "http": NewHTTPFetcher(BackendAuto)} {
+			// The httptest certificate isn't trusted, the fetch fails but the certificate is described
+			tlsRoots = nil
+			result, err := fetcher.Fetch(&FetchRequest{URL: server.URL})
+			var verifyErr *TLSVerifyError
+			assert.True(t, errors.As(err, &verifyErr), "%s %s: %v", mode, name, err)
+			if assert.NotNil(t, result.TLS, "%s %s", mode, name) {
+				assert.Contains(t, result.TLS.DNSNames, "example.com")
+				assert.NotEmpty(t, result.TLS.VerifyError)
+			}
+
+			tlsRoots = x509.NewCertPool()
+			tlsRoots.AddCert(server.Certificate())
+			result, err = fetcher.Fetch(&FetchRequest{URL: server.URL})
+			assert.NoError(t, err, "%s %s", mode, name)
+			assert.Equal(t, 200, result.StatusCode)
+			if assert.NotNil(t, result.TLS, "%s %s", mode, name) {
+				assert.Contains(t, result.TLS.DNSNames, "example.com")
+				assert.Empty(t, result.TLS.VerifyError)
+				assert.NotEmpty(t, result.TLS.Version)
+			}
+		}
+	}
+
+	assert.NoError(t, SetTLSMode(TLSVerifyOff))
+	pool, err := NewProxyPool([]string{"direct://"}, ProxyRoundRobin, 1)
+	assert.NoError(t, err)
+	SetProxyPool(pool)
+	result, err := FastFetcher{}.Fetch(&FetchRequest{URL: server.URL})
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", result.RemoteIP)
+	assert.Equal(t, FamilyIPv4, result.Family)
+	assert.Nil(t, result.TLS)
+}
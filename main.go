@@ -4,12 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	nethttp "net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/ardanlabs/conf/v3"
+	"github.com/musabgultekin/quantumscraper/http"
 	"github.com/musabgultekin/quantumscraper/logging"
 	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/musabgultekin/quantumscraper/storage"
+	"github.com/musabgultekin/quantumscraper/urlloader"
 	"github.com/musabgultekin/quantumscraper/worker"
 )
 
@@ -28,16 +34,131 @@ func run() error {
 	// Configuration
 	log.SetOutput(&logging.FilteredWriter{os.Stderr})
 
-	// Enforce proxy
-	if os.Getenv("PROXY_URL") == "" {
-		log.Println("Please set proxy environment variable")
-		os.Exit(1)
-	}
-
 	cfg := struct {
 		conf.Version
 		Crawler struct {
-			Concurrency int `conf:"default:100"`
+			Concurrency int    `conf:"default:100"`
+			Mode        string `conf:"default:single,help:single pass over the URL list or continuous recrawling"`
+		}
+		Fetcher struct {
+			Backend string `conf:"default:fasthttp"`
+			Family  string `conf:"default:prefer-ipv4,help:address family of direct dials: prefer-ipv4 or prefer-ipv6 or happy-eyeballs"`
+			Record  string `conf:"help:cassette file to record exchanges to: written as they are fetched"`
+			Replay  string `conf:"help:cassette file to serve exchanges from instead of the network"`
+		}
+		Profile struct {
+			Default string            `conf:"default:chrome-mac,help:request headers: bot or chrome-mac or chrome-windows or firefox-windows or safari-mac"`
+			Hosts   map[string]string `conf:"help:profiles of host patterns like *.example.com:bot"`
+			Contact string            `conf:"default:https://github.com/musabgultekin/quantumscraper,help:URL in the bot User-Agent"`
+		}
+		History struct {
+			Path string `conf:"default:data/fetch_history"`
+		}
+		Recrawl struct {
+			SchedulePath string        `conf:"default:data/recrawl_schedule"`
+			Initial      time.Duration `conf:"default:24h"`
+			Min          time.Duration `conf:"default:1h"`
+			Max          time.Duration `conf:"default:720h"`
+			Lease        time.Duration `conf:"default:1h"`
+			HubLinks     int           `conf:"default:100"`
+			HubBoost     float64       `conf:"default:2"`
+		}
+		Frontier struct {
+			Path      string        `conf:"default:data/frontier"`
+			Scorer    string        `conf:"default:depth,help:depth or seed-rank or opic"`
+			OPICPath  string        `conf:"default:data/opic"`
+			HostDelay time.Duration `conf:"default:1s"`
+			Lease     time.Duration `conf:"default:10m"`
+		}
+		Links struct {
+			Scope           string        `conf:"default:domain,help:host or domain or all"`
+			MaxDepth        int           `conf:"default:5"`
+			MaxPagesPerHost int           `conf:"default:10000"`
+			SeenPath        string        `conf:"default:data/seen"`
+			Robots          bool          `conf:"default:true"`
+			RobotsAgent     string        `conf:"default:quantumscraper"`
+			RobotsTTL       time.Duration `conf:"default:24h"`
+			RobotsMaxHosts  int           `conf:"default:100000"`
+		}
+		Traps struct {
+			Enabled             bool `conf:"default:true"`
+			MaxURLGrowth        int  `conf:"default:256"`
+			MaxRepeatedSegments int  `conf:"default:3"`
+			MaxParams           int  `conf:"default:10"`
+			MaxPatternURLs      int  `conf:"default:1000"`
+			DuplicatePages      int  `conf:"default:20"`
+			HostTrapLimit       int  `conf:"default:1000"`
+			MaxHosts            int  `conf:"default:100000"`
+		}
+		Budget struct {
+			Enabled   bool              `conf:"default:true"`
+			Host      string            `conf:"default:10000/1GB/1h/100,help:pages/bytes/time/errors per host and 0 for no limit"`
+			Domain    string            `conf:"default:50000/5GB/4h/500,help:pages/bytes/time/errors per registered domain"`
+			Overrides map[string]string `conf:"help:domain pattern to budget like *.wikipedia.org:0/0/24h/0"`
+			Window    time.Duration     `conf:"default:24h"`
+		}
+		Health struct {
+			Enabled      bool          `conf:"default:true"`
+			Path         string        `conf:"default:data/host_health,help:keeps open circuits across restarts"`
+			Window       time.Duration `conf:"default:5m"`
+			MinRequests  int           `conf:"default:10"`
+			MaxErrorRate float64       `conf:"default:0.5"`
+			MaxFailures  int           `conf:"default:5,help:consecutive failures that open the circuit"`
+			CoolOff      time.Duration `conf:"default:1m"`
+			MaxCoolOff   time.Duration `conf:"default:24h"`
+			HalfOpen     bool          `conf:"default:true,help:probe with one fetch after the cool-off"`
+		}
+		IPLimit struct {
+			Enabled   bool     `conf:"default:true"`
+			IP        string   `conf:"default:4/2,help:conns/rps per server IP and 0 for no limit"`
+			Subnet    string   `conf:"default:16/8,help:conns/rps per /24 or /48"`
+			ASNFile   string   `conf:"help:lines like AS13335 104.16.0.0/13 for overrides by ASN"`
+			Overrides []string `conf:"help:ASN or CIDR with ip conns/ip rps/subnet conns/subnet rps like AS13335=64/50/256/200"`
+		}
+		TLS struct {
+			Mode string `conf:"default:off,help:off or verify or record which also counts handshakes by outcome"`
+		}
+		DNS struct {
+			Servers       []string      `conf:"default:1.1.1.1;1.0.0.1;8.8.8.8;8.8.4.4;9.9.9.9;149.112.112.112,help:IPs for UDP or tls://IP for DoT or https:// URLs for DoH with an IP host or a bootstrap #IP"`
+			ServersFile   string        `conf:"help:public-dns.info style JSON file of more resolvers"`
+			ServersURL    string        `conf:"help:public-dns.info style JSON URL of more resolvers like https://public-dns.info/nameserver/us.json"`
+			MaxErrorRate  float64       `conf:"default:0.3"`
+			MaxLatency    time.Duration `conf:"default:1s"`
+			MinQueries    int           `conf:"default:20,help:before a resolver can be dropped"`
+			QueryTimeout  time.Duration `conf:"default:2s"`
+			CheckInterval time.Duration `conf:"default:1m"`
+			ProbeName     string        `conf:"default:www.google.com"`
+			CrossChecks   int           `conf:"default:5,help:answers of resolvers from the file or URL compared with the servers' before they're used"`
+			MinTTL        time.Duration `conf:"default:1m"`
+			MaxTTL        time.Duration `conf:"default:1h"`
+			NegativeTTL   time.Duration `conf:"default:10m,help:for NXDOMAIN answers without a SOA record"`
+			MaxEntries    int           `conf:"default:1000000"`
+			Timeout       time.Duration `conf:"default:10s"`
+		}
+		Body struct {
+			MaxCompressed   string `conf:"default:10MB"`
+			MaxDecompressed string `conf:"default:50MB"`
+			MaxWire         string `conf:"default:64MB,help:most fasthttp buffers and larger bodies are refetched streaming"`
+			Limits          map[string]string
+		}
+		Cookies struct {
+			Enabled    bool          `conf:"default:true,help:keep cookies per site within a host batch: off for anonymous crawling"`
+			MaxSites   int           `conf:"default:100000"`
+			MaxCookies int           `conf:"default:50"`
+			MaxAge     time.Duration `conf:"default:1h"`
+		}
+		Bandwidth struct {
+			Global   string `conf:"default:0,help:bytes per second over all connections like 10MB: 0 for no limit"`
+			PerHost  string `conf:"default:0"`
+			PerProxy string `conf:"default:0"`
+		}
+		Proxy struct {
+			URLs          []string
+			File          string
+			Strategy      string        `conf:"default:round-robin"`
+			MaxFailures   int           `conf:"default:3"`
+			ProbeInterval time.Duration `conf:"default:1m"`
+			ProbeAddr     string        `conf:"default:www.google.com:443"`
 		}
 		UrlList struct {
 			URL        string `conf:"default:https://tranco-list.eu/download/Z249G/full"`
@@ -64,6 +185,105 @@ func run() error {
 	// -------------------------------------------------------------------------
 	// Initialization
 
+	if err := http.SetTLSMode(cfg.TLS.Mode); err != nil {
+		return fmt.Errorf("tls mode: %w", err)
+	}
+	if err := http.SetDialFamily(cfg.Fetcher.Family); err != nil {
+		return fmt.Errorf("dial family: %w", err)
+	}
+	if err := http.SetRequestProfiles(cfg.Profile.Default, cfg.Profile.Hosts, cfg.Profile.Contact); err != nil {
+		return fmt.Errorf("request profiles: %w", err)
+	}
+
+	bodyLimits, err := http.NewBodyLimits(cfg.Body.MaxCompressed, cfg.Body.MaxDecompressed, cfg.Body.MaxWire, cfg.Body.Limits)
+	if err != nil {
+		return fmt.Errorf("body limits: %w", err)
+	}
+	http.SetBodyLimits(bodyLimits)
+
+	if cfg.Cookies.Enabled {
+		http.SetCookieJar(http.NewCookieJar(http.CookieJarConfig{
+			MaxSites:   cfg.Cookies.MaxSites,
+			MaxCookies: cfg.Cookies.MaxCookies,
+			MaxAge:     cfg.Cookies.MaxAge,
+		}))
+	}
+
+	var bandwidthLimits http.BandwidthLimits
+	if bandwidthLimits.Global, err = http.ParseSize(cfg.Bandwidth.Global); err != nil {
+		return fmt.Errorf("global bandwidth: %w", err)
+	}
+	if bandwidthLimits.PerHost, err = http.ParseSize(cfg.Bandwidth.PerHost); err != nil {
+		return fmt.Errorf("per host bandwidth: %w", err)
+	}
+	if bandwidthLimits.PerProxy, err = http.ParseSize(cfg.Bandwidth.PerProxy); err != nil {
+		return fmt.Errorf("per proxy bandwidth: %w", err)
+	}
+	http.BandwidthControl().SetLimits(bandwidthLimits)
+	nethttp.Handle("/admin/bandwidth", http.BandwidthControl())
+
+	dnsServers := cfg.DNS.Servers
+	if cfg.DNS.ServersFile != "" {
+		fileServers, err := http.LoadDNSServerFile(cfg.DNS.ServersFile)
+		if err != nil {
+			return fmt.Errorf("load dns server file: %w", err)
+		}
+		dnsServers = append(dnsServers, fileServers...)
+	}
+	if cfg.DNS.ServersURL != "" {
+		reliableServers, err := http.FetchReliableDNSRecords(cfg.DNS.ServersURL)
+		if err != nil {
+			return fmt.Errorf("dns server loading error: %w", err)
+		}
+		dnsServers = append(dnsServers, reliableServers...)
+	}
+	dnsPool, err := http.NewDNSPool(dnsServers, http.DNSPoolConfig{
+		MaxErrorRate:  cfg.DNS.MaxErrorRate,
+		MaxLatency:    cfg.DNS.MaxLatency,
+		MinQueries:    cfg.DNS.MinQueries,
+		Timeout:       cfg.DNS.QueryTimeout,
+		CheckInterval: cfg.DNS.CheckInterval,
+		ProbeName:     cfg.DNS.ProbeName,
+		Trusted:       cfg.DNS.Servers,
+		CrossChecks:   cfg.DNS.CrossChecks,
+	})
+	if err != nil {
+		return fmt.Errorf("dns pool: %w", err)
+	}
+	go dnsPool.StartHealthChecks()
+	http.SetDNSCache(http.NewDNSCache(http.DNSCacheConfig{
+		MinTTL:      cfg.DNS.MinTTL,
+		MaxTTL:      cfg.DNS.MaxTTL,
+		NegativeTTL: cfg.DNS.NegativeTTL,
+		MaxEntries:  cfg.DNS.MaxEntries,
+		Timeout:     cfg.DNS.Timeout,
+	}, dnsPool))
+
+	proxyEntries := cfg.Proxy.URLs
+	if proxyURL := os.Getenv("PROXY_URL"); proxyURL != "" {
+		proxyEntries = append(proxyEntries, proxyURL)
+	}
+	if cfg.Proxy.File != "" {
+		fileEntries, err := http.LoadProxyFile(cfg.Proxy.File)
+		if err != nil {
+			return fmt.Errorf("load proxy file: %w", err)
+		}
+		proxyEntries = append(proxyEntries, fileEntries...)
+	}
+
+	// Enforce proxy
+	if len(proxyEntries) == 0 {
+		log.Println("Please set proxy environment variable or proxy file (use direct:// to crawl without a proxy)")
+		os.Exit(1)
+	}
+
+	proxyPool, err := http.NewProxyPool(proxyEntries, cfg.Proxy.Strategy, cfg.Proxy.MaxFailures)
+	if err != nil {
+		return fmt.Errorf("proxy pool: %w", err)
+	}
+	http.SetProxyPool(proxyPool)
+	go proxyPool.StartHealthChecks(cfg.Proxy.ProbeInterval, cfg.Proxy.ProbeAddr)
+
 	// nsqdServer, err := storage.NewNSQDServer()
 	// if err != nil {
 	// 	return fmt.Errorf("start nsqd embedded server: %w", err)
@@ -73,9 +293,159 @@ func run() error {
 	// 	return fmt.Errorf("visited url storage creation: %w", err)
 	// }
 
-	// if _, err := http.FetchReliableDNSRecords("https://public-dns.info/nameserver/us.json"); err != nil {
-	// 	return fmt.Errorf("dns server loading error: %w", err)
-	// }
+	fetcher, err := http.NewFetcher(cfg.Fetcher.Backend)
+	if err != nil {
+		return fmt.Errorf("fetcher: %w", err)
+	}
+	var cassette *http.Cassette
+	switch {
+	case cfg.Fetcher.Replay != "":
+		replayCassette, err := http.LoadCassette(cfg.Fetcher.Replay)
+		if err != nil {
+			return fmt.Errorf("load cassette: %w", err)
+		}
+		fetcher = http.NewReplayFetcher(replayCassette)
+	case cfg.Fetcher.Record != "":
+		cassette, err = http.CreateCassette(cfg.Fetcher.Record)
+		if err != nil {
+			return err
+		}
+		fetcher = http.NewRecordingFetcher(fetcher, cassette)
+	}
+
+	var history *storage.FetchHistory
+	if cfg.History.Path != "" {
+		history, err = storage.NewFetchHistory(cfg.History.Path)
+		if err != nil {
+			return fmt.Errorf("fetch history: %w", err)
+		}
+		defer history.Close()
+	}
+
+	var budgets *worker.Budgets
+	if cfg.Budget.Enabled {
+		policy := worker.BudgetPolicy{Window: cfg.Budget.Window}
+		if policy.Host, err = worker.ParseBudget(cfg.Budget.Host); err != nil {
+			return fmt.Errorf("host budget: %w", err)
+		}
+		if policy.Domain, err = worker.ParseBudget(cfg.Budget.Domain); err != nil {
+			return fmt.Errorf("domain budget: %w", err)
+		}
+		if policy.Overrides, err = worker.NewBudgetOverrides(cfg.Budget.Overrides); err != nil {
+			return fmt.Errorf("budget overrides: %w", err)
+		}
+		if cfg.Crawler.Mode == "single" {
+			policy.Window = 0 // Usage lasts for a pass
+		}
+		budgets = worker.NewBudgets(policy)
+	}
+
+	var ipLimits *worker.IPLimiter
+	if cfg.IPLimit.Enabled {
+		policy := worker.IPLimitPolicy{}
+		if policy.IP, err = worker.ParseIPLimit(cfg.IPLimit.IP); err != nil {
+			return fmt.Errorf("ip limit: %w", err)
+		}
+		if policy.Subnet, err = worker.ParseIPLimit(cfg.IPLimit.Subnet); err != nil {
+			return fmt.Errorf("subnet limit: %w", err)
+		}
+		var asnPrefixes map[string][]*net.IPNet
+		if cfg.IPLimit.ASNFile != "" {
+			if asnPrefixes, err = worker.LoadASNPrefixes(cfg.IPLimit.ASNFile); err != nil {
+				return fmt.Errorf("asn prefixes: %w", err)
+			}
+		}
+		if policy.Overrides, err = worker.ParseIPLimitOverrides(cfg.IPLimit.Overrides, asnPrefixes); err != nil {
+			return fmt.Errorf("ip limit overrides: %w", err)
+		}
+		ipLimits = worker.NewIPLimiter(policy)
+	}
+
+	var health *worker.HostHealth
+	if cfg.Health.Enabled {
+		var healthStore *storage.HealthStore
+		if cfg.Health.Path != "" {
+			healthStore, err = storage.NewHealthStore(cfg.Health.Path)
+			if err != nil {
+				return fmt.Errorf("health store: %w", err)
+			}
+			defer healthStore.Close()
+		}
+		health = worker.NewHostHealth(worker.HealthPolicy{
+			Window:       cfg.Health.Window,
+			MinRequests:  cfg.Health.MinRequests,
+			MaxErrorRate: cfg.Health.MaxErrorRate,
+			MaxFailures:  cfg.Health.MaxFailures,
+			CoolOff:      cfg.Health.CoolOff,
+			MaxCoolOff:   cfg.Health.MaxCoolOff,
+			HalfOpen:     cfg.Health.HalfOpen,
+		}, healthStore)
+		nethttp.Handle("/admin/health", health)
+	}
+
+	var schedule *storage.Schedule
+	var frontier *storage.Frontier
+	var seen *storage.SeenSet
+	var robots *worker.RobotsCache
+	var traps *worker.TrapDetector
+	switch cfg.Crawler.Mode {
+	case "single":
+	case "continuous":
+		schedule, err = storage.NewSchedule(cfg.Recrawl.SchedulePath)
+		if err != nil {
+			return fmt.Errorf("recrawl schedule: %w", err)
+		}
+		defer schedule.Close()
+	default:
+		return fmt.Errorf("unknown crawler mode: %s", cfg.Crawler.Mode)
+	}
+
+	// Both modes follow links: single mode crawls them from the frontier once the seeds are done
+	var scorer storage.Scorer
+	switch cfg.Frontier.Scorer {
+	case storage.ScorerDepth:
+		scorer = storage.DepthScorer{}
+	case storage.ScorerSeedRank:
+		ranks, err := urlloader.LoadRanks(cfg.UrlList.URL, cfg.UrlList.CachePath)
+		if err != nil {
+			return fmt.Errorf("seed ranks: %w", err)
+		}
+		scorer = storage.SeedRankScorer{Ranks: ranks}
+	case storage.ScorerOPIC:
+		opicScorer, err := storage.NewOPICScorer(cfg.Frontier.OPICPath)
+		if err != nil {
+			return fmt.Errorf("opic scorer: %w", err)
+		}
+		defer opicScorer.Close()
+		scorer = opicScorer
+	default:
+		return fmt.Errorf("unknown scorer: %s", cfg.Frontier.Scorer)
+	}
+	frontier, err = storage.NewFrontier(cfg.Frontier.Path, scorer, cfg.Frontier.HostDelay, cfg.Frontier.Lease)
+	if err != nil {
+		return fmt.Errorf("frontier: %w", err)
+	}
+	defer frontier.Close()
+	seen, err = storage.NewSeenSet(cfg.Links.SeenPath)
+	if err != nil {
+		return fmt.Errorf("seen set: %w", err)
+	}
+	defer seen.Close()
+	if cfg.Links.Robots {
+		robots = worker.NewRobotsCache(fetcher, cfg.Links.RobotsAgent, cfg.Links.RobotsTTL, cfg.Links.RobotsMaxHosts)
+	}
+	if cfg.Traps.Enabled {
+		traps = worker.NewTrapDetector(worker.TrapPolicy{
+			MaxURLGrowth:        cfg.Traps.MaxURLGrowth,
+			MaxRepeatedSegments: cfg.Traps.MaxRepeatedSegments,
+			MaxParams:           cfg.Traps.MaxParams,
+			MaxPatternURLs:      cfg.Traps.MaxPatternURLs,
+			DuplicatePages:      cfg.Traps.DuplicatePages,
+			HostTrapLimit:       cfg.Traps.HostTrapLimit,
+			MaxHosts:            cfg.Traps.MaxHosts,
+		})
+		nethttp.Handle("/admin/traps", traps)
+	}
 
 	go metrics.StartMetricsServer()
 
@@ -90,12 +460,43 @@ func run() error {
 	// }()
 
 	// Start queue workers
-	// consumers, err := worker.StartQueueWorkers(cfg.Crawler.Concurrency, queue)
+	// consumers, err := worker.StartQueueWorkers(workerConfig, queue)
 	// if err != nil {
 	// 	return fmt.Errorf("worker process: %w", err)
 	// }
 	var workerWg sync.WaitGroup
-	worker.StartWorkers(cfg.UrlList.URL, cfg.UrlList.CachePath, cfg.UrlList.ParquetDir, &workerWg, cfg.Crawler.Concurrency)
+	workerConfig := &worker.Config{
+		URLListURL:       cfg.UrlList.URL,
+		URLListCachePath: cfg.UrlList.CachePath,
+		ParquetDir:       cfg.UrlList.ParquetDir,
+		Concurrency:      cfg.Crawler.Concurrency,
+		Fetcher:          fetcher,
+		History:          history,
+		Schedule:         schedule,
+		Frontier:         frontier,
+		Seen:             seen,
+		Robots:           robots,
+		Traps:            traps,
+		Budgets:          budgets,
+		Health:           health,
+		IPLimits:         ipLimits,
+		Recrawl: worker.RecrawlPolicy{
+			Initial:  cfg.Recrawl.Initial,
+			Min:      cfg.Recrawl.Min,
+			Max:      cfg.Recrawl.Max,
+			Lease:    cfg.Recrawl.Lease,
+			HubLinks: cfg.Recrawl.HubLinks,
+			HubBoost: cfg.Recrawl.HubBoost,
+		},
+		Links: worker.LinkPolicy{
+			Scope:           cfg.Links.Scope,
+			MaxDepth:        cfg.Links.MaxDepth,
+			MaxPagesPerHost: cfg.Links.MaxPagesPerHost,
+		},
+	}
+	if err := worker.StartWorkers(workerConfig, &workerWg); err != nil {
+		return fmt.Errorf("start workers: %w", err)
+	}
 
 	// -------------------------------------------------------------------------
 	// Shutdown
@@ -112,6 +513,11 @@ func run() error {
 
 	// Wait until closed
 	workerWg.Wait()
+	if cassette != nil {
+		if err := cassette.Close(); err != nil {
+			return err
+		}
+	}
 	// queue.StopSignal()
 	// time.Sleep(time.Millisecond * 100)
 	// for _, consumer := range consumers {
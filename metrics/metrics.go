@@ -14,13 +14,13 @@ var (
 	RequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "request_count",
 		Help: "The total number of requests made",
-	}, []string{"code"})
+	}, []string{"code", "protocol", "family"})
 
 	RequestLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "request_latency",
 		Help:    "Request latencies",
 		Buckets: prometheus.ExponentialBuckets(0.02, 2, 15),
-	}, []string{"code"})
+	}, []string{"code", "protocol", "family"})
 
 	RequestInFlightCount = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "request_inflight_count",
@@ -31,6 +31,159 @@ var (
 		Name: "found_urls_count",
 		Help: "The total number of unique URLs found during scraping",
 	})
+
+	RevisitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "revisit_count",
+		Help: "The total number of revisits by outcome",
+	}, []string{"result"})
+
+	RecrawlDueCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "recrawl_due_count",
+		Help: "The total number of URLs taken from the recrawl schedule",
+	})
+
+	FrontierClaimCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "frontier_claim_count",
+		Help: "The total number of URLs claimed from the frontier",
+	})
+
+	URLScore = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "url_score",
+		Help:    "Scores given to URLs queued in the frontier",
+		Buckets: prometheus.ExponentialBuckets(0.000001, 10, 10),
+	}, []string{"scorer"})
+
+	LinkCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "link_count",
+		Help: "The total number of discovered links, by whether they were enqueued or why not",
+	}, []string{"result"})
+
+	TrapURLCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trap_url_count",
+		Help: "The total number of discovered links dropped as crawler traps, by reason",
+	}, []string{"reason"})
+
+	TrapPatternsQuarantined = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trap_patterns_quarantined",
+		Help: "The number of URL patterns quarantined as crawler traps",
+	})
+
+	TrapHostsCapped = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trap_hosts_capped",
+		Help: "The number of hosts whose links are no longer followed because of too many traps",
+	})
+
+	BudgetDeferredCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "budget_deferred_count",
+		Help: "The total number of URLs deferred because their host or domain ran out of budget, by budget",
+	}, []string{"budget"})
+
+	BudgetDroppedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "budget_dropped_count",
+		Help: "The total number of URLs given up on because their host or domain ran out of its error budget, by budget",
+	}, []string{"budget"})
+
+	DNSLookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_lookup_count",
+		Help: "The total number of DNS lookups, by result: hit, negative_hit, miss, coalesced, and resolved, nxdomain or error for queries",
+	}, []string{"result"})
+
+	DNSPrefetchCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_prefetch_count",
+		Help: "The total number of hosts resolved ahead of their fetches",
+	})
+
+	DNSServerCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_server_count",
+		Help: "The number of resolvers in the DNS pool, by state",
+	}, []string{"state"})
+
+	DNSServerDropCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_server_drop_count",
+		Help: "The total number of resolvers dropped from the DNS pool, by reason",
+	}, []string{"reason"})
+
+	DialCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dial_count",
+		Help: "The total number of direct dials, by address family and result",
+	}, []string{"family", "result"})
+
+	IPLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ip_limit_wait",
+		Help:    "Time fetches waited for the limits of their server IP or subnet, by scope",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"scope"})
+
+	CircuitOpenCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_open_count",
+		Help: "The total number of circuits opened for failing hosts or IPs, by scope",
+	}, []string{"scope"})
+
+	CircuitRejectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_reject_count",
+		Help: "The total number of host batches held back by an open circuit, by scope",
+	}, []string{"scope"})
+
+	RobotsDisallowCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "robots_disallow_count",
+		Help: "The total number of fetches skipped because robots.txt disallows them",
+	})
+
+	SitemapBoostCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sitemap_boost_count",
+		Help: "The total number of URLs moved up because their sitemap lastmod was newer than our last fetch",
+	})
+
+	TruncatedBodyCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "truncated_body_count",
+		Help: "The total number of response bodies cut off at the body limits",
+	})
+
+	TLSConnectionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tls_connection_count",
+		Help: "The total number of recorded TLS connections by version and certificate validity",
+	}, []string{"version", "verified"})
+
+	ProxyRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_request_count",
+		Help: "The total number of requests made through each proxy",
+	}, []string{"proxy", "code"})
+
+	ProxyErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_error_count",
+		Help: "The total number of failed proxy dials",
+	}, []string{"proxy"})
+
+	ProxyLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_latency",
+		Help:    "Request latencies per proxy",
+		Buckets: prometheus.ExponentialBuckets(0.02, 2, 15),
+	}, []string{"proxy"})
+
+	ProxyHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_healthy",
+		Help: "Whether the proxy is in rotation (1) or not (0)",
+	}, []string{"proxy"})
+
+	NetworkBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "network_bytes",
+		Help: "The total number of bytes read (in) and written (out) on crawl connections",
+	}, []string{"direction"})
+
+	BodyBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "body_bytes",
+		Help: "The total number of response body bytes off the wire and after decoding, by content encoding",
+	}, []string{"encoding", "stage"})
+
+	CookieDropCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cookie_drop_count",
+		Help: "The total number of cookies ignored because their site had too many",
+	})
+
+	BandwidthLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bandwidth_limit",
+		Help: "The bandwidth limit in bytes per second, 0 for none",
+	}, []string{"scope"})
 )
 
 func StartMetricsServer() {
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/musabgultekin/quantumscraper/metrics"
+)
+
+var (
+	frontierQueuePrefix = []byte("q/") // q/<host>\x00<priority><url> -> nil, queued URLs of a host by priority
+	frontierURLPrefix   = []byte("u/") // u/<url> -> queue key, or lease key while claimed
+	frontierHostPrefix  = []byte("h/") // h/<host> -> <unix nanos>, when the host may be fetched again
+	frontierReadyPrefix = []byte("r/") // r/<unix nanos><host> -> nil, hosts with queued URLs by ready time
+	frontierLeasePrefix = []byte("l/") // l/<unix nanos><url> -> queue key, claimed URLs by lease expiry
+)
+
+// Frontier is a persistent per host URL frontier backed by Badger. URLs are claimed one per host
+// at a time, highest priority first, and a host isn't claimed from again until its claimed URL is
+// acked and the host delay passed, so the delay runs between fetches however long URLs wait for a worker.
+// Claimed URLs are leased: unless acked before the lease expires, they're queued again.
+// Nothing is held in memory, so it scales with the disk.
+type Frontier struct {
+	db        *badger.DB
+	scorer    Scorer
+	hostDelay time.Duration
+	lease     time.Duration
+}
+
+func NewFrontier(path string, scorer Scorer, hostDelay, lease time.Duration) (*Frontier, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %w", err)
+	}
+	return &Frontier{db: db, scorer: scorer, hostDelay: hostDelay, lease: lease}, nil
+}
+
+func (frontier *Frontier) Close() error {
+	if err := frontier.db.Close(); err != nil {
+		return fmt.Errorf("failed to close badger db: %w", err)
+	}
+	return nil
+}
+
+// Push queues the URL with the score the scorer gives it. Higher scores are claimed first.
+// If the URL is queued already, its score is updated. If it's claimed, it's left alone.
+func (frontier *Frontier) Push(info URLInfo) (added bool, err error) {
+	return frontier.enqueue(info, false)
+}
+
+// Rescore updates the score of a URL that is still queued, e.g. when another page links to it.
+// URLs that aren't queued, because they were claimed, acked or never pushed, are left alone.
+func (frontier *Frontier) Rescore(info URLInfo) error {
+	queued := false
+	err := frontier.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(frontierURLKey(info.URL))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get url from badger db: %w", err)
+		}
+		return item.Value(func(value []byte) error {
+			queued = bytes.HasPrefix(value, frontierQueuePrefix)
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("store db view: %w", err)
+	}
+	if !queued {
+		return nil
+	}
+	_, err = frontier.enqueue(info, true)
+	return err
+}
+
+func (frontier *Frontier) enqueue(info URLInfo, onlyQueued bool) (added bool, err error) {
+	host, err := frontierHost(info.URL)
+	if err != nil {
+		return false, err
+	}
+	score, err := frontier.scorer.Score(info)
+	if err != nil {
+		return false, fmt.Errorf("score: %w", err)
+	}
+	metrics.URLScore.WithLabelValues(frontier.scorer.Name()).Observe(score)
+
+	queueKey := frontierQueueKey(host, score, info.URL)
+	// Claims rewrite the ready keys of the hosts pushed to
+	for attempt := 0; attempt < 10; attempt++ {
+		added, err = frontier.push(queueKey, info.URL, onlyQueued)
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+		conflictBackoff()
+	}
+	return added, err
+}
+
+func (frontier *Frontier) push(queueKey []byte, targetURL string, onlyQueued bool) (added bool, err error) {
+	err = frontier.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(frontierURLKey(targetURL))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return fmt.Errorf("failed to get url from badger db: %w", err)
+		}
+		if item != nil {
+			previous, err := item.ValueCopy(nil)
+			if err != nil {
+				return fmt.Errorf("failed to read url entry: %w", err)
+			}
+			if !bytes.HasPrefix(previous, frontierQueuePrefix) || bytes.Equal(previous, queueKey) {
+				return nil
+			}
+			if err := txn.Delete(previous); err != nil {
+				return err
+			}
+			return queueURL(txn, queueKey)
+		}
+		if onlyQueued {
+			return nil // Claimed since it was looked up
+		}
+		added = true
+		return queueURL(txn, queueKey)
+	})
+	if err != nil {
+		return false, fmt.Errorf("store db update: %w", err)
+	}
+	return added, nil
+}
+
+// Claim leases up to max URLs, one per host that is ready at now.
+func (frontier *Frontier) Claim(now time.Time, max int) (urls []string, err error) {
+	if err := frontier.reclaimExpired(now, max); err != nil {
+		return nil, err
+	}
+	// Workers push and ack concurrently, and touch the same host keys
+	for attempt := 0; attempt < 10; attempt++ {
+		urls, err = frontier.claim(now, max)
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+		conflictBackoff()
+	}
+	return urls, err
+}
+
+func (frontier *Frontier) claim(now time.Time, max int) ([]string, error) {
+	var urls []string
+	err := frontier.db.Update(func(txn *badger.Txn) error {
+		urls = urls[:0]
+		var hosts []string
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = frontierReadyPrefix
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid() && len(hosts) < max; it.Next() {
+			at, host := parseTimeKey(frontierReadyPrefix, it.Item().Key())
+			if at.After(now) {
+				break
+			}
+			hosts = append(hosts, host)
+		}
+		it.Close()
+
+		// Look up every host before writing, iterators over a txn with pending writes sort them all
+		queueKeys := make([][]byte, len(hosts))
+		mores := make([]bool, len(hosts))
+		for i, host := range hosts {
+			queueKeys[i], mores[i] = firstQueued(txn, host)
+		}
+
+		for i, host := range hosts {
+			queueKey, more := queueKeys[i], mores[i]
+			if queueKey != nil {
+				targetURL := queueKeyURL(queueKey)
+				leaseKey := timeKey(frontierLeasePrefix, now.Add(frontier.lease), targetURL)
+				if err := txn.Delete(queueKey); err != nil {
+					return err
+				}
+				if err := txn.Set(leaseKey, queueKey); err != nil {
+					return err
+				}
+				if err := txn.Set(frontierURLKey(targetURL), leaseKey); err != nil {
+					return err
+				}
+				urls = append(urls, targetURL)
+			}
+			// The host waits for the ack, or the lease to expire
+			ready := now.Add(frontier.hostDelay)
+			if queueKey != nil {
+				ready = now.Add(frontier.lease)
+			}
+			if err := setHostReady(txn, host, ready, more); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store db update: %w", err)
+	}
+	return urls, nil
+}
+
+// Ack removes a claimed URL for good, and makes its host ready after the host delay.
+// Acking an unclaimed URL removes it from the queue.
+func (frontier *Frontier) Ack(targetURL string) (err error) {
+	// Claims rewrite the ready keys of the hosts acked
+	for attempt := 0; attempt < 10; attempt++ {
+		err = frontier.ack(targetURL, time.Now())
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+		conflictBackoff()
+	}
+	return err
+}
+
+func (frontier *Frontier) ack(targetURL string, now time.Time) error {
+	err := frontier.db.Update(func(txn *badger.Txn) error {
+		urlKey := frontierURLKey(targetURL)
+		item, err := txn.Get(urlKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get url from badger db: %w", err)
+		}
+		key, err := item.ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("failed to read url entry: %w", err)
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if err := txn.Delete(urlKey); err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(key, frontierLeasePrefix) {
+			return nil
+		}
+		host, err := frontierHost(targetURL)
+		if err != nil {
+			return err
+		}
+		queueKey, _ := firstQueued(txn, host)
+		return setHostReady(txn, host, now.Add(frontier.hostDelay), queueKey != nil)
+	})
+	if err != nil {
+		return fmt.Errorf("store db update: %w", err)
+	}
+	return nil
+}
+
+// SetHostReady delays the host until the given time, e.g. for a crawl delay or a backoff.
+func (frontier *Frontier) SetHostReady(host string, at time.Time) error {
+	err := frontier.db.Update(func(txn *badger.Txn) error {
+		queueKey, _ := firstQueued(txn, host)
+		return setHostReady(txn, host, at, queueKey != nil)
+	})
+	if err != nil {
+		return fmt.Errorf("store db update: %w", err)
+	}
+	return nil
+}
+
+// NextReady returns the earliest time a host with queued URLs is ready, or false if nothing is queued.
+func (frontier *Frontier) NextReady() (time.Time, bool, error) {
+	var next time.Time
+	var found bool
+	err := frontier.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = frontierReadyPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		if it.Valid() {
+			next, _ = parseTimeKey(frontierReadyPrefix, it.Item().Key())
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("store db view: %w", err)
+	}
+	return next, found, nil
+}
+
+// Drained reports whether no URL is queued or claimed anymore.
+func (frontier *Frontier) Drained() (bool, error) {
+	drained := true
+	err := frontier.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range [][]byte{frontierReadyPrefix, frontierLeasePrefix} {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Prefix = prefix
+			it := txn.NewIterator(opts)
+			it.Rewind()
+			if it.Valid() {
+				drained = false
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("store db view: %w", err)
+	}
+	return drained, nil
+}
+
+// reclaimExpired queues again up to max claimed URLs whose lease expired at now.
+func (frontier *Frontier) reclaimExpired(now time.Time, max int) error {
+	err := frontier.db.Update(func(txn *badger.Txn) error {
+		var leaseKeys, queueKeys [][]byte
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = frontierLeasePrefix
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid() && len(leaseKeys) < max; it.Next() {
+			item := it.Item()
+			if at, _ := parseTimeKey(frontierLeasePrefix, item.Key()); at.After(now) {
+				break
+			}
+			queueKey, err := item.ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return fmt.Errorf("failed to read lease: %w", err)
+			}
+			leaseKeys = append(leaseKeys, item.KeyCopy(nil))
+			queueKeys = append(queueKeys, queueKey)
+		}
+		it.Close()
+
+		for i := range leaseKeys {
+			if err := txn.Delete(leaseKeys[i]); err != nil {
+				return err
+			}
+			if err := queueURL(txn, queueKeys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("store db update: %w", err)
+	}
+	return nil
+}
+
+// conflictBackoff sleeps a few random milliseconds before a conflicting transaction is retried,
+// so it doesn't collide again with the one it conflicted with.
+func conflictBackoff() {
+	time.Sleep(time.Duration(rand.Int63n(int64(time.Millisecond * 5))))
+}
+
+// queueURL adds the queue entry and makes sure its host is in the ready index.
+func queueURL(txn *badger.Txn, queueKey []byte) error {
+	if err := txn.Set(queueKey, []byte{}); err != nil {
+		return err
+	}
+	if err := txn.Set(frontierURLKey(queueKeyURL(queueKey)), queueKey); err != nil {
+		return err
+	}
+	host := queueKeyHost(queueKey)
+	at, err := hostReady(txn, host)
+	if err != nil {
+		return err
+	}
+	return txn.Set(timeKey(frontierReadyPrefix, at, host), []byte{})
+}
+
+// hostReady returns when the host may be fetched again, zero time if it never was.
+func hostReady(txn *badger.Txn, host string) (time.Time, error) {
+	item, err := txn.Get(frontierHostKey(host))
+	if err == badger.ErrKeyNotFound {
+		return time.Unix(0, 0), nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get host from badger db: %w", err)
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read host: %w", err)
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value))), nil
+}
+
+// setHostReady moves the host in the ready index. Hosts without queued URLs are left out of it.
+func setHostReady(txn *badger.Txn, host string, at time.Time, queued bool) error {
+	previous, err := hostReady(txn, host)
+	if err != nil {
+		return err
+	}
+	if err := txn.Delete(timeKey(frontierReadyPrefix, previous, host)); err != nil {
+		return err
+	}
+	nanos := make([]byte, 8)
+	binary.BigEndian.PutUint64(nanos, uint64(at.UnixNano()))
+	if err := txn.Set(frontierHostKey(host), nanos); err != nil {
+		return err
+	}
+	if !queued {
+		return nil
+	}
+	return txn.Set(timeKey(frontierReadyPrefix, at, host), []byte{})
+}
+
+// firstQueued returns the highest priority queue key of the host, and whether there are more.
+func firstQueued(txn *badger.Txn, host string) ([]byte, bool) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.PrefetchSize = 2
+	opts.Prefix = frontierHostQueuePrefix(host)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	it.Rewind()
+	if !it.Valid() {
+		return nil, false
+	}
+	queueKey := it.Item().KeyCopy(nil)
+	it.Next()
+	return queueKey, it.Valid()
+}
+
+func frontierHost(targetURL string) (string, error) {
+	targetURLParsed, err := url.Parse(targetURL)
+	if err != nil {
+		return "", fmt.Errorf("target url parse err: %w", err)
+	}
+	if targetURLParsed.Host == "" {
+		return "", fmt.Errorf("target url has no host: %s", targetURL)
+	}
+	return strings.ToLower(targetURLParsed.Host), nil
+}
+
+func frontierHostQueuePrefix(host string) []byte {
+	key := make([]byte, 0, len(frontierQueuePrefix)+len(host)+1)
+	key = append(key, frontierQueuePrefix...)
+	key = append(key, host...)
+	return append(key, 0)
+}
+
+func frontierQueueKey(host string, priority float64, targetURL string) []byte {
+	key := frontierHostQueuePrefix(host)
+	key = binary.BigEndian.AppendUint64(key, priorityBits(priority))
+	return append(key, targetURL...)
+}
+
+func queueKeyHost(queueKey []byte) string {
+	key := queueKey[len(frontierQueuePrefix):]
+	return string(key[:bytes.IndexByte(key, 0)])
+}
+
+func queueKeyURL(queueKey []byte) string {
+	key := queueKey[len(frontierQueuePrefix):]
+	return string(key[bytes.IndexByte(key, 0)+1+8:])
+}
+
+// priorityBits maps a priority to a key that sorts higher priorities first.
+func priorityBits(priority float64) uint64 {
+	bits := math.Float64bits(priority)
+	if bits&(1<<63) == 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return ^bits
+}
+
+func frontierURLKey(targetURL string) []byte {
+	return append(append(make([]byte, 0, len(frontierURLPrefix)+len(targetURL)), frontierURLPrefix...), targetURL...)
+}
+
+func frontierHostKey(host string) []byte {
+	return append(append(make([]byte, 0, len(frontierHostPrefix)+len(host)), frontierHostPrefix...), host...)
+}
+
+func timeKey(prefix []byte, at time.Time, suffix string) []byte {
+	key := make([]byte, 0, len(prefix)+8+len(suffix))
+	key = append(key, prefix...)
+	key = binary.BigEndian.AppendUint64(key, uint64(at.UnixNano()))
+	return append(key, suffix...)
+}
+
+func parseTimeKey(prefix []byte, key []byte) (time.Time, string) {
+	key = key[len(prefix):]
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8]))), string(key[8:])
+}
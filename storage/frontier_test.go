@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// priorityScorer scores URLs from a fixed table.
+type priorityScorer map[string]float64
+
+func (priorityScorer) Name() string { return "test" }
+
+func (scorer priorityScorer) Score(info URLInfo) (float64, error) {
+	return scorer[info.URL], nil
+}
+
+func TestFrontierClaim(t *testing.T) {
+	scorer := priorityScorer{}
+	frontier, err := NewFrontier(t.TempDir(), scorer, time.Second, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create frontier: %v", err)
+	}
+	defer frontier.Close()
+
+	pushes := []struct {
+		url      string
+		priority float64
+		added    bool
+	}{
+		{"https://a.com/2", 0.5, true},
+		{"https://a.com/1", 1, true},
+		{"https://b.com/1", 0.1, true},
+		{"https://a.com/2", 5, false}, // Rescored ahead of a.com/1
+	}
+	for _, push := range pushes {
+		scorer[push.url] = push.priority
+		added, err := frontier.Push(URLInfo{URL: push.url})
+		if err != nil {
+			t.Fatalf("Push %s failed: %v", push.url, err)
+		}
+		if added != push.added {
+			t.Errorf("Push %s added = %v, want %v", push.url, added, push.added)
+		}
+	}
+
+	now := time.Now()
+	claim := func(at time.Time, want ...string) {
+		t.Helper()
+		urls, err := frontier.Claim(at, 10)
+		if err != nil {
+			t.Fatalf("Claim failed: %v", err)
+		}
+		if len(urls) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(urls, want) {
+			t.Errorf("Claim at %v = %v, want %v", at.Sub(now), urls, want)
+		}
+	}
+
+	claim(now, "https://a.com/2", "https://b.com/1") // One per host, highest priority first
+	claim(now)                                       // Hosts aren't ready yet
+	claim(now.Add(2 * time.Second))                  // Nor after the host delay, until their URLs are acked
+	if err := frontier.Ack("https://a.com/2"); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	claim(now.Add(2*time.Second), "https://a.com/1")
+	claim(now.Add(2*time.Hour), "https://b.com/1", "https://a.com/1") // Leases expired, acked URL stays gone
+	if drained, err := frontier.Drained(); err != nil || drained {
+		t.Errorf("Drained = %v, %v, want claimed URLs pending", drained, err)
+	}
+
+	if _, ok, err := frontier.NextReady(); err != nil || ok {
+		t.Errorf("NextReady = %v, %v, want nothing queued", ok, err)
+	}
+	for _, targetURL := range []string{"https://a.com/1", "https://b.com/1"} {
+		if err := frontier.Ack(targetURL); err != nil {
+			t.Fatalf("Ack failed: %v", err)
+		}
+	}
+	if drained, err := frontier.Drained(); err != nil || !drained {
+		t.Errorf("Drained = %v, %v, want true", drained, err)
+	}
+}
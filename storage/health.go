@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// HealthRecord is the circuit state of a host or IP, kept across restarts.
+type HealthRecord struct {
+	State               string        `json:"state"`
+	OpenUntil           time.Time     `json:"open_until,omitempty"`
+	CoolOff             time.Duration `json:"cool_off,omitempty"` // Of the last opening, doubles on each reopening
+	ConsecutiveFailures int           `json:"consecutive_failures,omitempty"`
+	Opens               int           `json:"opens,omitempty"`
+}
+
+// HealthStore persists health records backed by Badger.
+type HealthStore struct {
+	db *badger.DB
+}
+
+func NewHealthStore(path string) (*HealthStore, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %w", err)
+	}
+	return &HealthStore{db: db}, nil
+}
+
+func (store *HealthStore) Close() error {
+	if err := store.db.Close(); err != nil {
+		return fmt.Errorf("failed to close badger db: %w", err)
+	}
+	return nil
+}
+
+// Get returns the record of the key, or nil if there's none.
+func (store *HealthStore) Get(key string) (*HealthRecord, error) {
+	var record *HealthRecord
+	err := store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get health record from badger db: %w", err)
+		}
+		record = &HealthRecord{}
+		return item.Value(func(value []byte) error {
+			return json.Unmarshal(value, record)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store db view: %w", err)
+	}
+	return record, nil
+}
+
+func (store *HealthStore) Put(key string, record *HealthRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal health record: %w", err)
+	}
+	err = store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), value)
+	})
+	if err != nil {
+		return fmt.Errorf("store db update: %w", err)
+	}
+	return nil
+}
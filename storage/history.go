@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// FetchRecord is what we remember about the fetches of a URL.
+type FetchRecord struct {
+	ETag           string    `json:"etag,omitempty"`
+	LastModified   string    `json:"last_modified,omitempty"`
+	ContentHash    uint64    `json:"hash"`
+	FirstFetchedAt time.Time `json:"first_fetched_at"`
+	FetchedAt      time.Time `json:"fetched_at"`
+	ChangedAt      time.Time `json:"changed_at"`
+	Fetches        int       `json:"fetches"`
+	Changes        int       `json:"changes"`            // Revisits that found the content changed
+	Changed        bool      `json:"changed"`            // Whether the last revisit found the content changed
+	Failures       int       `json:"failures,omitempty"` // Failed fetches since the last successful one
+}
+
+// FetchHistory is a per URL fetch history backed by Badger.
+type FetchHistory struct {
+	db *badger.DB
+}
+
+func NewFetchHistory(path string) (*FetchHistory, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %w", err)
+	}
+	return &FetchHistory{db: db}, nil
+}
+
+func (history *FetchHistory) Close() error {
+	if err := history.db.Close(); err != nil {
+		return fmt.Errorf("failed to close badger db: %w", err)
+	}
+	return nil
+}
+
+// Get returns the record of the URL, or nil if it was never fetched.
+func (history *FetchHistory) Get(targetURL string) (*FetchRecord, error) {
+	var record *FetchRecord
+	err := history.db.View(func(txn *badger.Txn) error {
+		var err error
+		record, err = getFetchRecord(txn, targetURL)
+		return err
+	})
+	return record, err
+}
+
+// Record stores the outcome of a fetch and returns the updated record. Its Changed field tells
+// whether the content changed since the previous fetch. A not modified response counts as unchanged,
+// as does a body with the same hash as before.
+func (history *FetchHistory) Record(targetURL, etag, lastModified string, notModified bool, body []byte, fetchedAt time.Time) (*FetchRecord, error) {
+	var record *FetchRecord
+	err := history.db.Update(func(txn *badger.Txn) error {
+		var err error
+		record, err = getFetchRecord(txn, targetURL)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			record = &FetchRecord{}
+		}
+		if record.Fetches == 0 {
+			record.FirstFetchedAt, record.ChangedAt = fetchedAt, fetchedAt
+		}
+		changed := false
+		if !notModified {
+			hash := contentHash(body)
+			changed = record.Fetches > 0 && hash != record.ContentHash
+			record.ContentHash = hash
+			record.ETag = etag
+			record.LastModified = lastModified
+		}
+		if changed {
+			record.Changes++
+			record.ChangedAt = fetchedAt
+		}
+		record.Changed = changed
+		record.FetchedAt = fetchedAt
+		record.Fetches++
+		record.Failures = 0
+
+		value, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshal fetch record: %w", err)
+		}
+		return txn.Set(historyKey(targetURL), value)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store db update: %w", err)
+	}
+	return record, nil
+}
+
+// Failed counts a failed fetch of the URL and returns the failures since its last successful fetch.
+func (history *FetchHistory) Failed(targetURL string) (int, error) {
+	var failures int
+	err := history.db.Update(func(txn *badger.Txn) error {
+		record, err := getFetchRecord(txn, targetURL)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			record = &FetchRecord{}
+		}
+		record.Failures++
+		failures = record.Failures
+
+		value, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshal fetch record: %w", err)
+		}
+		return txn.Set(historyKey(targetURL), value)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("store db update: %w", err)
+	}
+	return failures, nil
+}
+
+func getFetchRecord(txn *badger.Txn, targetURL string) (*FetchRecord, error) {
+	item, err := txn.Get(historyKey(targetURL))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fetch record from badger db: %w", err)
+	}
+	record := &FetchRecord{}
+	err = item.Value(func(value []byte) error {
+		return json.Unmarshal(value, record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal fetch record: %w", err)
+	}
+	return record, nil
+}
+
+func historyKey(targetURL string) []byte {
+	return []byte("h/" + targetURL)
+}
+
+func contentHash(body []byte) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write(body)
+	return hasher.Sum64()
+}
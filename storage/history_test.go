@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFetchHistoryRecord(t *testing.T) {
+	history, err := NewFetchHistory(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create fetch history: %v", err)
+	}
+	defer history.Close()
+
+	const targetURL = "https://example.com/"
+	now := time.Now()
+
+	steps := []struct {
+		name        string
+		body        string
+		notModified bool
+		changed     bool
+	}{
+		{name: "first fetch", body: "a"},
+		{name: "same content", body: "a"},
+		{name: "not modified", notModified: true},
+		{name: "changed content", body: "b", changed: true},
+	}
+	for i, step := range steps {
+		record, err := history.Record(targetURL, `"etag"`, "", step.notModified, []byte(step.body), now.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatalf("%s: record: %v", step.name, err)
+		}
+		if record.Changed != step.changed {
+			t.Errorf("%s: expected changed %v, got %v", step.name, step.changed, record.Changed)
+		}
+	}
+
+	record, err := history.Get(targetURL)
+	if err != nil || record == nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	if record.Fetches != 4 || record.Changes != 1 || record.ETag != `"etag"` {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	// Failures count up until the next successful fetch
+	for want := 1; want <= 2; want++ {
+		if failures, err := history.Failed(targetURL); err != nil || failures != want {
+			t.Errorf("Failed = %d, %v, want %d", failures, err, want)
+		}
+	}
+	record, err = history.Record(targetURL, `"etag"`, "", true, nil, now.Add(time.Hour*5))
+	if err != nil || record.Failures != 0 || record.Fetches != 5 {
+		t.Errorf("Record after failures = %+v, %v", record, err)
+	}
+}
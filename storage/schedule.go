@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+var (
+	scheduleTimePrefix = []byte("t/") // t/<unix nanos><url> -> nil, ordered by due time
+	scheduleURLPrefix  = []byte("u/") // u/<url> -> <unix nanos>, to find the entry of a URL
+	scheduleSeededKey  = []byte("seeded")
+)
+
+// Schedule is a persistent time ordered queue of URLs backed by Badger.
+// Unlike NSQ deferred messages, URLs can be scheduled any time ahead.
+type Schedule struct {
+	db *badger.DB
+}
+
+func NewSchedule(path string) (*Schedule, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %w", err)
+	}
+	return &Schedule{db: db}, nil
+}
+
+func (schedule *Schedule) Close() error {
+	if err := schedule.db.Close(); err != nil {
+		return fmt.Errorf("failed to close badger db: %w", err)
+	}
+	return nil
+}
+
+// Add schedules the URL at the given time, replacing its previous schedule.
+func (schedule *Schedule) Add(targetURL string, at time.Time) error {
+	err := schedule.db.Update(func(txn *badger.Txn) error {
+		return setSchedule(txn, targetURL, at)
+	})
+	if err != nil {
+		return fmt.Errorf("store db update: %w", err)
+	}
+	return nil
+}
+
+// AddIfAbsent schedules the URL only if it's not scheduled already.
+func (schedule *Schedule) AddIfAbsent(targetURL string, at time.Time) (added bool, err error) {
+	err = schedule.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(scheduleURLKey(targetURL))
+		if err == nil {
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return fmt.Errorf("failed to get url from badger db: %w", err)
+		}
+		added = true
+		return setSchedule(txn, targetURL, at)
+	})
+	if err != nil {
+		return false, fmt.Errorf("store db update: %w", err)
+	}
+	return added, nil
+}
+
+// PopDue returns up to max URLs due at now, earliest first. Popped URLs are leased, not removed:
+// they're rescheduled at now+lease, so they come back if the crawler dies before rescheduling them.
+func (schedule *Schedule) PopDue(now time.Time, max int, lease time.Duration) ([]string, error) {
+	var urls []string
+	err := schedule.db.Update(func(txn *badger.Txn) error {
+		urls = urls[:0]
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = scheduleTimePrefix
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid() && len(urls) < max; it.Next() {
+			at, targetURL := parseScheduleKey(it.Item().Key())
+			if at.After(now) {
+				break
+			}
+			urls = append(urls, targetURL)
+		}
+		it.Close()
+
+		for _, targetURL := range urls {
+			if err := setSchedule(txn, targetURL, now.Add(lease)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store db update: %w", err)
+	}
+	return urls, nil
+}
+
+// Next returns the earliest scheduled time, or false if nothing is scheduled.
+func (schedule *Schedule) Next() (time.Time, bool, error) {
+	var next time.Time
+	var found bool
+	err := schedule.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = scheduleTimePrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		if it.Valid() {
+			next, _ = parseScheduleKey(it.Item().Key())
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("store db view: %w", err)
+	}
+	return next, found, nil
+}
+
+// Seeded reports whether MarkSeeded was called, so the initial URL list is only loaded once.
+func (schedule *Schedule) Seeded() (bool, error) {
+	err := schedule.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(scheduleSeededKey)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("store db view: %w", err)
+	}
+	return true, nil
+}
+
+func (schedule *Schedule) MarkSeeded() error {
+	err := schedule.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(scheduleSeededKey, []byte{})
+	})
+	if err != nil {
+		return fmt.Errorf("store db update: %w", err)
+	}
+	return nil
+}
+
+func setSchedule(txn *badger.Txn, targetURL string, at time.Time) error {
+	urlKey := scheduleURLKey(targetURL)
+	item, err := txn.Get(urlKey)
+	if err != nil && err != badger.ErrKeyNotFound {
+		return fmt.Errorf("failed to get url from badger db: %w", err)
+	}
+	if item != nil {
+		previous, err := item.ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("failed to read schedule: %w", err)
+		}
+		if err := txn.Delete(scheduleKey(int64(binary.BigEndian.Uint64(previous)), targetURL)); err != nil {
+			return err
+		}
+	}
+
+	nanos := make([]byte, 8)
+	binary.BigEndian.PutUint64(nanos, uint64(at.UnixNano()))
+	if err := txn.Set(scheduleKey(at.UnixNano(), targetURL), []byte{}); err != nil {
+		return err
+	}
+	return txn.Set(urlKey, nanos)
+}
+
+func scheduleKey(unixNanos int64, targetURL string) []byte {
+	key := bytes.NewBuffer(make([]byte, 0, len(scheduleTimePrefix)+8+len(targetURL)))
+	key.Write(scheduleTimePrefix)
+	binary.Write(key, binary.BigEndian, uint64(unixNanos))
+	key.WriteString(targetURL)
+	return key.Bytes()
+}
+
+func scheduleURLKey(targetURL string) []byte {
+	return append(append(make([]byte, 0, len(scheduleURLPrefix)+len(targetURL)), scheduleURLPrefix...), targetURL...)
+}
+
+func parseScheduleKey(key []byte) (time.Time, string) {
+	key = key[len(scheduleTimePrefix):]
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8]))), string(key[8:])
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchedulePopDue(t *testing.T) {
+	schedule, err := NewSchedule(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create schedule: %v", err)
+	}
+	defer schedule.Close()
+
+	now := time.Now()
+	schedule.Add("https://example.com/c", now.Add(-time.Minute))
+	schedule.Add("https://example.com/a", now.Add(-time.Hour))
+	schedule.Add("https://example.com/b", now.Add(time.Hour))
+	schedule.Add("https://example.com/b", now.Add(-30*time.Minute)) // Replaces the previous schedule
+
+	if added, err := schedule.AddIfAbsent("https://example.com/a", now.Add(time.Hour)); err != nil || added {
+		t.Fatalf("AddIfAbsent on a scheduled URL = %v, %v", added, err)
+	}
+
+	urls, err := schedule.PopDue(now, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("PopDue failed: %v", err)
+	}
+	want := []string{"https://example.com/a", "https://example.com/b", "https://example.com/c"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("PopDue = %v, want %v", urls, want)
+	}
+
+	// Popped URLs are leased until now+lease
+	urls, err = schedule.PopDue(now, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("PopDue failed: %v", err)
+	}
+	if len(urls) != 0 {
+		t.Errorf("PopDue during lease = %v, want none", urls)
+	}
+	next, ok, err := schedule.Next()
+	if err != nil || !ok || !next.Equal(time.Unix(0, now.Add(time.Hour).UnixNano())) {
+		t.Errorf("Next = %v, %v, %v, want %v", next, ok, err, now.Add(time.Hour))
+	}
+}
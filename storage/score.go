@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Scorers
+const (
+	ScorerDepth    = "depth"     // Breadth first, shallower URLs first
+	ScorerSeedRank = "seed-rank" // URLs of higher ranked seed domains first
+	ScorerOPIC     = "opic"      // URLs with more important inlinks first
+)
+
+// URLInfo is what's known about a URL when it's queued.
+type URLInfo struct {
+	URL         string
+	Depth       int    // Link hops from a seed, 0 for seeds
+	Parent      string // Page the URL was found on, empty for seeds
+	ParentLinks int    // Number of links on the parent page
+}
+
+// Scorer decides the priority of URLs in the frontier. Higher scores are crawled first.
+// Scores are positive, so their distributions are comparable between scorers.
+type Scorer interface {
+	Name() string
+	Score(info URLInfo) (float64, error)
+}
+
+// DepthScorer crawls breadth first.
+type DepthScorer struct{}
+
+func (DepthScorer) Name() string { return ScorerDepth }
+
+func (DepthScorer) Score(info URLInfo) (float64, error) {
+	return 1 / float64(1+info.Depth), nil
+}
+
+// SeedRankScorer crawls the domains ranked higher in a top list (like Tranco) first.
+// Unranked domains come last.
+type SeedRankScorer struct {
+	Ranks map[string]int // Domain to rank, starting from 1
+}
+
+func (SeedRankScorer) Name() string { return ScorerSeedRank }
+
+func (scorer SeedRankScorer) Score(info URLInfo) (float64, error) {
+	urlParsed, err := url.Parse(info.URL)
+	if err != nil {
+		return 0, fmt.Errorf("parse url: %w", err)
+	}
+	// Try the host, then its parent domains: www.blog.example.com, blog.example.com, example.com
+	domain := strings.ToLower(urlParsed.Hostname())
+	for {
+		if rank, ok := scorer.Ranks[domain]; ok && rank > 0 {
+			return 1 / float64(rank), nil
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return 1 / float64(len(scorer.Ranks)+1), nil
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// OPICScorer approximates OPIC (Abiteboul et al., "Adaptive On-Line Page Importance Computation").
+// Seeds start with one unit of cash, and every page passes its cash on, split evenly between its links.
+// Unlike OPIC, pages keep their cash after passing it on, so a URL's cash sums up its inlinks seen so far.
+// Cash is kept in Badger.
+type OPICScorer struct {
+	db *badger.DB
+}
+
+func NewOPICScorer(path string) (*OPICScorer, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %w", err)
+	}
+	return &OPICScorer{db: db}, nil
+}
+
+func (scorer *OPICScorer) Close() error {
+	if err := scorer.db.Close(); err != nil {
+		return fmt.Errorf("failed to close badger db: %w", err)
+	}
+	return nil
+}
+
+func (*OPICScorer) Name() string { return ScorerOPIC }
+
+func (scorer *OPICScorer) Score(info URLInfo) (float64, error) {
+	var cash float64
+	err := scorer.db.Update(func(txn *badger.Txn) error {
+		received := 1.0 // Seeds
+		if info.Parent != "" {
+			parentCash, err := getCash(txn, info.Parent)
+			if err != nil {
+				return err
+			}
+			if parentCash == 0 {
+				parentCash = 1 // Parent wasn't scored, e.g. queued before switching scorers
+			}
+			received = parentCash / math.Max(1, float64(info.ParentLinks))
+		}
+		var err error
+		cash, err = getCash(txn, info.URL)
+		if err != nil {
+			return err
+		}
+		cash += received
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, math.Float64bits(cash))
+		return txn.Set(cashKey(info.URL), value)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("store db update: %w", err)
+	}
+	return cash, nil
+}
+
+func getCash(txn *badger.Txn, targetURL string) (float64, error) {
+	item, err := txn.Get(cashKey(targetURL))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get cash from badger db: %w", err)
+	}
+	var cash float64
+	err = item.Value(func(value []byte) error {
+		cash = math.Float64frombits(binary.BigEndian.Uint64(value))
+		return nil
+	})
+	return cash, err
+}
+
+func cashKey(targetURL string) []byte {
+	return []byte("c/" + targetURL)
+}
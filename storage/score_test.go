@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOPICScorer(t *testing.T) {
+	scorer, err := NewOPICScorer(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create OPIC scorer: %v", err)
+	}
+	defer scorer.Close()
+
+	steps := []struct {
+		info URLInfo
+		want float64
+	}{
+		{URLInfo{URL: "https://a.com/"}, 1},
+		{URLInfo{URL: "https://b.com/"}, 1},
+		{URLInfo{URL: "https://c.com/x", Parent: "https://a.com/", ParentLinks: 4}, 0.25},
+		{URLInfo{URL: "https://c.com/x", Parent: "https://b.com/", ParentLinks: 2}, 0.75}, // Cash adds up over inlinks
+		{URLInfo{URL: "https://d.com/", Parent: "https://c.com/x", ParentLinks: 3}, 0.25},
+	}
+	for _, step := range steps {
+		score, err := scorer.Score(step.info)
+		if err != nil {
+			t.Fatalf("Score %s failed: %v", step.info.URL, err)
+		}
+		if math.Abs(score-step.want) > 1e-9 {
+			t.Errorf("Score %s from %s = %v, want %v", step.info.URL, step.info.Parent, score, step.want)
+		}
+	}
+}
+
+func TestSeedRankScorer(t *testing.T) {
+	scorer := SeedRankScorer{Ranks: map[string]int{"example.com": 1, "example.org": 4}}
+	for targetURL, want := range map[string]float64{
+		"https://www.blog.example.com/a": 1,
+		"https://example.org/":           0.25,
+		"https://unranked.net/":          1.0 / 3,
+	} {
+		score, err := scorer.Score(URLInfo{URL: targetURL})
+		if err != nil {
+			t.Fatalf("Score %s failed: %v", targetURL, err)
+		}
+		if math.Abs(score-want) > 1e-9 {
+			t.Errorf("Score %s = %v, want %v", targetURL, score, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// ErrHostFull is returned by SeenSet.Add when the host has reached its page limit.
+var ErrHostFull = errors.New("host page limit reached")
+
+// SeenSet remembers discovered URLs with the depth they were found at, and counts them per host.
+// It's backed by Badger, so it scales with the disk.
+type SeenSet struct {
+	db *badger.DB
+}
+
+func NewSeenSet(path string) (*SeenSet, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %w", err)
+	}
+	return &SeenSet{db: db}, nil
+}
+
+func (seen *SeenSet) Close() error {
+	if err := seen.db.Close(); err != nil {
+		return fmt.Errorf("failed to close badger db: %w", err)
+	}
+	return nil
+}
+
+// Depth returns the depth the URL was found at, or false if it wasn't seen.
+func (seen *SeenSet) Depth(targetURL string) (int, bool, error) {
+	var depth int
+	var found bool
+	err := seen.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(seenKey(targetURL))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get url from badger db: %w", err)
+		}
+		return item.Value(func(value []byte) error {
+			depthValue, _ := binary.Uvarint(value)
+			depth, found = int(depthValue), true
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("store db view: %w", err)
+	}
+	return depth, found, nil
+}
+
+// Add marks the URL seen at the given depth. It reports false if the URL was seen before,
+// and returns ErrHostFull if the host has maxPerHost URLs already. Zero maxPerHost means no limit.
+func (seen *SeenSet) Add(targetURL, host string, depth, maxPerHost int) (added bool, err error) {
+	// Workers add links concurrently, and the host counter is a hot key
+	for attempt := 0; attempt < 10; attempt++ {
+		added, err = seen.add(targetURL, host, depth, maxPerHost)
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+		conflictBackoff()
+	}
+	return added, err
+}
+
+func (seen *SeenSet) add(targetURL, host string, depth, maxPerHost int) (added bool, err error) {
+	err = seen.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(seenKey(targetURL))
+		if err == nil {
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return fmt.Errorf("failed to get url from badger db: %w", err)
+		}
+
+		var count uint64
+		item, err := txn.Get(seenHostKey(host))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return fmt.Errorf("failed to get host from badger db: %w", err)
+		}
+		if item != nil {
+			err := item.Value(func(value []byte) error {
+				count = binary.BigEndian.Uint64(value)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to read host count: %w", err)
+			}
+		}
+		if maxPerHost > 0 && count >= uint64(maxPerHost) {
+			return ErrHostFull
+		}
+
+		countValue := make([]byte, 8)
+		binary.BigEndian.PutUint64(countValue, count+1)
+		if err := txn.Set(seenHostKey(host), countValue); err != nil {
+			return err
+		}
+		added = true
+		return txn.Set(seenKey(targetURL), binary.AppendUvarint(nil, uint64(depth)))
+	})
+	if err != nil {
+		if errors.Is(err, ErrHostFull) {
+			return false, err
+		}
+		return false, fmt.Errorf("store db update: %w", err)
+	}
+	return added, nil
+}
+
+func seenKey(targetURL string) []byte {
+	return []byte("s/" + targetURL)
+}
+
+func seenHostKey(host string) []byte {
+	return []byte("n/" + host)
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSeenSetAdd(t *testing.T) {
+	seen, err := NewSeenSet(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create seen set: %v", err)
+	}
+	defer seen.Close()
+
+	if added, err := seen.Add("https://a.com/1", "a.com", 2, 2); err != nil || !added {
+		t.Fatalf("Add new url = %v, %v", added, err)
+	}
+	if added, err := seen.Add("https://a.com/1", "a.com", 3, 2); err != nil || added {
+		t.Errorf("Add seen url = %v, %v, want not added", added, err)
+	}
+	if added, err := seen.Add("https://a.com/2", "a.com", 3, 2); err != nil || !added {
+		t.Errorf("Add second url = %v, %v", added, err)
+	}
+	if _, err := seen.Add("https://a.com/3", "a.com", 3, 2); !errors.Is(err, ErrHostFull) {
+		t.Errorf("Add over the host limit = %v, want ErrHostFull", err)
+	}
+
+	depth, found, err := seen.Depth("https://a.com/1")
+	if err != nil || !found || depth != 2 {
+		t.Errorf("Depth = %d, %v, %v, want 2", depth, found, err)
+	}
+	if _, found, _ := seen.Depth("https://a.com/3"); found {
+		t.Errorf("URL over the host limit was marked seen")
+	}
+}
@@ -0,0 +1,90 @@
+package synthweb
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// acceptProxyConns answers CONNECT requests and hands the tunnels to the web's server,
+// which serves the host the client asked for. Other connections go to the server as they are.
+func (web *Web) acceptProxyConns() {
+	for {
+		conn, err := web.listener.Accept()
+		if err != nil {
+			web.tunnels.Close()
+			return
+		}
+		go func() {
+			reader := bufio.NewReader(conn)
+			method, err := reader.Peek(len("CONNECT "))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if bytes.Equal(method, []byte("CONNECT ")) {
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				req.Body.Close()
+				if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+					conn.Close()
+					return
+				}
+			}
+			web.tunnels.push(&bufferedConn{Conn: conn, reader: reader})
+		}()
+	}
+}
+
+// bufferedConn reads what was buffered while peeking first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// connListener is a net.Listener of connections pushed to it.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (listener *connListener) push(conn net.Conn) {
+	select {
+	case listener.conns <- conn:
+	case <-listener.done:
+		conn.Close()
+	}
+}
+
+func (listener *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *connListener) Close() error {
+	listener.once.Do(func() { close(listener.done) })
+	return nil
+}
+
+func (listener *connListener) Addr() net.Addr {
+	return listener.addr
+}
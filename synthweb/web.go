@@ -0,0 +1,324 @@
+// Package synthweb serves a synthetic web of many virtual hosts from one local server,
+// for testing the crawler end to end without a network.
+package synthweb
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+)
+
+// Config shapes the web. Everything about a page is derived from Seed,
+// so the same config always serves the same web.
+type Config struct {
+	Seed          int64
+	Hosts         int
+	PagesPerHost  int
+	LinksPerPage  int     // Besides the link to the next page of the host, which makes every page reachable from the home page
+	ExternalLinks float64 // Share of links to other hosts
+
+	Disallow string // Path prefix disallowed by every robots.txt. Home pages link to a page under it.
+	Sitemaps bool   // robots.txt points to a sitemap of the host's pages
+
+	RedirectPages   float64 // Share of pages linked through a redirect
+	SlowPages       float64 // Share of pages answered after SlowDelay
+	SlowDelay       time.Duration
+	RateLimitPages  float64 // Share of pages answering their first request with 429
+	CompressedPages float64 // Share of pages served with gzip or br, if the client accepts them
+	BadCharsetPages float64 // Share of pages declaring a charset that doesn't exist
+	TrapHosts       float64 // Share of hosts with an endless calendar
+}
+
+// Request is a request the web served.
+type Request struct {
+	URL    string
+	Status int
+	Time   time.Time // When the request arrived
+}
+
+// Web is a running synthetic web. Hosts are named like h12.synth.test and are only
+// reachable through ProxyURL, an HTTP proxy that serves them itself.
+type Web struct {
+	ProxyURL string
+
+	config   Config
+	listener net.Listener
+	tunnels  *connListener
+	server   *http.Server
+
+	mu       sync.Mutex
+	requests []Request
+	counts   map[string]int // Requests per URL
+}
+
+const hostSuffix = ".synth.test"
+
+// Start serves the web on a local port.
+func Start(config Config) (*Web, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	web := &Web{
+		ProxyURL: "http://" + listener.Addr().String(),
+		config:   config,
+		listener: listener,
+		tunnels:  newConnListener(listener.Addr()),
+		counts:   make(map[string]int),
+	}
+	web.server = &http.Server{Handler: web}
+	go web.server.Serve(web.tunnels)
+	go web.acceptProxyConns()
+	return web, nil
+}
+
+func (web *Web) Close() error {
+	web.listener.Close()
+	return web.server.Close()
+}
+
+// Host returns the name of the i-th host.
+func (web *Web) Host(i int) string {
+	return "h" + strconv.Itoa(i) + hostSuffix
+}
+
+// PageURL returns the URL of the n-th page of the i-th host.
+func (web *Web) PageURL(i, n int) string {
+	return "http://" + web.Host(i) + pagePath(n)
+}
+
+func pagePath(n int) string {
+	if n == 0 {
+		return "/"
+	}
+	return "/p/" + strconv.Itoa(n)
+}
+
+// Seeds returns the home page of every host.
+func (web *Web) Seeds() []string {
+	seeds := make([]string, web.config.Hosts)
+	for i := range seeds {
+		seeds[i] = web.PageURL(i, 0)
+	}
+	return seeds
+}
+
+// Pages returns the URL of every page a crawl obeying robots.txt can reach, traps aside.
+func (web *Web) Pages() []string {
+	pages := make([]string, 0, web.config.Hosts*web.config.PagesPerHost)
+	for i := 0; i < web.config.Hosts; i++ {
+		for n := 0; n < web.config.PagesPerHost; n++ {
+			pages = append(pages, web.PageURL(i, n))
+		}
+	}
+	return pages
+}
+
+// Requests returns the requests served so far, in order.
+func (web *Web) Requests() []Request {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	return append([]Request(nil), web.requests...)
+}
+
+// Count returns how many times the URL was requested.
+func (web *Web) Count(url string) int {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+	return web.counts[url]
+}
+
+// TrapHost tells whether the i-th host has a calendar trap.
+func (web *Web) TrapHost(i int) bool {
+	return web.chance(web.config.TrapHosts, "trap", web.Host(i))
+}
+
+// chance decides with the given probability, always the same way for the same keys.
+func (web *Web) chance(probability float64, keys ...string) bool {
+	return probability > 0 && web.rand(keys...).Float64() < probability
+}
+
+func (web *Web) rand(keys ...string) *rand.Rand {
+	hash := fnv.New64a()
+	fmt.Fprint(hash, web.config.Seed)
+	for _, key := range keys {
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+	}
+	return rand.New(rand.NewSource(int64(hash.Sum64())))
+}
+
+func (web *Web) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	received := time.Now()
+	status := web.serve(w, r, host)
+	web.mu.Lock()
+	requestURL := "http://" + host + r.URL.RequestURI()
+	web.requests = append(web.requests, Request{URL: requestURL, Status: status, Time: received})
+	web.counts[requestURL]++
+	web.mu.Unlock()
+}
+
+func (web *Web) serve(w http.ResponseWriter, r *http.Request, host string) int {
+	hostIndex, ok := web.hostIndex(host)
+	if !ok {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+	path := r.URL.Path
+	switch {
+	case path == "/robots.txt":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "User-agent: *\nDisallow: %s\n", web.config.Disallow)
+		if web.config.Sitemaps {
+			fmt.Fprintf(w, "Sitemap: http://%s/sitemap.xml\n", host)
+		}
+		return http.StatusOK
+	case path == "/sitemap.xml" && web.config.Sitemaps:
+		var sitemap bytes.Buffer
+		sitemap.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">` + "\n")
+		for n := 0; n < web.config.PagesPerHost; n++ {
+			fmt.Fprintf(&sitemap, "<url><loc>%s</loc></url>\n", web.PageURL(hostIndex, n))
+		}
+		sitemap.WriteString("</urlset>\n")
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(sitemap.Bytes())
+		return http.StatusOK
+	case strings.HasPrefix(path, "/r/"):
+		n, err := strconv.Atoi(strings.TrimPrefix(path, "/r/"))
+		if err != nil || n <= 0 || n >= web.config.PagesPerHost {
+			break
+		}
+		http.Redirect(w, r, pagePath(n), http.StatusMovedPermanently)
+		return http.StatusMovedPermanently
+	case strings.HasPrefix(path, "/calendar/") && web.TrapHost(hostIndex):
+		var year, month int
+		if _, err := fmt.Sscanf(path, "/calendar/%d/%d", &year, &month); err != nil {
+			break
+		}
+		next := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+		body := fmt.Sprintf(`<html><head><title>Calendar</title></head><body><p>No events</p><a href="/calendar/%d/%d">Next month</a></body></html>`,
+			next.Year(), int(next.Month()))
+		return web.writePage(w, r, host, path, []byte(body))
+	case web.config.Disallow != "" && strings.HasPrefix(path, web.config.Disallow):
+		return web.writePage(w, r, host, path, []byte("<html><body>Private</body></html>"))
+	}
+
+	n, ok := pageIndex(path)
+	if !ok || n >= web.config.PagesPerHost {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+	if web.chance(web.config.RateLimitPages, "429", host, path) && web.Count("http://"+host+r.URL.RequestURI()) == 0 {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return http.StatusTooManyRequests
+	}
+	if web.chance(web.config.SlowPages, "slow", host, path) {
+		time.Sleep(web.config.SlowDelay)
+	}
+	return web.writePage(w, r, host, path, web.page(hostIndex, n))
+}
+
+func (web *Web) hostIndex(host string) (int, bool) {
+	if !strings.HasPrefix(host, "h") || !strings.HasSuffix(host, hostSuffix) {
+		return 0, false
+	}
+	i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(host, "h"), hostSuffix))
+	if err != nil || i < 0 || i >= web.config.Hosts {
+		return 0, false
+	}
+	return i, true
+}
+
+func pageIndex(path string) (int, bool) {
+	if path == "/" {
+		return 0, true
+	}
+	if !strings.HasPrefix(path, "/p/") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(path, "/p/"))
+	return n, err == nil && n > 0
+}
+
+// page renders the n-th page of the i-th host with its links.
+func (web *Web) page(i, n int) []byte {
+	var links []string
+	if n+1 < web.config.PagesPerHost {
+		links = append(links, pagePath(n+1))
+	}
+	random := web.rand("links", web.Host(i), strconv.Itoa(n))
+	for l := 0; l < web.config.LinksPerPage; l++ {
+		targetHost, targetPage := i, random.Intn(web.config.PagesPerHost)
+		if random.Float64() < web.config.ExternalLinks {
+			targetHost = random.Intn(web.config.Hosts)
+		}
+		link := pagePath(targetPage)
+		if targetPage > 0 && web.chance(web.config.RedirectPages, "redirect", web.Host(targetHost), link) {
+			link = "/r/" + strconv.Itoa(targetPage)
+		}
+		if targetHost != i {
+			link = "http://" + web.Host(targetHost) + link
+		}
+		links = append(links, link)
+	}
+	if n == 0 && web.config.Disallow != "" {
+		links = append(links, web.config.Disallow+"page")
+	}
+	if n == 0 && web.TrapHost(i) {
+		links = append(links, "/calendar/2024/1")
+	}
+
+	var page bytes.Buffer
+	fmt.Fprintf(&page, "<html><head><title>%s page %d</title></head><body>\n<p>Page %d of %s, %x</p>\n",
+		web.Host(i), n, n, web.Host(i), random.Uint64())
+	for _, link := range links {
+		fmt.Fprintf(&page, "<a href=\"%s\">%s</a>\n", link, link)
+	}
+	page.WriteString("</body></html>\n")
+	return page.Bytes()
+}
+
+// writePage writes an HTML page, compressed or with a bogus charset if the page was picked for it.
+func (web *Web) writePage(w http.ResponseWriter, r *http.Request, host, path string, body []byte) int {
+	contentType := "text/html; charset=utf-8"
+	if web.chance(web.config.BadCharsetPages, "charset", host, path) {
+		contentType = "text/html; charset=x-synthetic-bogus"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if web.chance(web.config.CompressedPages, "compress", host, path) {
+		accepted := r.Header.Get("Accept-Encoding")
+		var compressed bytes.Buffer
+		switch {
+		case strings.Contains(accepted, "br"):
+			writer := brotli.NewWriter(&compressed)
+			writer.Write(body)
+			writer.Close()
+			w.Header().Set("Content-Encoding", "br")
+			body = compressed.Bytes()
+		case strings.Contains(accepted, "gzip"):
+			writer := gzip.NewWriter(&compressed)
+			writer.Write(body)
+			writer.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			body = compressed.Bytes()
+		}
+	}
+	w.Write(body)
+	return http.StatusOK
+}
@@ -0,0 +1,76 @@
+package synthweb
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeb(t *testing.T) {
+	config := Config{
+		Seed: 1, Hosts: 5, PagesPerHost: 4, LinksPerPage: 3, ExternalLinks: 0.5,
+		Disallow: "/private/", Sitemaps: true, RateLimitPages: 1, TrapHosts: 1, CompressedPages: 1,
+	}
+	web, err := Start(config)
+	assert.NoError(t, err)
+	defer web.Close()
+
+	proxyURL, _ := url.Parse(web.ProxyURL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(rawURL string) (*http.Response, string) {
+		res, err := client.Get(rawURL)
+		if !assert.NoError(t, err) {
+			return &http.Response{}, ""
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, _ := get(web.PageURL(1, 2))
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "first request is rate limited")
+	res, first := get(web.PageURL(1, 2))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, first, `href="/p/3"`, "pages link to the next one")
+	assert.Equal(t, 2, web.Count(web.PageURL(1, 2)))
+
+	// The same seed serves the same web
+	again, err := Start(config)
+	assert.NoError(t, err)
+	defer again.Close()
+	proxyURL, _ = url.Parse(again.ProxyURL)
+	client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}
+	get(again.PageURL(1, 2))
+	_, second := get(again.PageURL(1, 2))
+	assert.Equal(t, first, second)
+
+	_, robots := get("http://" + again.Host(0) + "/robots.txt")
+	assert.Contains(t, robots, "Disallow: /private/")
+	assert.Contains(t, robots, "Sitemap: http://h0.synth.test/sitemap.xml")
+	_, sitemap := get("http://" + again.Host(0) + "/sitemap.xml")
+	assert.Equal(t, config.PagesPerHost, strings.Count(sitemap, "<loc>"))
+
+	res, _ = get("http://" + again.Host(0) + "/r/2")
+	assert.Equal(t, http.StatusMovedPermanently, res.StatusCode)
+	assert.Equal(t, "/p/2", res.Header.Get("Location"))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+again.Host(0)+"/calendar/2024/12", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+
+	res, _ = get("http://h99.synth.test/")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Len(t, again.Pages(), config.Hosts*config.PagesPerHost)
+}
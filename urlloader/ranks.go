@@ -0,0 +1,47 @@
+package urlloader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadRanks loads a "rank,domain" top list like Tranco, downloading it if it's not cached yet.
+// Rows without a numeric rank, like a header, are skipped.
+func LoadRanks(urlListURL string, filepath string) (map[string]int, error) {
+	urlLoader, err := New(urlListURL, filepath) // Downloads the list if needed
+	if err != nil {
+		return nil, fmt.Errorf("url loader: %w", err)
+	}
+	urlLoader.Close()
+
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	ranks := make(map[string]int)
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return ranks, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read line: %w", err)
+		}
+		if len(record) < 2 {
+			continue
+		}
+		rank, err := strconv.Atoi(record[0])
+		if err != nil {
+			continue
+		}
+		ranks[strings.ToLower(record[1])] = rank
+	}
+}
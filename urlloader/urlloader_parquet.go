@@ -128,5 +128,8 @@ func (l *URLLoaderParquet) LoadNextHostURLs() ([]string, error) {
 }
 
 func (l *URLLoaderParquet) Close() error {
+	if l.reader == nil {
+		return nil // Not opened yet, or closed at the end of its file
+	}
 	return l.reader.Close()
 }
@@ -0,0 +1,273 @@
+package worker
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/http"
+	"github.com/musabgultekin/quantumscraper/metrics"
+)
+
+// Budget limits the crawl of a host or registered domain within a window. Zero means no limit.
+type Budget struct {
+	Pages  int
+	Bytes  int64
+	Time   time.Duration // Spent fetching
+	Errors int
+}
+
+// BudgetPolicy holds the budgets per host and per registered domain. Overrides replace both
+// for hosts or domains matching a pattern like *.wikipedia.org.
+type BudgetPolicy struct {
+	Host      Budget
+	Domain    Budget
+	Overrides []BudgetOverride
+	Window    time.Duration // Usage resets after this long. Zero keeps it until the next pass, and errors for good.
+}
+
+type BudgetOverride struct {
+	Pattern string
+	Budget  Budget
+}
+
+// ParseBudget parses budgets like "1000/100MB/1h/50", as pages/bytes/time/errors.
+func ParseBudget(spec string) (Budget, error) {
+	fields := strings.Split(spec, "/")
+	if len(fields) != 4 {
+		return Budget{}, fmt.Errorf("budget %q: expected pages/bytes/time/errors", spec)
+	}
+	var budget Budget
+	var err error
+	if budget.Pages, err = strconv.Atoi(fields[0]); err != nil {
+		return budget, fmt.Errorf("budget %q pages: %w", spec, err)
+	}
+	if budget.Bytes, err = http.ParseSize(fields[1]); err != nil {
+		return budget, fmt.Errorf("budget %q bytes: %w", spec, err)
+	}
+	if budget.Time, err = time.ParseDuration(fields[2]); err != nil {
+		return budget, fmt.Errorf("budget %q time: %w", spec, err)
+	}
+	if budget.Errors, err = strconv.Atoi(fields[3]); err != nil {
+		return budget, fmt.Errorf("budget %q errors: %w", spec, err)
+	}
+	return budget, nil
+}
+
+// NewBudgetOverrides parses overrides from pattern to budget spec. Longer patterns are matched first.
+func NewBudgetOverrides(specs map[string]string) ([]BudgetOverride, error) {
+	overrides := make([]BudgetOverride, 0, len(specs))
+	for pattern, spec := range specs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("budget pattern %q: %w", pattern, err)
+		}
+		budget, err := ParseBudget(spec)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, BudgetOverride{Pattern: strings.ToLower(pattern), Budget: budget})
+	}
+	sort.Slice(overrides, func(i, j int) bool { return len(overrides[i].Pattern) > len(overrides[j].Pattern) })
+	return overrides, nil
+}
+
+// Budgets tracks the usage of hosts and registered domains against the policy.
+type Budgets struct {
+	policy BudgetPolicy
+
+	mu       sync.Mutex
+	usages   map[string]*budgetUsage // Keyed by "host/" or "domain/" and the name
+	deferred []deferredBatch         // Host batches deferred to a next pass, when there's no schedule
+}
+
+type deferredBatch struct {
+	urls []string
+	at   time.Time // Not crawled in a pass before this
+}
+
+type budgetUsage struct {
+	start  time.Time
+	pages  int
+	bytes  int64
+	took   time.Duration
+	errors int
+}
+
+const maxBudgetUsages = 1_000_000
+
+func NewBudgets(policy BudgetPolicy) *Budgets {
+	return &Budgets{policy: policy, usages: make(map[string]*budgetUsage)}
+}
+
+// Exhausted returns which budget of the host, or of its registered domain, ran out,
+// like "host_pages" or "domain_bytes". It returns an empty string if none did.
+func (budgets *Budgets) Exhausted(host string) string {
+	budgets.mu.Lock()
+	defer budgets.mu.Unlock()
+
+	now := time.Now()
+	domain := hostDomain(host)
+	if reason := budgets.usage("host/"+host, now).exhausted(budgets.budget(host, budgets.policy.Host)); reason != "" {
+		return "host_" + reason
+	}
+	if reason := budgets.usage("domain/"+domain, now).exhausted(budgets.budget(domain, budgets.policy.Domain)); reason != "" {
+		return "domain_" + reason
+	}
+	return ""
+}
+
+// Spend counts a fetch against the host and its registered domain.
+func (budgets *Budgets) Spend(host string, bytes int, took time.Duration, failed bool) {
+	budgets.mu.Lock()
+	defer budgets.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range []string{"host/" + host, "domain/" + hostDomain(host)} {
+		usage := budgets.usage(key, now)
+		usage.pages++
+		usage.bytes += int64(bytes)
+		usage.took += took
+		if failed {
+			usage.errors++
+		}
+	}
+}
+
+// WindowEnd returns when the usage of the host resets.
+func (budgets *Budgets) WindowEnd(host string) time.Time {
+	budgets.mu.Lock()
+	defer budgets.mu.Unlock()
+
+	now := time.Now()
+	end := budgets.usage("host/"+host, now).start.Add(budgets.policy.Window)
+	if domainEnd := budgets.usage("domain/"+hostDomain(host), now).start.Add(budgets.policy.Window); domainEnd.After(end) {
+		end = domainEnd
+	}
+	return end
+}
+
+// Defer keeps a host batch for the first pass starting at or after the given time.
+func (budgets *Budgets) Defer(urls []string, at time.Time) {
+	budgets.mu.Lock()
+	defer budgets.mu.Unlock()
+	budgets.deferred = append(budgets.deferred, deferredBatch{urls: urls, at: at})
+}
+
+// NextPass resets all usage but errors, and returns the deferred batches due at now. The others
+// are kept, and next tells when the earliest of them is due, zero if there are none.
+func (budgets *Budgets) NextPass(now time.Time) (due [][]string, next time.Time) {
+	budgets.mu.Lock()
+	defer budgets.mu.Unlock()
+
+	var kept []deferredBatch
+	for _, batch := range budgets.deferred {
+		if batch.at.After(now) {
+			kept = append(kept, batch)
+			if next.IsZero() || batch.at.Before(next) {
+				next = batch.at
+			}
+			continue
+		}
+		due = append(due, batch.urls)
+	}
+	budgets.deferred = kept
+	usages := make(map[string]*budgetUsage)
+	for key, usage := range budgets.usages {
+		if usage.errors > 0 {
+			usages[key] = &budgetUsage{start: now, errors: usage.errors}
+		}
+	}
+	budgets.usages = usages
+	return due, next
+}
+
+func (budgets *Budgets) budget(name string, fallback Budget) Budget {
+	for _, override := range budgets.policy.Overrides {
+		if matched, _ := path.Match(override.Pattern, name); matched {
+			return override.Budget
+		}
+	}
+	return fallback
+}
+
+func (budgets *Budgets) usage(key string, now time.Time) *budgetUsage {
+	usage, ok := budgets.usages[key]
+	if ok && (budgets.policy.Window == 0 || now.Sub(usage.start) < budgets.policy.Window) {
+		return usage
+	}
+	if !ok && len(budgets.usages) >= maxBudgetUsages {
+		for evicted := range budgets.usages {
+			delete(budgets.usages, evicted) // Evict any
+			break
+		}
+	}
+	usage = &budgetUsage{start: now}
+	budgets.usages[key] = usage
+	return usage
+}
+
+func (usage *budgetUsage) exhausted(budget Budget) string {
+	switch {
+	case budget.Pages > 0 && usage.pages >= budget.Pages:
+		return "pages"
+	case budget.Bytes > 0 && usage.bytes >= budget.Bytes:
+		return "bytes"
+	case budget.Time > 0 && usage.took >= budget.Time:
+		return "time"
+	case budget.Errors > 0 && usage.errors >= budget.Errors:
+		return "errors"
+	}
+	return ""
+}
+
+// deferIfExhausted defers the URLs of a host batch if the host ran out of budget. With a schedule
+// they come back when the budget window ends, otherwise in the next pass.
+func (worker *Worker) deferIfExhausted(urls []string) bool {
+	budgets := worker.cfg.Budgets
+	if budgets == nil {
+		return false
+	}
+	host := urlHost(urls[0])
+	reason := budgets.Exhausted(host)
+	if reason == "" {
+		return false
+	}
+	if strings.HasSuffix(reason, "_errors") && budgets.policy.Window == 0 {
+		// Errors carry over to the next passes, so the host would be deferred forever
+		metrics.BudgetDroppedCount.WithLabelValues(reason).Add(float64(len(urls)))
+		for _, targetURL := range urls {
+			worker.ack(targetURL)
+		}
+		return true
+	}
+	metrics.BudgetDeferredCount.WithLabelValues(reason).Add(float64(len(urls)))
+	worker.deferHost(host, urls, budgets.WindowEnd(host))
+	return true
+}
+
+// spend counts the last HandleUrl against the budgets. Only failed fetches and server errors
+// count as errors, pages we skip like robots disallowed or not HTML don't.
+func (worker *Worker) spend(targetURL string, took time.Duration) {
+	if worker.cfg.Budgets == nil {
+		return
+	}
+	worker.cfg.Budgets.Spend(urlHost(targetURL), worker.fetchedBytes, took, worker.fetchFailed)
+}
+
+func urlHost(targetURL string) string {
+	targetURLParsed, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(targetURLParsed.Host)
+}
+
+// hostDomain returns the registered domain of a host, which may have a port.
+func hostDomain(host string) string {
+	return registeredDomain((&url.URL{Host: host}).Hostname())
+}
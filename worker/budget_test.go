@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudgets(t *testing.T) {
+	overrides, err := NewBudgetOverrides(map[string]string{"*big.com": "0/0/0/0", "*.com": "3/0/0/0"})
+	if err != nil {
+		t.Fatalf("Failed to parse overrides: %v", err)
+	}
+	budgets := NewBudgets(BudgetPolicy{
+		Host:      Budget{Pages: 2, Errors: 1},
+		Domain:    Budget{Pages: 100, Bytes: 1000},
+		Overrides: overrides,
+	})
+
+	budgets.Spend("a.org", 10, time.Second, false)
+	if reason := budgets.Exhausted("a.org"); reason != "" {
+		t.Errorf("Exhausted after one page = %q", reason)
+	}
+	budgets.Spend("a.org", 10, time.Second, false)
+	if reason := budgets.Exhausted("a.org"); reason != "host_pages" {
+		t.Errorf("Exhausted after two pages = %q, want host_pages", reason)
+	}
+
+	budgets.Spend("b.org", 10, time.Second, true)
+	if reason := budgets.Exhausted("b.org"); reason != "host_errors" {
+		t.Errorf("Exhausted after an error = %q, want host_errors", reason)
+	}
+
+	// Other hosts of the domain share its byte budget
+	budgets.Spend("x.c.org", 1000, time.Second, false)
+	if reason := budgets.Exhausted("y.c.org:8080"); reason != "domain_bytes" {
+		t.Errorf("Exhausted on a sibling host = %q, want domain_bytes", reason)
+	}
+
+	// The longest matching override wins
+	for i := 0; i < 3; i++ {
+		budgets.Spend("www.big.com", 0, time.Second, false)
+		budgets.Spend("www.small.com", 0, time.Second, false)
+	}
+	if reason := budgets.Exhausted("www.big.com"); reason != "" {
+		t.Errorf("Exhausted with an unlimited override = %q", reason)
+	}
+	if reason := budgets.Exhausted("www.small.com"); reason != "host_pages" {
+		t.Errorf("Exhausted with an override = %q, want host_pages", reason)
+	}
+
+	now := time.Now()
+	budgets.Defer([]string{"https://a.org/3"}, now)
+	budgets.Defer([]string{"https://d.org/1"}, now.Add(time.Hour)) // Open circuit
+	if deferred, next := budgets.NextPass(now); len(deferred) != 1 || !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("NextPass = %v, %v, want the due batch and when the other is due", deferred, next)
+	}
+	if reason := budgets.Exhausted("a.org"); reason != "" {
+		t.Errorf("Exhausted in the next pass = %q", reason)
+	}
+	if reason := budgets.Exhausted("b.org"); reason != "host_errors" {
+		t.Errorf("Exhausted in the next pass after an error = %q, want host_errors", reason)
+	}
+	if deferred, next := budgets.NextPass(now.Add(time.Hour)); len(deferred) != 1 || !next.IsZero() {
+		t.Errorf("NextPass once due = %v, %v, want the held back batch", deferred, next)
+	}
+}
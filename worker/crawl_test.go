@@ -0,0 +1,256 @@
+package worker
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/http"
+	"github.com/musabgultekin/quantumscraper/storage"
+	"github.com/musabgultekin/quantumscraper/synthweb"
+)
+
+func TestCrawlSyntheticWeb(t *testing.T) {
+	web, err := synthweb.Start(synthweb.Config{
+		Seed: 7, Hosts: 8, PagesPerHost: 5, LinksPerPage: 3, ExternalLinks: 0.3,
+		Disallow: "/private/", Sitemaps: true,
+		RedirectPages: 0.3, SlowPages: 0.2, SlowDelay: time.Millisecond * 50, RateLimitPages: 0.2,
+		CompressedPages: 0.5, BadCharsetPages: 0.1, TrapHosts: 0.5,
+	})
+	if err != nil {
+		t.Fatalf("start synthetic web: %v", err)
+	}
+	defer web.Close()
+	pool, err := http.NewProxyPool([]string{web.ProxyURL}, http.ProxyRoundRobin, 100)
+	if err != nil {
+		t.Fatalf("proxy pool: %v", err)
+	}
+	http.SetProxyPool(pool)
+	t.Cleanup(func() { http.SetProxyPool(nil) })
+
+	const hostDelay = time.Millisecond * 200
+	frontier, err := storage.NewFrontier(t.TempDir(), storage.DepthScorer{}, hostDelay, time.Minute)
+	if err != nil {
+		t.Fatalf("frontier: %v", err)
+	}
+	defer frontier.Close()
+	seen, err := storage.NewSeenSet(t.TempDir())
+	if err != nil {
+		t.Fatalf("seen set: %v", err)
+	}
+	defer seen.Close()
+
+	// Seeds are the sitemaps of the hosts. The index is empty, so StartWorkers crawls
+	// them from the frontier after its seed pass.
+	var seeds []string
+	for i := 0; i < 8; i++ {
+		seeds = append(seeds, "http://"+web.Host(i)+"/sitemap.xml")
+	}
+	for _, seed := range seeds {
+		if _, err := frontier.Push(storage.URLInfo{URL: seed}); err != nil {
+			t.Fatalf("frontier push: %v", err)
+		}
+	}
+
+	const duplicatePages = 3
+	cfg := &Config{
+		Concurrency: 4,
+		ParquetDir:  t.TempDir(),
+		Fetcher:     http.FastFetcher{},
+		Frontier:    frontier,
+		Seen:        seen,
+		Robots:      NewRobotsCache(http.FastFetcher{}, "quantumscraper", time.Hour, 100),
+		Traps: NewTrapDetector(TrapPolicy{
+			MaxURLGrowth: 256, MaxRepeatedSegments: 3, MaxParams: 10, MaxPatternURLs: 1000,
+			DuplicatePages: duplicatePages, HostTrapLimit: 100, MaxHosts: 100,
+		}),
+		Links: LinkPolicy{Scope: ScopeDomain, MaxDepth: 20, MaxPagesPerHost: 1000},
+	}
+	markSeeds(cfg, seeds)
+	var wg sync.WaitGroup
+	if err := StartWorkers(cfg, &wg); err != nil {
+		t.Fatalf("StartWorkers = %v", err)
+	}
+	wg.Wait()
+
+	// Coverage
+	for _, page := range web.Pages() {
+		if web.Count(page) == 0 {
+			t.Errorf("%s never crawled", page)
+		}
+	}
+
+	requests := web.Requests()
+	rateLimited := make(map[string]time.Time) // First 429 of each URL
+	redirects := make(map[string]int)         // Requests of each page through a redirect
+	followed := make([]bool, len(requests))   // Whether the request followed a redirect
+	for i, request := range requests {
+		for j := i - 1; j >= 0 && request.Time.Sub(requests[j].Time) < hostDelay/4; j-- {
+			if strings.Replace(requests[j].URL, "/r/", "/p/", 1) == request.URL && requests[j].Status == 301 {
+				followed[i] = true
+			}
+		}
+		switch {
+		case request.Status == 429:
+			if _, ok := rateLimited[request.URL]; ok {
+				t.Errorf("%s answered 429 twice", request.URL)
+			}
+			rateLimited[request.URL] = request.Time
+		case strings.Contains(request.URL, "/r/"):
+			redirects[strings.Replace(request.URL, "/r/", "/p/", 1)]++
+		}
+	}
+
+	// 429s are retried once Retry-After has passed
+	if len(rateLimited) == 0 {
+		t.Errorf("no page answered 429")
+	}
+	for rateLimitedURL, at := range rateLimited {
+		retried := false
+		for i, request := range requests {
+			if request.URL == rateLimitedURL && !followed[i] && request.Time.After(at) {
+				retried = true
+				if wait := request.Time.Sub(at); wait < time.Millisecond*900 {
+					t.Errorf("%s retried %v after its 429", rateLimitedURL, wait)
+				}
+				break
+			}
+		}
+		if !retried {
+			t.Errorf("%s never retried after its 429", rateLimitedURL)
+		}
+	}
+
+	// Redirects are followed once, pages are fetched once besides redirects to them and retries
+	if len(redirects) == 0 {
+		t.Errorf("no redirect followed")
+	}
+	calendars := make(map[string]int)
+	for _, request := range requests {
+		requestURL, _ := url.Parse(request.URL)
+		count := web.Count(request.URL)
+		_, wasRateLimited := rateLimited[request.URL]
+		switch {
+		case strings.Contains(request.URL, "/private/"):
+			t.Errorf("%s is disallowed by robots.txt", request.URL)
+		case strings.HasPrefix(requestURL.Path, "/calendar/"):
+			calendars[requestURL.Host]++
+		case strings.HasPrefix(requestURL.Path, "/r/"):
+			_, targetRateLimited := rateLimited[strings.Replace(request.URL, "/r/", "/p/", 1)]
+			if count > 1 && !targetRateLimited {
+				t.Errorf("redirect %s fetched %d times", request.URL, count)
+			}
+		case requestURL.Path != "/robots.txt":
+			want := 1 + redirects[request.URL]
+			if wasRateLimited {
+				want++
+			}
+			if count > want {
+				t.Errorf("%s fetched %d times", request.URL, count)
+			}
+		}
+	}
+
+	// Trap hosts are cut off after a few near-identical calendar pages
+	traps := 0
+	for i := 0; i < 8; i++ {
+		if !web.TrapHost(i) {
+			continue
+		}
+		traps++
+		if count := calendars[web.Host(i)]; count == 0 || count > duplicatePages+2 {
+			t.Errorf("%s: %d calendar pages fetched", web.Host(i), count)
+		}
+	}
+	if traps == 0 {
+		t.Errorf("no trap host")
+	}
+
+	// Politeness, besides robots.txt and sitemaps fetched with the seeds, redirects followed
+	// and retries, which come outside of the host's frontier slots
+	lastFetch := make(map[string]time.Time)
+	fetched := make(map[string]bool)
+	for i, request := range requests {
+		requestURL, _ := url.Parse(request.URL)
+		retried := fetched[request.URL]
+		fetched[request.URL] = true
+		if requestURL.Path == "/robots.txt" || requestURL.Path == "/sitemap.xml" || retried || followed[i] {
+			continue
+		}
+		if last, ok := lastFetch[requestURL.Host]; ok && request.Time.Sub(last) < hostDelay/2 {
+			t.Errorf("%s fetched %v after the previous page of its host", request.URL, request.Time.Sub(last))
+		}
+		lastFetch[requestURL.Host] = request.Time
+	}
+}
+
+func TestHandleUrlReplay(t *testing.T) {
+	cassette := http.NewCassette()
+	cassette.Record(&http.Exchange{
+		URL: "http://a.test/", StatusCode: 200, Protocol: "HTTP/1.1",
+		Header: [][2]string{{"Content-Type", "text/html; charset=utf-8"}},
+		Body:   []byte(`<html><body><a href="/">Home</a><a href="/b">B</a><a href="http://a.test/c?x=1">C</a><a href="https://other.test/">Other</a></body></html>`),
+	})
+	cassette.Record(&http.Exchange{URL: "http://a.test/blocked", Error: "could not connect to proxy", Proxy: "proxy.test:8080", ProxyStatus: 403})
+
+	frontier, err := storage.NewFrontier(t.TempDir(), storage.DepthScorer{}, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("frontier: %v", err)
+	}
+	defer frontier.Close()
+	seen, err := storage.NewSeenSet(t.TempDir())
+	if err != nil {
+		t.Fatalf("seen set: %v", err)
+	}
+	defer seen.Close()
+	cfg := &Config{
+		Fetcher:  http.NewReplayFetcher(cassette),
+		Frontier: frontier,
+		Seen:     seen,
+		Links:    LinkPolicy{Scope: ScopeHost, MaxDepth: 5},
+	}
+	worker, err := NewWorker(0, nil, cfg)
+	if err != nil {
+		t.Fatalf("new worker: %v", err)
+	}
+
+	// Links in scope are enqueued, the seed isn't again
+	markSeeds(cfg, []string{"http://a.test/"})
+	if err := worker.HandleUrl("http://a.test/"); err != nil {
+		t.Fatalf("HandleUrl = %v", err)
+	}
+	var enqueued []string
+	for {
+		urls, err := frontier.Claim(time.Now(), 10)
+		if err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		if len(urls) == 0 {
+			break
+		}
+		for _, targetURL := range urls {
+			if err := frontier.Ack(targetURL); err != nil {
+				t.Fatalf("ack: %v", err)
+			}
+		}
+		enqueued = append(enqueued, urls...)
+	}
+	sort.Strings(enqueued)
+	if want := []string{"http://a.test/b", "http://a.test/c?x=1"}; strings.Join(enqueued, " ") != strings.Join(want, " ") {
+		t.Errorf("enqueued %v, want %v", enqueued, want)
+	}
+	if depth, found, err := seen.Depth("http://a.test/b"); err != nil || !found || depth != 1 {
+		t.Errorf("depth of a link = %d, %v, %v, want 1", depth, found, err)
+	}
+
+	// Proxies refusing the target are told apart
+	err = worker.HandleUrl("http://a.test/blocked")
+	var proxyErr *http.ProxyConnectError
+	if !errors.As(err, &proxyErr) || proxyErr.StatusCode != 403 {
+		t.Errorf("HandleUrl of a blocked URL = %v, want a proxy 403", err)
+	}
+}
@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"errors"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/musabgultekin/quantumscraper/http"
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/musabgultekin/quantumscraper/storage"
+	"go.uber.org/zap"
+)
+
+// feedFromFrontier claims ready URLs from the frontier and hands them to the workers, until stop is closed.
+// Claims give one URL per host, and each goes to the workers as a batch of its own, its host resolved
+// in the background while it waits in the queue. Cookies only last
+// a batch, so from the frontier they carry across the redirects of a fetch but not to the next fetch.
+// Claims still conflict with workers pushing links of the hosts they scan, those are retried after a
+// few random milliseconds so they don't collide again.
+func feedFromFrontier(frontier *storage.Frontier, queue chan<- []string, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		urls, err := frontier.Claim(time.Now(), 1000)
+		if errors.Is(err, badger.ErrConflict) {
+			sleepUnless(time.Duration(rand.Int63n(int64(time.Millisecond*10))), stop)
+			continue
+		}
+		if err != nil {
+			logger.Error("frontier claim", zap.Error(err))
+			sleepUnless(time.Second, stop)
+			continue
+		}
+		if len(urls) == 0 {
+			wait := time.Second
+			if next, ok, err := frontier.NextReady(); err == nil && ok && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			sleepUnless(wait, stop)
+			continue
+		}
+		metrics.FrontierClaimCount.Add(float64(len(urls)))
+		for _, targetURL := range urls {
+			http.PrefetchDNS((&url.URL{Host: urlHost(targetURL)}).Hostname())
+		}
+		for _, targetURL := range urls {
+			queue <- []string{targetURL}
+		}
+	}
+}
+
+func sleepUnless(wait time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+	}
+}
+
+// CrawlFrontier crawls the frontier with cfg.Concurrency workers until stop is closed,
+// then waits for the workers to finish their batches. Frontier and Seen must be set.
+func CrawlFrontier(cfg *Config, stop <-chan struct{}) error {
+	if cfg.Frontier == nil || cfg.Seen == nil {
+		return errors.New("crawling the frontier needs frontier and seen set")
+	}
+	var wg sync.WaitGroup
+	queue := make(chan []string, 1000)
+	if err := startWorkerPool(cfg, &wg, queue); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-foundLinksChan:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	feedFromFrontier(cfg.Frontier, queue, stop)
+	close(queue)
+	wg.Wait()
+	return nil
+}
+
+// drainFrontier crawls the frontier with a new worker pool until no URL is queued or claimed anymore.
+func drainFrontier(cfg *Config, wg *sync.WaitGroup) error {
+	queue := make(chan []string, 1000)
+	if err := startWorkerPool(cfg, wg, queue); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			drained, err := cfg.Frontier.Drained()
+			if err != nil {
+				logger.Error("frontier drained", zap.Error(err))
+				continue
+			}
+			if drained {
+				close(stop)
+				return
+			}
+		}
+	}()
+	feedFromFrontier(cfg.Frontier, queue, stop)
+	close(queue)
+	wg.Wait()
+	return nil
+}
+
+// ack tells the frontier the URL is done, so its lease doesn't bring it back.
+func (worker *Worker) ack(targetURL string) {
+	if worker.cfg.Frontier == nil {
+		return
+	}
+	if err := worker.cfg.Frontier.Ack(targetURL); err != nil {
+		logger.Error("frontier ack", zap.Error(err), zap.String("url", targetURL))
+	}
+}
+
+// deferHost holds back the URLs of a host batch until the given time. Without a schedule they're
+// kept for the first budget pass after it, or dropped if there are no budgets, and leave the frontier either way.
+func (worker *Worker) deferHost(host string, urls []string, at time.Time) {
+	if worker.cfg.Schedule == nil {
+		if worker.cfg.Budgets != nil {
+			worker.cfg.Budgets.Defer(urls, at)
+		}
+		for _, targetURL := range urls {
+			worker.ack(targetURL)
+		}
+		return
+	}
+	for _, targetURL := range urls {
+		if err := worker.cfg.Schedule.Add(targetURL, at); err != nil {
+			logger.Error("schedule add", zap.Error(err), zap.String("url", targetURL))
+		}
+		worker.ack(targetURL)
+	}
+	if worker.cfg.Frontier != nil {
+		if err := worker.cfg.Frontier.SetHostReady(host, at); err != nil {
+			logger.Error("frontier set host ready", zap.Error(err), zap.String("host", host))
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package worker
+
+import (
+	"encoding/json"
+	nethttp "net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/http"
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/musabgultekin/quantumscraper/storage"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// Circuit states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"      // Fetches are held back until the cool-off ends
+	CircuitHalfOpen = "half_open" // One probe fetch decides whether to close or reopen
+)
+
+// HealthPolicy decides when the circuit of a host or IP opens.
+type HealthPolicy struct {
+	Window       time.Duration // Of the rolling error rate
+	MinRequests  int           // In the window, before the error rate counts
+	MaxErrorRate float64
+	MaxFailures  int // Consecutive
+	CoolOff      time.Duration
+	MaxCoolOff   time.Duration
+	HalfOpen     bool // Probe with one fetch after the cool-off, instead of closing right away
+}
+
+// HostHealth tracks error rates, latency and consecutive failures per host and per IP,
+// and breaks the circuit of failing ones. Circuit states are persisted, so known-dead
+// hosts stay held back after a restart.
+type HostHealth struct {
+	policy HealthPolicy
+	store  *storage.HealthStore // Optional
+
+	mu      sync.Mutex
+	entries map[string]*healthEntry // Keyed by "host/" or "ip/" and the name
+}
+
+type healthEntry struct {
+	record storage.HealthRecord
+
+	windowStart      time.Time
+	requests, errors int
+	previousRequests int // Of the previous window, so the rate rolls over smoothly
+	previousErrors   int
+	latency          time.Duration // Moving average
+	probeStart       time.Time     // Of the half-open probe in flight
+	lastIP           string        // Of host entries
+	kind             string        // "host" or "ip", the metric label
+}
+
+const maxHealthEntries = 1_000_000
+
+func NewHostHealth(policy HealthPolicy, store *storage.HealthStore) *HostHealth {
+	return &HostHealth{policy: policy, store: store, entries: make(map[string]*healthEntry)}
+}
+
+// Allow reports whether the host may be fetched now. If not, it returns when to retry.
+func (health *HostHealth) Allow(host string) (bool, time.Time) {
+	health.load("host/" + host)
+	health.mu.Lock()
+	ip := health.entry("host/" + host).lastIP
+	health.mu.Unlock()
+	if ip != "" {
+		health.load("ip/" + ip)
+	}
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	now := time.Now()
+	hostEntry := health.entry("host/" + host)
+	if allowed, retryAt := health.allow(hostEntry, now); !allowed {
+		metrics.CircuitRejectCount.WithLabelValues("host").Inc()
+		return false, retryAt
+	}
+	if hostEntry.lastIP != "" {
+		if allowed, retryAt := health.allow(health.entry("ip/"+hostEntry.lastIP), now); !allowed {
+			hostEntry.probeStart = time.Time{} // Not probed after all
+			metrics.CircuitRejectCount.WithLabelValues("ip").Inc()
+			return false, retryAt
+		}
+	}
+	return true, time.Time{}
+}
+
+// Report records the outcome of a fetch of the host, and of its IP if known.
+func (health *HostHealth) Report(host, ip string, failed bool, latency time.Duration) {
+	health.load("host/" + host)
+	if ip != "" {
+		health.load("ip/" + ip)
+	}
+
+	health.mu.Lock()
+	now := time.Now()
+	changed := make(map[string]storage.HealthRecord, 2)
+	hostEntry := health.entry("host/" + host)
+	if health.report(hostEntry, failed, latency, now) {
+		changed["host/"+host] = hostEntry.record
+	}
+	if ip != "" {
+		hostEntry.lastIP = ip
+		ipEntry := health.entry("ip/" + ip)
+		if health.report(ipEntry, failed, latency, now) {
+			changed["ip/"+ip] = ipEntry.record
+		}
+	}
+	health.mu.Unlock()
+
+	for key, record := range changed {
+		health.persist(key, &record)
+	}
+}
+
+func (health *HostHealth) allow(entry *healthEntry, now time.Time) (bool, time.Time) {
+	switch entry.record.State {
+	case CircuitOpen:
+		if now.Before(entry.record.OpenUntil) {
+			return false, entry.record.OpenUntil
+		}
+		if !health.policy.HalfOpen {
+			entry.record.State = CircuitClosed
+			return true, time.Time{}
+		}
+		entry.record.State = CircuitHalfOpen
+		entry.probeStart = now
+		return true, time.Time{}
+	case CircuitHalfOpen:
+		// Wait for the probe, unless it never reported back
+		if retryAt := entry.probeStart.Add(health.policy.CoolOff); now.Before(retryAt) {
+			return false, retryAt
+		}
+		entry.probeStart = now
+		return true, time.Time{}
+	}
+	return true, time.Time{}
+}
+
+// report records the outcome in the entry, and tells whether its circuit changed and should be persisted.
+func (health *HostHealth) report(entry *healthEntry, failed bool, latency time.Duration, now time.Time) bool {
+	if now.Sub(entry.windowStart) >= health.policy.Window {
+		entry.previousRequests, entry.previousErrors = entry.requests, entry.errors
+		if now.Sub(entry.windowStart) >= 2*health.policy.Window {
+			entry.previousRequests, entry.previousErrors = 0, 0
+		}
+		entry.windowStart, entry.requests, entry.errors = now, 0, 0
+	}
+	entry.requests++
+	if entry.latency == 0 {
+		entry.latency = latency
+	} else {
+		entry.latency = (entry.latency*7 + latency) / 8
+	}
+
+	record := &entry.record
+	if !failed {
+		record.ConsecutiveFailures = 0
+		record.CoolOff = 0
+		if record.State == CircuitHalfOpen {
+			record.State = CircuitClosed
+			return true
+		}
+		return false
+	}
+
+	entry.errors++
+	record.ConsecutiveFailures++
+	switch record.State {
+	case CircuitHalfOpen:
+		health.open(entry, now)
+		return true
+	case CircuitClosed, "":
+		requests := entry.requests + entry.previousRequests
+		errorRate := float64(entry.errors+entry.previousErrors) / float64(requests)
+		if (health.policy.MaxFailures > 0 && record.ConsecutiveFailures >= health.policy.MaxFailures) ||
+			(requests >= health.policy.MinRequests && errorRate >= health.policy.MaxErrorRate) {
+			health.open(entry, now)
+			return true
+		}
+	}
+	return false
+}
+
+// open opens the circuit, doubling the cool-off of the previous opening.
+func (health *HostHealth) open(entry *healthEntry, now time.Time) {
+	record := &entry.record
+	record.CoolOff *= 2
+	if record.CoolOff < health.policy.CoolOff {
+		record.CoolOff = health.policy.CoolOff
+	}
+	if health.policy.MaxCoolOff > 0 && record.CoolOff > health.policy.MaxCoolOff {
+		record.CoolOff = health.policy.MaxCoolOff
+	}
+	record.State = CircuitOpen
+	record.OpenUntil = now.Add(record.CoolOff)
+	record.Opens++
+	metrics.CircuitOpenCount.WithLabelValues(entry.kind).Inc()
+}
+
+// persist stores the record, outside of health.mu.
+func (health *HostHealth) persist(key string, record *storage.HealthRecord) {
+	if health.store == nil {
+		return
+	}
+	if err := health.store.Put(key, record); err != nil {
+		logger.Error("health store put", zap.Error(err), zap.String("key", key))
+	}
+}
+
+// load reads the persisted state of the key the first time it's seen. It takes health.mu
+// only around the map, so workers don't wait on each other's store reads.
+func (health *HostHealth) load(key string) {
+	if health.store == nil {
+		return
+	}
+	health.mu.Lock()
+	_, ok := health.entries[key]
+	health.mu.Unlock()
+	if ok {
+		return
+	}
+
+	record, err := health.store.Get(key)
+	if err != nil {
+		logger.Error("health store get", zap.Error(err), zap.String("key", key))
+		return
+	}
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if _, ok := health.entries[key]; ok || record == nil {
+		return // Another worker loaded it first, or nothing was persisted
+	}
+	entry := health.entry(key)
+	entry.record = *record
+	if entry.record.State == CircuitHalfOpen {
+		entry.record.State = CircuitOpen // The probe died with the previous run
+	}
+}
+
+// entry returns the entry of the key, creating a closed one if it isn't known.
+// The persisted state is read by load beforehand.
+func (health *HostHealth) entry(key string) *healthEntry {
+	if entry, ok := health.entries[key]; ok {
+		return entry
+	}
+	if len(health.entries) >= maxHealthEntries {
+		for evicted := range health.entries {
+			delete(health.entries, evicted) // Evict any, open circuits come back from the store
+			break
+		}
+	}
+	entry := &healthEntry{record: storage.HealthRecord{State: CircuitClosed}, kind: key[:strings.IndexByte(key, '/')]}
+	health.entries[key] = entry
+	return entry
+}
+
+// deferIfUnhealthy defers the URLs of a host batch while the circuit of the host or its IP is open.
+func (worker *Worker) deferIfUnhealthy(urls []string) bool {
+	if worker.cfg.Health == nil {
+		return false
+	}
+	host := urlHost(urls[0])
+	allowed, retryAt := worker.cfg.Health.Allow(host)
+	if allowed {
+		return false
+	}
+	worker.deferHost(host, urls, retryAt)
+	return true
+}
+
+// reportHealth counts server errors, 429s and failed connections against the host.
+// Failures of the proxy never reached the host, so they don't count.
+func (worker *Worker) reportHealth(targetURL string, result *http.FetchResult, err error, latency time.Duration) {
+	if worker.cfg.Health == nil {
+		return
+	}
+	if err != nil && http.ProxyFailed(err) {
+		return
+	}
+	failed := result.StatusCode >= 500 || result.StatusCode == fasthttp.StatusTooManyRequests ||
+		(err != nil && result.StatusCode == 0)
+	worker.cfg.Health.Report(urlHost(targetURL), result.RemoteIP, failed, latency)
+}
+
+type healthReport struct {
+	Key                 string    `json:"key"`
+	State               string    `json:"state"`
+	OpenUntil           time.Time `json:"open_until"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	ErrorRate           float64   `json:"error_rate"`
+	LatencyMs           int64     `json:"latency_ms"`
+	Opens               int       `json:"opens"`
+}
+
+// ServeHTTP lists the hosts and IPs whose circuit isn't closed as JSON.
+func (health *HostHealth) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	health.mu.Lock()
+	reports := make([]healthReport, 0)
+	for key, entry := range health.entries {
+		if entry.record.State == CircuitClosed {
+			continue
+		}
+		var errorRate float64
+		if requests := entry.requests + entry.previousRequests; requests > 0 {
+			errorRate = float64(entry.errors+entry.previousErrors) / float64(requests)
+		}
+		reports = append(reports, healthReport{
+			Key:                 key,
+			State:               entry.record.State,
+			OpenUntil:           entry.record.OpenUntil,
+			ConsecutiveFailures: entry.record.ConsecutiveFailures,
+			ErrorRate:           errorRate,
+			LatencyMs:           entry.latency.Milliseconds(),
+			Opens:               entry.record.Opens,
+		})
+	}
+	health.mu.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Key < reports[j].Key })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
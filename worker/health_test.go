@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/storage"
+)
+
+func TestHostHealth(t *testing.T) {
+	store, err := storage.NewHealthStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create health store: %v", err)
+	}
+	defer store.Close()
+	policy := HealthPolicy{Window: time.Minute, MinRequests: 100, MaxErrorRate: 0.5, MaxFailures: 3,
+		CoolOff: 50 * time.Millisecond, MaxCoolOff: time.Hour, HalfOpen: true}
+	health := NewHostHealth(policy, store)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := health.Allow("a.com"); !allowed {
+			t.Fatalf("Allow after %d failures = false", i)
+		}
+		health.Report("a.com", "10.0.0.1", true, time.Millisecond)
+	}
+	allowed, retryAt := health.Allow("a.com")
+	if allowed || retryAt.IsZero() {
+		t.Fatalf("Allow after 3 failures = %v, %v, want open", allowed, retryAt)
+	}
+	// The IP opened too, so other hosts on it are held back after their first fetch
+	health.Report("b.com", "10.0.0.1", false, time.Millisecond)
+	if allowed, _ := health.Allow("b.com"); allowed {
+		t.Errorf("Allow on a failing IP = true")
+	}
+
+	// Restarts keep the circuit open
+	restarted := NewHostHealth(policy, store)
+	if allowed, _ := restarted.Allow("a.com"); allowed {
+		t.Errorf("Allow after restart = true, want open")
+	}
+
+	// After the cool-off, one probe goes through. Its failure doubles the cool-off.
+	time.Sleep(policy.CoolOff)
+	if allowed, _ := health.Allow("a.com"); !allowed {
+		t.Fatalf("Allow after cool-off = false, want a probe")
+	}
+	if allowed, _ := health.Allow("a.com"); allowed {
+		t.Errorf("Allow during probe = true")
+	}
+	health.Report("a.com", "", true, time.Millisecond)
+	record, err := store.Get("host/a.com")
+	if err != nil || record == nil {
+		t.Fatalf("Get = %v, %v", record, err)
+	}
+	if record.State != CircuitOpen || record.CoolOff != 2*policy.CoolOff || record.Opens != 2 {
+		t.Errorf("Record after failed probe = %+v", record)
+	}
+
+	// A successful probe closes it, and its IP
+	time.Sleep(2 * policy.CoolOff)
+	if allowed, _ := health.Allow("a.com"); !allowed {
+		t.Fatalf("Allow after second cool-off = false")
+	}
+	health.Report("a.com", "10.0.0.1", false, time.Millisecond)
+	if allowed, _ := health.Allow("a.com"); !allowed {
+		t.Errorf("Allow after successful probe = false")
+	}
+}
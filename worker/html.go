@@ -5,85 +5,193 @@ import (
 	"fmt"
 	"io"
 	"net/url"
-	"path/filepath"
 	"strings"
+	"sync"
 
 	"golang.org/x/net/html"
 )
 
+// acceptedExtensions are the extensions of links to pages. Links without an extension are pages too.
+var acceptedExtensions = map[string]struct{}{
+	".asp": {}, ".aspx": {}, ".htm": {}, ".html": {}, ".jsp": {}, ".jsx": {}, ".php": {}, ".php3": {}, ".php4": {}, ".php5": {}, ".phtml": {},
+}
+
+// linkExtractor holds the buffers reused across pages.
+type linkExtractor struct {
+	reader bytes.Reader
+	link   []byte
+}
+
+var linkExtractors = sync.Pool{New: func() any { return new(linkExtractor) }}
+
 func extractLinksFromHTML(pageURL string, body []byte) (linkSet map[string]struct{}, err error) {
-	pageURLParsed, err := url.Parse(pageURL)
+	base, err := newPageBase(pageURL)
 	if err != nil {
 		return nil, fmt.Errorf("page url parse: %w", err)
 	}
 
-	htmlLinkStrings, err := extractRawLinksFromHTML(body)
-	if err != nil {
-		return nil, fmt.Errorf("extract raw links from html: %w", err)
-	}
-
 	// Use a map to ensure uniqueness of links
 	linkSet = make(map[string]struct{})
 
-	// Convert to absolute
-	for _, htmlLinkString := range htmlLinkStrings {
-		if strings.HasPrefix(htmlLinkString, "http") {
-			linkSet[htmlLinkString] = struct{}{}
-			continue
-		}
-		absoluteHTMLink, err := pageURLParsed.Parse(htmlLinkString)
-		if err != nil {
-			// log.Println("WARN: page link parse error:", err, pageURL)
-			continue
-		}
-		linkSet[absoluteHTMLink.String()] = struct{}{}
+	extractor := linkExtractors.Get().(*linkExtractor)
+	defer linkExtractors.Put(extractor)
+	if err := extractor.extract(base, body, linkSet); err != nil {
+		return nil, fmt.Errorf("extract raw links from html: %w", err)
 	}
-
-	return
+	return linkSet, nil
 }
 
-func extractRawLinksFromHTML(body []byte) ([]string, error) {
-	var links []string
+// extract adds the absolute URL of the first href of every <a> tag to links.
+func (extractor *linkExtractor) extract(base *pageBase, body []byte, links map[string]struct{}) error {
+	extractor.reader.Reset(body)
+	defer extractor.reader.Reset(nil) // Don't hold on to the page
 
-	z := html.NewTokenizer(bytes.NewReader(body))
+	z := html.NewTokenizer(&extractor.reader)
 	for {
-		tt := z.Next()
-		switch tt {
+		switch z.Next() {
 		case html.ErrorToken:
 			if z.Err() == io.EOF {
-				return links, nil
+				return nil
 			}
-			return nil, z.Err()
+			return z.Err()
 		case html.StartTagToken:
 			tagName, moreAttr := z.TagName()
-			if len(tagName) == 1 && tagName[0] == 'a' {
-				for moreAttr {
-					var key, val []byte
-					key, val, moreAttr = z.TagAttr()
-					if string(key) == "href" && len(val) != 0 {
-						valString := strings.TrimSpace(string(val))
-						if strings.HasPrefix(valString, "#") {
-							break
-						}
-						acceptedExtensions := []string{".asp", ".aspx", ".htm", ".html", ".jsp", ".jsx", ".php", ".php3", ".php4", ".php5", ".phtml"}
-						ext := filepath.Ext(valString)
-						if ext == "" || contains(acceptedExtensions, ext) {
-							links = append(links, valString)
-						}
-						break
-					}
+			if len(tagName) != 1 || tagName[0] != 'a' {
+				continue
+			}
+			for moreAttr {
+				var key, val []byte
+				key, val, moreAttr = z.TagAttr()
+				if string(key) == "href" && len(val) != 0 {
+					extractor.add(base, bytes.TrimSpace(val), links)
+					break
 				}
 			}
 		}
 	}
 }
 
-// contains checks if a slice contains a string
-func contains(s []string, str string) bool {
-	for _, v := range s {
-		if v == str {
-			return true
+func (extractor *linkExtractor) add(base *pageBase, link []byte, links map[string]struct{}) {
+	if len(link) > 0 && link[0] == '#' || !pageLink(link) {
+		return
+	}
+	absolute := link
+	if !bytes.HasPrefix(link, []byte("http")) {
+		var ok bool
+		extractor.link, ok = base.appendResolved(extractor.link[:0], link)
+		if !ok {
+			resolved, err := base.parsed.Parse(string(link))
+			if err != nil {
+				return
+			}
+			links[resolved.String()] = struct{}{}
+			return
 		}
+		absolute = extractor.link
+	}
+	if _, ok := links[string(absolute)]; !ok { // Lookups don't allocate, only new links are copied
+		links[string(absolute)] = struct{}{}
 	}
-	return false
 }
+
+// pageLink tells whether the link has no extension or one of a page, like filepath.Ext sees it.
+func pageLink(link []byte) bool {
+	for i := len(link) - 1; i >= 0 && link[i] != '/'; i-- {
+		if link[i] == '.' {
+			_, ok := acceptedExtensions[string(link[i:])]
+			return ok
+		}
+	}
+	return true
+}
+
+// pageBase is a page URL parsed once to resolve the links on the page.
+type pageBase struct {
+	parsed *url.URL
+	origin string // Scheme and host, empty if every link must be resolved by parsed
+	dir    string // Path up to its last slash
+}
+
+func newPageBase(pageURL string) (*pageBase, error) {
+	parsed, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	base := &pageBase{parsed: parsed}
+	if parsed.Scheme == "" || parsed.Host == "" || parsed.Opaque != "" {
+		return base, nil
+	}
+	dir := parsed.EscapedPath()
+	dir = dir[:strings.LastIndex(dir, "/")+1]
+	if dir == "" {
+		dir = "/"
+	}
+	if !simplePath(dir) {
+		return base, nil
+	}
+	base.origin = (&url.URL{Scheme: parsed.Scheme, User: parsed.User, Host: parsed.Host}).String()
+	base.dir = dir
+	return base, nil
+}
+
+// appendResolved appends the absolute URL of the link to dst. It only handles links the way
+// url.URL.Parse would resolve them with plain concatenation, and reports false for the rest.
+func (base *pageBase) appendResolved(dst, link []byte) ([]byte, bool) {
+	if base.origin == "" || len(link) == 0 || link[0] == '?' {
+		return dst, false
+	}
+	path, query := link, []byte(nil)
+	if i := bytes.IndexByte(link, '?'); i >= 0 {
+		path, query = link[:i], link[i+1:]
+	}
+	if !simplePath(path) {
+		return dst, false
+	}
+	for _, c := range query {
+		if c != '?' && !simpleLinkChars[c] {
+			return dst, false
+		}
+	}
+
+	dst = append(dst, base.origin...)
+	if link[0] != '/' {
+		dst = append(dst, base.dir...)
+	}
+	return append(dst, link...), true
+}
+
+// simplePath tells whether the path needs no escaping and no dot segment or empty segment removal.
+func simplePath[T string | []byte](path T) bool {
+	segmentStart := 0
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) && path[i] != '/' {
+			if !simpleLinkChars[path[i]] {
+				return false
+			}
+			continue
+		}
+		segment := path[segmentStart:i]
+		if len(segment) == 1 && segment[0] == '.' || len(segment) == 2 && segment[0] == '.' && segment[1] == '.' {
+			return false
+		}
+		if len(segment) == 0 && i > 0 && i < len(path) {
+			return false // A double slash
+		}
+		segmentStart = i + 1
+	}
+	return true
+}
+
+// simpleLinkChars are the bytes links keep as they are once parsed and printed by net/url.
+var simpleLinkChars = func() (chars [256]bool) {
+	for c := '0'; c <= '9'; c++ {
+		chars[c] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		chars[c], chars[c-'a'+'A'] = true, true
+	}
+	for _, c := range "-._~=&" {
+		chars[c] = true
+	}
+	return chars
+}()
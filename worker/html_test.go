@@ -0,0 +1,155 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// extractLinksReference is the extractor before the fast path, which the fast path must agree with.
+func extractLinksReference(pageURL string, body []byte) (map[string]struct{}, error) {
+	pageURLParsed, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	var rawLinks []string
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for done := false; !done; {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return nil, z.Err()
+			}
+			done = true
+		case html.StartTagToken:
+			tagName, moreAttr := z.TagName()
+			if len(tagName) == 1 && tagName[0] == 'a' {
+				for moreAttr {
+					var key, val []byte
+					key, val, moreAttr = z.TagAttr()
+					if string(key) == "href" && len(val) != 0 {
+						valString := strings.TrimSpace(string(val))
+						if strings.HasPrefix(valString, "#") {
+							break
+						}
+						acceptedExtensions := []string{".asp", ".aspx", ".htm", ".html", ".jsp", ".jsx", ".php", ".php3", ".php4", ".php5", ".phtml"}
+						ext := filepath.Ext(valString)
+						for _, accepted := range acceptedExtensions {
+							if ext == accepted {
+								ext = ""
+							}
+						}
+						if ext == "" {
+							rawLinks = append(rawLinks, valString)
+						}
+						break
+					}
+				}
+			}
+		}
+	}
+
+	linkSet := make(map[string]struct{})
+	for _, rawLink := range rawLinks {
+		if strings.HasPrefix(rawLink, "http") {
+			linkSet[rawLink] = struct{}{}
+			continue
+		}
+		absolute, err := pageURLParsed.Parse(rawLink)
+		if err != nil {
+			continue
+		}
+		linkSet[absolute.String()] = struct{}{}
+	}
+	return linkSet, nil
+}
+
+var testHrefs = []string{
+	"", " ", "#top", "/", "a", "a/", "/a/b", "b.html", "c.php?id=1&x=y", "d?", "d??e", "?q=1", " e ", "f.pdf", "g.tar.gz",
+	".", "..", "./h", "../i", "j/../k", "l/./m", "/n/..", "//other.test/o", "/p//q", "r s", "t%20u", "v;w", "x+y", "ü",
+	"z:1", "mailto:a@example.com", "javascript:void(0)", "http://example.com/abs", "https://example.com/x?y", "httpish",
+	"HTTP://EXAMPLE.COM/", "a?b=c/d:e", "&amp;f", "g&amp;h=1",
+}
+
+var testPageURLs = []string{
+	"http://example.com", "http://example.com/", "http://example.com/dir/page.html", "https://user:pw@example.com:8443/a/b/?q#f",
+	"http://example.com/a/./b/../c", "http://example.com//x/y", "http://example.com/%7Ea/b", "http://[::1]/a/b", "mailto:a@example.com",
+}
+
+func TestExtractLinksFromHTML(t *testing.T) {
+	var body strings.Builder
+	for _, href := range testHrefs {
+		fmt.Fprintf(&body, "<p><a class=\"x\" href=\"%s\" href=\"/second\">link</a></p>\n", href)
+	}
+	body.WriteString(`<A HREF="/upper">x</A><a>none</a><link href="/not-a"><a href='/single'>y</a>`)
+
+	for _, pageURL := range testPageURLs {
+		got, err := extractLinksFromHTML(pageURL, []byte(body.String()))
+		if err != nil {
+			t.Fatalf("extract links of %s: %v", pageURL, err)
+		}
+		want, err := extractLinksReference(pageURL, []byte(body.String()))
+		if err != nil {
+			t.Fatalf("reference links of %s: %v", pageURL, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			for link := range got {
+				if _, ok := want[link]; !ok {
+					t.Errorf("%s: unexpected link %q", pageURL, link)
+				}
+			}
+			for link := range want {
+				if _, ok := got[link]; !ok {
+					t.Errorf("%s: missing link %q", pageURL, link)
+				}
+			}
+		}
+	}
+}
+
+// benchmarkPage looks like a typical page: mostly relative links, some absolute and some assets.
+func benchmarkPage() []byte {
+	var page strings.Builder
+	page.WriteString("<html><head><title>Page</title><script>var a = '<a href=\"/no\">';</script></head><body>\n")
+	for i := 0; i < 200; i++ {
+		switch i % 5 {
+		case 0:
+			fmt.Fprintf(&page, "<a href=\"https://other%d.example.org/path/%d\">External</a>\n", i%7, i)
+		case 1:
+			fmt.Fprintf(&page, "<a href=\"/category/item-%d.html\" class=\"item\">Item %d</a>\n", i, i)
+		case 2:
+			fmt.Fprintf(&page, "<a href=\"page?id=%d&amp;sort=asc\">Page %d</a>\n", i, i)
+		case 3:
+			fmt.Fprintf(&page, "<div><img src=\"/img/%d.png\"><a href=\"/files/%d.pdf\">PDF</a></div>\n", i, i)
+		case 4:
+			fmt.Fprintf(&page, "<a href=\"#section-%d\">Section</a><a href=\"/\">Home</a>\n", i)
+		}
+	}
+	page.WriteString("</body></html>\n")
+	return []byte(page.String())
+}
+
+func BenchmarkExtractLinks(b *testing.B) {
+	page := benchmarkPage()
+	for name, extract := range map[string]func(string, []byte) (map[string]struct{}, error){
+		"fast":      extractLinksFromHTML,
+		"reference": extractLinksReference,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(page)))
+			for i := 0; i < b.N; i++ {
+				if _, err := extract("https://www.example.com/category/list", page); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/http"
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"golang.org/x/time/rate"
+)
+
+// IPLimit bounds the concurrent fetches and fetches per second to an IP or subnet. Zero means no limit.
+type IPLimit struct {
+	Conns int
+	RPS   float64
+}
+
+// IPLimitPolicy holds the limits per IP and per subnet, a /24 for IPv4 or a /48 for IPv6,
+// so hosts sharing a server don't all get crawled at once. Overrides replace both
+// for IPs in their networks, like CDNs that take far more.
+type IPLimitPolicy struct {
+	IP        IPLimit
+	Subnet    IPLimit
+	Overrides []IPLimitOverride
+}
+
+type IPLimitOverride struct {
+	Networks []*net.IPNet
+	IP       IPLimit
+	Subnet   IPLimit
+}
+
+// ParseIPLimit parses limits like "4/2.5", as conns/rps.
+func ParseIPLimit(spec string) (IPLimit, error) {
+	conns, rps, ok := strings.Cut(spec, "/")
+	if !ok {
+		return IPLimit{}, fmt.Errorf("ip limit %q: expected conns/rps", spec)
+	}
+	var limit IPLimit
+	var err error
+	if limit.Conns, err = strconv.Atoi(conns); err != nil {
+		return limit, fmt.Errorf("ip limit %q conns: %w", spec, err)
+	}
+	if limit.RPS, err = strconv.ParseFloat(rps, 64); err != nil {
+		return limit, fmt.Errorf("ip limit %q rps: %w", spec, err)
+	}
+	return limit, nil
+}
+
+// ParseIPLimitOverrides parses overrides like "AS13335=64/50/256/200" or "104.16.0.0/13=64/50/256/200",
+// as ip conns/ip rps/subnet conns/subnet rps. ASNs are looked up in asnPrefixes.
+func ParseIPLimitOverrides(specs []string, asnPrefixes map[string][]*net.IPNet) ([]IPLimitOverride, error) {
+	overrides := make([]IPLimitOverride, 0, len(specs))
+	for _, spec := range specs {
+		network, limits, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("ip limit override %q: expected network=limits", spec)
+		}
+		var override IPLimitOverride
+		if asn := strings.ToUpper(network); strings.HasPrefix(asn, "AS") {
+			override.Networks = asnPrefixes[asn]
+			if len(override.Networks) == 0 {
+				return nil, fmt.Errorf("ip limit override %q: no prefixes known for %s", spec, asn)
+			}
+		} else {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("ip limit override %q: %w", spec, err)
+			}
+			override.Networks = []*net.IPNet{ipNet}
+		}
+
+		fields := strings.Split(limits, "/")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("ip limit override %q: expected ip conns/ip rps/subnet conns/subnet rps", spec)
+		}
+		var err error
+		if override.IP, err = ParseIPLimit(fields[0] + "/" + fields[1]); err != nil {
+			return nil, err
+		}
+		if override.Subnet, err = ParseIPLimit(fields[2] + "/" + fields[3]); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, nil
+}
+
+// LoadASNPrefixes reads the announced prefixes of ASNs from lines like "AS13335 104.16.0.0/13".
+func LoadASNPrefixes(path string) (map[string][]*net.IPNet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open asn prefix file: %w", err)
+	}
+	defer file.Close()
+
+	prefixes := make(map[string][]*net.IPNet)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("asn prefix line %q: expected asn and prefix", scanner.Text())
+		}
+		_, ipNet, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("asn prefix line %q: %w", scanner.Text(), err)
+		}
+		asn := strings.ToUpper(fields[0])
+		prefixes[asn] = append(prefixes[asn], ipNet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read asn prefix file: %w", err)
+	}
+	return prefixes, nil
+}
+
+// IPLimiter enforces the limits of the IP and subnet of each fetch.
+type IPLimiter struct {
+	policy IPLimitPolicy
+
+	mu    sync.Mutex
+	slots map[string]*ipSlot // Keyed by IP or subnet
+	hosts map[string]net.IP  // IP the connections of a host were last dialed to
+}
+
+// ipSlot counts the fetches of an IP or subnet. Each fetch is held to the limits of the IP it goes to,
+// so IPs of one subnet with different overrides share the count but not the limit.
+type ipSlot struct {
+	refs int // Fetches holding or waiting for the slot, under IPLimiter.mu. Slots in use aren't evicted.
+
+	mu      sync.Mutex
+	active  int
+	wake    chan struct{} // Closed when a fetch releases the slot
+	limiter *rate.Limiter
+}
+
+const maxIPSlots = 1_000_000
+
+func NewIPLimiter(policy IPLimitPolicy) *IPLimiter {
+	return &IPLimiter{policy: policy, slots: make(map[string]*ipSlot), hosts: make(map[string]net.IP)}
+}
+
+// Acquire waits until a fetch from the IP is within limits. The returned func must be called when it's done.
+// The IP slot is taken first, so fetches waiting on a busy IP don't hold up the rest of its subnet.
+func (limiter *IPLimiter) Acquire(ctx context.Context, ip net.IP) (func(), error) {
+	ipLimit, subnetLimit := limiter.limits(ip)
+	subnet, single := limiter.pin(subnetKey(ip)), limiter.pin(ip.String())
+	unpin := func() {
+		limiter.unpin(subnet)
+		limiter.unpin(single)
+	}
+
+	releaseIP, err := single.acquire(ctx, ipLimit, "ip")
+	if err != nil {
+		unpin()
+		return nil, err
+	}
+	releaseSubnet, err := subnet.acquire(ctx, subnetLimit, "subnet")
+	if err != nil {
+		releaseIP()
+		unpin()
+		return nil, err
+	}
+	return func() {
+		releaseIP()
+		releaseSubnet()
+		unpin()
+	}, nil
+}
+
+// Dialed remembers the IP the connections of the host went to, to limit its next fetches on it.
+func (limiter *IPLimiter) Dialed(host string, ip net.IP) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if _, ok := limiter.hosts[host]; !ok && len(limiter.hosts) >= maxIPSlots {
+		for evicted := range limiter.hosts {
+			delete(limiter.hosts, evicted) // Evict any
+			break
+		}
+	}
+	limiter.hosts[host] = ip
+}
+
+// HostIP returns the IP the connections of the host were last dialed to, or nil if it wasn't dialed yet.
+func (limiter *IPLimiter) HostIP(host string) net.IP {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.hosts[host]
+}
+
+func (limiter *IPLimiter) limits(ip net.IP) (IPLimit, IPLimit) {
+	for _, override := range limiter.policy.Overrides {
+		for _, network := range override.Networks {
+			if network.Contains(ip) {
+				return override.IP, override.Subnet
+			}
+		}
+	}
+	return limiter.policy.IP, limiter.policy.Subnet
+}
+
+// pin returns the slot of the key and keeps it from being evicted until unpinned.
+func (limiter *IPLimiter) pin(key string) *ipSlot {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	slot, ok := limiter.slots[key]
+	if !ok {
+		if len(limiter.slots) >= maxIPSlots {
+			for evicted, evictedSlot := range limiter.slots {
+				if evictedSlot.refs == 0 {
+					delete(limiter.slots, evicted) // Evict an idle one
+					break
+				}
+			}
+		}
+		slot = &ipSlot{wake: make(chan struct{}), limiter: rate.NewLimiter(rate.Inf, 1)}
+		limiter.slots[key] = slot
+	}
+	slot.refs++
+	return slot
+}
+
+func (limiter *IPLimiter) unpin(slot *ipSlot) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	slot.refs--
+}
+
+func (slot *ipSlot) acquire(ctx context.Context, limit IPLimit, scope string) (func(), error) {
+	startTime := time.Now()
+	defer func() {
+		metrics.IPLimitWait.WithLabelValues(scope).Observe(time.Since(startTime).Seconds())
+	}()
+
+	for {
+		slot.mu.Lock()
+		if limit.Conns <= 0 || slot.active < limit.Conns {
+			slot.active++
+			if limit.RPS > 0 {
+				slot.limiter.SetLimit(rate.Limit(limit.RPS))
+			}
+			slot.mu.Unlock()
+			break
+		}
+		wake := slot.wake
+		slot.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		slot.mu.Lock()
+		slot.active--
+		close(slot.wake)
+		slot.wake = make(chan struct{})
+		slot.mu.Unlock()
+	}
+	if limit.RPS > 0 {
+		if err := slot.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// subnetKey returns the /24 of an IPv4 or the /48 of an IPv6 address.
+func subnetKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// errIPBusy is returned for fetches that waited maxIPWait for the limits of their IP.
+var errIPBusy = errors.New("ip limits busy")
+
+// Fetches wait this long for the limits of their IP, then their host batch is deferred for as long.
+const maxIPWait = time.Second * 10
+
+// acquireIP waits until the IP of the URL's host is within limits: the IP its connections were last
+// dialed to, or the first address dialing tries if it wasn't dialed yet. If the host doesn't resolve
+// the fetch goes ahead, and fails on its own.
+func (worker *Worker) acquireIP(targetURL string) (func(), error) {
+	if worker.cfg.IPLimits == nil {
+		return func() {}, nil
+	}
+	targetURLParsed, err := url.Parse(targetURL)
+	if err != nil {
+		return func() {}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), maxIPWait)
+	defer cancel()
+	ip := worker.cfg.IPLimits.HostIP(targetURLParsed.Hostname())
+	if ip == nil {
+		ips, err := http.ResolveHost(ctx, targetURLParsed.Hostname())
+		if err != nil || len(ips) == 0 {
+			return func() {}, nil
+		}
+		ip = ips[0]
+	}
+	release, err := worker.cfg.IPLimits.Acquire(ctx, ip)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errIPBusy, ip)
+	}
+	return release, nil
+}
+
+// dialedIP tells the IP limits where the connections of the host went, for its next fetches.
+// Only direct connections tell their IP.
+func (worker *Worker) dialedIP(targetURL string, result *http.FetchResult) {
+	if worker.cfg.IPLimits == nil || result.RemoteIP == "" {
+		return
+	}
+	targetURLParsed, err := url.Parse(targetURL)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(result.RemoteIP); ip != nil {
+		worker.cfg.IPLimits.Dialed(targetURLParsed.Hostname(), ip)
+	}
+}
@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPLimiter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.txt")
+	if err := os.WriteFile(path, []byte("# CDN\nAS64500 203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write asn file: %v", err)
+	}
+	asnPrefixes, err := LoadASNPrefixes(path)
+	if err != nil {
+		t.Fatalf("Failed to load asn prefixes: %v", err)
+	}
+	overrides, err := ParseIPLimitOverrides([]string{"as64500=0/0/0/0", "192.0.2.128/25=2/0/3/0"}, asnPrefixes)
+	if err != nil {
+		t.Fatalf("Failed to parse overrides: %v", err)
+	}
+	limiter := NewIPLimiter(IPLimitPolicy{IP: IPLimit{Conns: 2}, Subnet: IPLimit{Conns: 2}, Overrides: overrides})
+
+	// Two IPs of one /24 use up the subnet
+	release1, err := limiter.Acquire(context.Background(), net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("Acquire first = %v", err)
+	}
+	release2, err := limiter.Acquire(context.Background(), net.ParseIP("192.0.2.2"))
+	if err != nil {
+		t.Fatalf("Acquire second = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := limiter.Acquire(ctx, net.ParseIP("192.0.2.3")); err == nil {
+		t.Errorf("Acquire over the subnet limit succeeded")
+	}
+	release1()
+	release3, err := limiter.Acquire(context.Background(), net.ParseIP("192.0.2.3"))
+	if err != nil {
+		t.Fatalf("Acquire after release = %v", err)
+	}
+
+	// Another IP of the subnet has a bigger subnet limit, the count stays shared
+	release4, err := limiter.Acquire(context.Background(), net.ParseIP("192.0.2.129"))
+	if err != nil {
+		t.Fatalf("Acquire with a bigger subnet limit = %v", err)
+	}
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel2()
+	if _, err := limiter.Acquire(ctx2, net.ParseIP("192.0.2.130")); err == nil {
+		t.Errorf("Acquire over the bigger subnet limit succeeded")
+	}
+	release2()
+	release3()
+	release4()
+	limiter.mu.Lock()
+	for key, slot := range limiter.slots {
+		if slot.refs != 0 || slot.active != 0 {
+			t.Errorf("Slot %s after release = %d refs, %d active", key, slot.refs, slot.active)
+		}
+	}
+	limiter.mu.Unlock()
+
+	// The CDN has no limits
+	for i := 0; i < 5; i++ {
+		if _, err := limiter.Acquire(ctx, net.ParseIP("203.0.113.7")); err != nil {
+			t.Fatalf("Acquire on the CDN = %v", err)
+		}
+	}
+
+	limiter.Dialed("a.com", net.ParseIP("192.0.2.9"))
+	if ip := limiter.HostIP("a.com"); !ip.Equal(net.ParseIP("192.0.2.9")) {
+		t.Errorf("HostIP = %v, want the dialed IP", ip)
+	}
+
+	if key := subnetKey(net.ParseIP("2001:db8:1:2::1")); key != "2001:db8:1::/48" {
+		t.Errorf("subnetKey of IPv6 = %s", key)
+	}
+}
+
+func TestIPLimiterWaitDoesNotHoldSubnet(t *testing.T) {
+	limiter := NewIPLimiter(IPLimitPolicy{IP: IPLimit{Conns: 1}, Subnet: IPLimit{Conns: 2}})
+	release, err := limiter.Acquire(context.Background(), net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("Acquire = %v", err)
+	}
+	defer release()
+
+	// A fetch waiting for the busy IP leaves the other subnet slot to the next IP
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go limiter.Acquire(ctx, net.ParseIP("192.0.2.1"))
+	time.Sleep(time.Millisecond * 20)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel2()
+	if _, err := limiter.Acquire(ctx2, net.ParseIP("192.0.2.2")); err != nil {
+		t.Errorf("Acquire of another IP while one waits = %v", err)
+	}
+}
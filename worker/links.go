@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/musabgultekin/quantumscraper/storage"
+	"go.uber.org/zap"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Link scopes
+const (
+	ScopeHost   = "host"   // Only links to the same host
+	ScopeDomain = "domain" // Links to the same registered domain, e.g. blog.example.com from example.com
+	ScopeAll    = "all"
+)
+
+// LinkPolicy limits which discovered links are enqueued.
+type LinkPolicy struct {
+	Scope           string
+	MaxDepth        int // Link hops from a seed
+	MaxPagesPerHost int // Discovered pages, 0 for no limit
+}
+
+// enqueueLinks puts the links found on a page into the frontier, if they're new, in scope
+// and allowed by robots.txt. Links seen before get their score updated while they're still queued.
+func (worker *Worker) enqueueLinks(pageURL string, links map[string]struct{}) {
+	if worker.cfg.Frontier == nil || worker.cfg.Seen == nil {
+		return
+	}
+	added, duplicates := worker.admitLinks(pageURL, links)
+	for _, info := range added {
+		if _, err := worker.cfg.Frontier.Push(info); err != nil {
+			logger.Error("frontier push", zap.Error(err), zap.String("url", info.URL))
+			continue
+		}
+		metrics.LinkCount.WithLabelValues("enqueued").Inc()
+	}
+	// Scorers like OPIC credit every inlink, as long as the URL is waiting in the frontier
+	for _, info := range duplicates {
+		if err := worker.cfg.Frontier.Rescore(info); err != nil {
+			logger.Error("frontier rescore", zap.Error(err), zap.String("url", info.URL))
+		}
+	}
+}
+
+// admitLinks checks the links found on a page against the depth, scope, robots.txt and traps,
+// and adds them to the seen set. It returns the new links, and those that were seen before.
+// Seen must be set.
+func (worker *Worker) admitLinks(pageURL string, links map[string]struct{}) (added, duplicates []storage.URLInfo) {
+	policy := worker.cfg.Links
+
+	parentDepth, _, err := worker.cfg.Seen.Depth(pageURL)
+	if err != nil {
+		logger.Error("seen depth", zap.Error(err), zap.String("url", pageURL))
+		return nil, nil
+	}
+	depth := parentDepth + 1
+	if depth > policy.MaxDepth {
+		metrics.LinkCount.WithLabelValues("too_deep").Add(float64(len(links)))
+		return nil, nil
+	}
+	pageURLParsed, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, nil
+	}
+
+	for link := range links {
+		linkURL, err := canonicalizeURL(link)
+		if err != nil {
+			metrics.LinkCount.WithLabelValues("invalid").Inc()
+			continue
+		}
+		if !inScope(policy.Scope, pageURLParsed, linkURL) {
+			metrics.LinkCount.WithLabelValues("out_of_scope").Inc()
+			continue
+		}
+		// Only cached rules here, hosts not seen yet are checked when fetched
+		if worker.cfg.Robots != nil {
+			if allowed, known := worker.cfg.Robots.Cached(linkURL); known && !allowed {
+				metrics.LinkCount.WithLabelValues("robots").Inc()
+				continue
+			}
+		}
+
+		if worker.cfg.Traps != nil {
+			if reason := worker.cfg.Traps.Check(linkURL, pageURLParsed); reason != "" {
+				metrics.LinkCount.WithLabelValues("trap").Inc()
+				metrics.TrapURLCount.WithLabelValues(reason).Inc()
+				continue
+			}
+		}
+
+		linkString := linkURL.String()
+		info := storage.URLInfo{URL: linkString, Depth: depth, Parent: pageURL, ParentLinks: len(links)}
+		isNew, err := worker.cfg.Seen.Add(linkString, linkURL.Host, depth, policy.MaxPagesPerHost)
+		if errors.Is(err, storage.ErrHostFull) {
+			metrics.LinkCount.WithLabelValues("host_full").Inc()
+			continue
+		}
+		if err != nil {
+			logger.Error("seen add", zap.Error(err), zap.String("url", linkString))
+			continue
+		}
+		if !isNew {
+			metrics.LinkCount.WithLabelValues("duplicate").Inc()
+			duplicates = append(duplicates, info)
+			continue
+		}
+		if worker.cfg.Traps != nil {
+			worker.cfg.Traps.Discovered(linkURL)
+		}
+		added = append(added, info)
+	}
+	return added, duplicates
+}
+
+// markSeeds adds seed URLs to the seen set at depth zero, so links back to them aren't enqueued again.
+func markSeeds(cfg *Config, urls []string) {
+	if cfg.Seen == nil {
+		return
+	}
+	for _, seedURL := range urls {
+		seedURLParsed, err := canonicalizeURL(seedURL)
+		if err != nil {
+			continue
+		}
+		if _, err := cfg.Seen.Add(seedURLParsed.String(), seedURLParsed.Host, 0, 0); err != nil {
+			logger.Error("seen add", zap.Error(err), zap.String("url", seedURL))
+		}
+	}
+}
+
+// canonicalizeURL normalizes a URL so the same page is seen once: lowercase host without the default port,
+// no fragment, dot segments resolved, query sorted and without utm_ tracking parameters.
+func canonicalizeURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host: %s", rawURL)
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = u.Hostname()
+		if strings.Contains(u.Host, ":") {
+			u.Host = "[" + u.Host + "]" // IPv6
+		}
+	}
+	u.Fragment, u.RawFragment = "", ""
+	u = u.ResolveReference(&url.URL{}) // Resolves dot segments
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			if strings.HasPrefix(key, "utm_") {
+				delete(query, key)
+			}
+		}
+		u.RawQuery = query.Encode() // Sorted by key
+	}
+	return u, nil
+}
+
+func inScope(scope string, pageURL, linkURL *url.URL) bool {
+	switch scope {
+	case ScopeHost:
+		return strings.EqualFold(pageURL.Host, linkURL.Host)
+	case ScopeDomain:
+		return registeredDomain(pageURL.Hostname()) == registeredDomain(linkURL.Hostname())
+	default:
+		return true
+	}
+}
+
+func registeredDomain(host string) string {
+	host = strings.ToLower(host)
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/storage"
+)
+
+func TestCanonicalizeURL(t *testing.T) {
+	tests := map[string]string{
+		"HTTP://Example.COM:80":                     "http://example.com/",
+		"https://example.com:443/a/./b/../c#frag":   "https://example.com/a/c",
+		"https://example.com/?b=2&utm_source=x&a=1": "https://example.com/?a=1&b=2",
+		"https://example.com:8443/":                 "https://example.com:8443/",
+		"https://[2001:db8::1]:443/":                "https://[2001:db8::1]/",
+	}
+	for rawURL, want := range tests {
+		got, err := canonicalizeURL(rawURL)
+		if err != nil {
+			t.Fatalf("canonicalizeURL(%q) failed: %v", rawURL, err)
+		}
+		if got.String() != want {
+			t.Errorf("canonicalizeURL(%q) = %q, want %q", rawURL, got.String(), want)
+		}
+	}
+
+	for _, rawURL := range []string{"mailto:a@example.com", "javascript:void(0)", "/relative"} {
+		if _, err := canonicalizeURL(rawURL); err == nil {
+			t.Errorf("canonicalizeURL(%q) should fail", rawURL)
+		}
+	}
+}
+
+func TestInScope(t *testing.T) {
+	page, _ := url.Parse("https://www.example.co.uk/")
+	link, _ := url.Parse("https://blog.example.co.uk/post")
+	if inScope(ScopeHost, page, link) {
+		t.Errorf("other host in host scope")
+	}
+	if !inScope(ScopeDomain, page, link) {
+		t.Errorf("same registered domain not in domain scope")
+	}
+	other, _ := url.Parse("https://other.co.uk/")
+	if inScope(ScopeDomain, page, other) {
+		t.Errorf("other registered domain in domain scope")
+	}
+}
+
+func TestEnqueueLinksCreditsInlinks(t *testing.T) {
+	scorer, err := storage.NewOPICScorer(t.TempDir())
+	if err != nil {
+		t.Fatalf("opic scorer: %v", err)
+	}
+	defer scorer.Close()
+	frontier, err := storage.NewFrontier(t.TempDir(), scorer, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("frontier: %v", err)
+	}
+	defer frontier.Close()
+	seen, err := storage.NewSeenSet(t.TempDir())
+	if err != nil {
+		t.Fatalf("seen set: %v", err)
+	}
+	defer seen.Close()
+	cfg := &Config{Frontier: frontier, Seen: seen, Links: LinkPolicy{Scope: ScopeHost, MaxDepth: 5}}
+	worker, err := NewWorker(0, nil, cfg)
+	if err != nil {
+		t.Fatalf("new worker: %v", err)
+	}
+	claim := func() string {
+		t.Helper()
+		urls, err := frontier.Claim(time.Now(), 1)
+		if err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		if len(urls) == 0 {
+			return ""
+		}
+		if err := frontier.Ack(urls[0]); err != nil {
+			t.Fatalf("ack: %v", err)
+		}
+		return urls[0]
+	}
+
+	// Both pages link to /x, which rises above the pages themselves, /y only gets one inlink
+	seeds := []string{"http://a.test/", "http://a.test/b"}
+	markSeeds(cfg, seeds)
+	for _, seed := range seeds {
+		if _, err := frontier.Push(storage.URLInfo{URL: seed}); err != nil {
+			t.Fatalf("frontier push: %v", err)
+		}
+	}
+	worker.enqueueLinks("http://a.test/", map[string]struct{}{"http://a.test/x": {}, "http://a.test/y": {}})
+	worker.enqueueLinks("http://a.test/b", map[string]struct{}{"http://a.test/x": {}})
+	if got := claim(); got != "http://a.test/x" {
+		t.Errorf("claimed %s first, want the page linked twice", got)
+	}
+
+	// Once crawled, more inlinks don't bring it back
+	worker.enqueueLinks("http://a.test/y", map[string]struct{}{"http://a.test/x": {}})
+	for targetURL := claim(); targetURL != ""; targetURL = claim() {
+		if targetURL == "http://a.test/x" {
+			t.Errorf("%s queued again after it was acked", targetURL)
+		}
+	}
+}
+
+func TestRobotsRules(t *testing.T) {
+	body := []byte(`
+User-agent: *
+Disallow: /private
+Allow: /private/public$
+
+# Our own group wins over *
+User-agent: OtherBot
+User-agent: QuantumScraper
+Disallow: /*.pdf$
+Disallow: /search
+Allow: /search/about
+`)
+	tests := []struct {
+		agent, path string
+		allowed     bool
+	}{
+		{"quantumscraper", "/private", true},
+		{"quantumscraper", "/docs/file.pdf", false},
+		{"quantumscraper", "/docs/file.pdf?download=1", true},
+		{"quantumscraper", "/search?q=1", false},
+		{"quantumscraper", "/search/about", true},
+		{"quantumscraper", "/robots.txt", true},
+		{"somebot", "/private/x", false},
+		{"somebot", "/private/public", true},
+		{"somebot", "/private/public/x", false},
+		{"somebot", "/", true},
+	}
+	for _, test := range tests {
+		rules := &robotsRules{rules: parseRobots(body, test.agent)}
+		if got := rules.allowed(test.path); got != test.allowed {
+			t.Errorf("%s allowed %s = %v, want %v", test.agent, test.path, got, test.allowed)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 
@@ -14,6 +15,7 @@ import (
 type QueueWorker struct {
 	queue       *storage.Queue
 	rateLimiter *rate.Limiter
+	crawler     *Worker // Checks the links found like the frontier workers do
 }
 
 func (worker *QueueWorker) HandleMessage(message *nsq.Message) error {
@@ -37,19 +39,28 @@ func (worker *QueueWorker) HandleMessage(message *nsq.Message) error {
 	}
 
 	// Queue new links
-	_ = links
-	// for _, link := range links {
-	// 	if err := worker.queue.AddURL(link); err != nil {
-	// 		return fmt.Errorf("failed to add URL to visited storage: %w", err)
-	// 	}
-	// }
+	added, _ := worker.crawler.admitLinks(targetURL, links)
+	for _, info := range added {
+		if err := worker.queue.AddURL(info.URL); err != nil {
+			return fmt.Errorf("failed to add URL to visited storage: %w", err)
+		}
+	}
 
 	return nil
 }
 
-func StartQueueWorkers(concurrency int, queue *storage.Queue) (consumers []*nsq.Consumer, err error) {
+// StartQueueWorkers consumes URLs from the queue, and queues the links found on them that pass
+// the link checks of cfg. Seen must be set.
+func StartQueueWorkers(cfg *Config, queue *storage.Queue) (consumers []*nsq.Consumer, err error) {
+	if cfg.Seen == nil {
+		return nil, errors.New("queue workers need a seen set")
+	}
+	worker, err := NewWorker(0, nil, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("new worker: %w", err)
+	}
 
-	// for i := 0; i < concurrency; i++ {
+	// for i := 0; i < cfg.Concurrency; i++ {
 	// Consumer initialization
 	consumerConfig := nsq.NewConfig()
 	consumerConfig.MaxInFlight = 1
@@ -61,6 +72,7 @@ func StartQueueWorkers(concurrency int, queue *storage.Queue) (consumers []*nsq.
 	consumer.AddHandler(&QueueWorker{
 		queue:       queue,
 		rateLimiter: rate.NewLimiter(1, 1),
+		crawler:     worker,
 	})
 	// Connect
 	if err := consumer.ConnectToNSQD(storage.NsqServer); err != nil {
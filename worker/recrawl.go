@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/musabgultekin/quantumscraper/storage"
+	"github.com/musabgultekin/quantumscraper/urlloader"
+	"go.uber.org/zap"
+)
+
+// RecrawlPolicy decides when a URL is fetched next, based on how often it was seen changing.
+type RecrawlPolicy struct {
+	Initial  time.Duration // Interval after the first fetch, when there's no history yet
+	Min      time.Duration
+	Max      time.Duration
+	Lease    time.Duration // How long a popped URL stays out of the schedule before it comes back
+	HubLinks int           // Pages with at least this many links are hubs
+	HubBoost float64       // Hubs are revisited this many times sooner
+}
+
+// NextInterval estimates the change rate with the Poisson estimator from Cho and Garcia-Molina,
+// "Estimating Frequency of Change": after n revisits that found X changes, the rate is
+// -ln((n - X + 0.5) / (n + 0.5)) per average revisit interval. We come back after the expected
+// time until the next change.
+func (policy *RecrawlPolicy) NextInterval(record *storage.FetchRecord, links int) time.Duration {
+	interval := policy.Initial
+	if revisits := record.Fetches - 1; revisits > 0 {
+		average := record.FetchedAt.Sub(record.FirstFetchedAt) / time.Duration(revisits)
+		n, x := float64(revisits), float64(record.Changes)
+		changesPerInterval := -math.Log((n - x + 0.5) / (n + 0.5))
+		if changesPerInterval > 0 {
+			interval = time.Duration(float64(average) / changesPerInterval)
+		} else {
+			interval = average * 2 // Never seen changing, back off
+		}
+	}
+
+	if policy.HubLinks > 0 && links >= policy.HubLinks && policy.HubBoost > 1 {
+		interval = time.Duration(float64(interval) / policy.HubBoost)
+	}
+
+	if interval < policy.Min {
+		return policy.Min
+	}
+	if interval > policy.Max {
+		return policy.Max
+	}
+	return interval
+}
+
+// FailureInterval backs off failed fetches, doubling from Min with each failure in a row up to Max.
+func (policy *RecrawlPolicy) FailureInterval(failures int) time.Duration {
+	interval := policy.Min
+	for i := 1; i < failures && interval < policy.Max; i++ {
+		interval *= 2
+	}
+	if interval > policy.Max {
+		return policy.Max
+	}
+	return interval
+}
+
+// recrawl seeds the schedule from the URL list once, then keeps feeding due URLs to the workers.
+func recrawl(cfg *Config, urlLoader *urlloader.URLLoaderParquet) error {
+	seeded, err := cfg.Schedule.Seeded()
+	if err != nil {
+		return fmt.Errorf("schedule seeded: %w", err)
+	}
+	if !seeded {
+		log.Println("Seeding recrawl schedule")
+		now := time.Now()
+		for {
+			urlStrings, err := urlLoader.LoadNextHostURLs()
+			if err != nil {
+				return fmt.Errorf("url loader load next domain urls: %w", err)
+			}
+			if len(urlStrings) == 0 {
+				break // end of file
+			}
+			for _, urlString := range urlStrings {
+				if _, err := cfg.Schedule.AddIfAbsent(urlString, now); err != nil {
+					return fmt.Errorf("schedule add: %w", err)
+				}
+			}
+			markSeeds(cfg, urlStrings)
+		}
+		if err := cfg.Schedule.MarkSeeded(); err != nil {
+			return fmt.Errorf("schedule mark seeded: %w", err)
+		}
+	}
+
+	log.Println("Recrawling due URLs")
+	for {
+		urls, err := cfg.Schedule.PopDue(time.Now(), 10_000, cfg.Recrawl.Lease)
+		if err != nil {
+			return fmt.Errorf("schedule pop due: %w", err)
+		}
+		if len(urls) == 0 {
+			wait := time.Minute
+			if next, ok, err := cfg.Schedule.Next(); err == nil && ok && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			time.Sleep(wait)
+			continue
+		}
+		metrics.RecrawlDueCount.Add(float64(len(urls)))
+		for _, targetURL := range urls {
+			if _, err := cfg.Frontier.Push(storage.URLInfo{URL: targetURL}); err != nil {
+				logger.Error("frontier push", zap.Error(err), zap.String("url", targetURL))
+			}
+		}
+	}
+}
+
+// reschedule puts the URL back into the schedule after a successful fetch.
+func (worker *Worker) reschedule(targetURL string, record *storage.FetchRecord, links int) error {
+	if worker.cfg.Schedule == nil {
+		return nil
+	}
+	next := time.Now().Add(worker.cfg.Recrawl.NextInterval(record, links))
+	if err := worker.cfg.Schedule.Add(targetURL, next); err != nil {
+		return fmt.Errorf("schedule add: %w", err)
+	}
+	return nil
+}
+
+// rescheduleFailed retries failed URLs, backing off with the failures in a row.
+func (worker *Worker) rescheduleFailed(targetURL string) {
+	if worker.cfg.Schedule == nil {
+		return
+	}
+	failures := 1
+	if worker.cfg.History != nil {
+		var err error
+		if failures, err = worker.cfg.History.Failed(targetURL); err != nil {
+			logger.Error("fetch history failed", zap.Error(err), zap.String("url", targetURL))
+			failures = 1
+		}
+	}
+	next := time.Now().Add(worker.cfg.Recrawl.FailureInterval(failures))
+	if err := worker.cfg.Schedule.Add(targetURL, next); err != nil {
+		logger.Error("reschedule failed url", zap.Error(err), zap.String("url", targetURL))
+	}
+}
+
+// handleSitemap passes sitemap entries on as links, and schedules the ones whose lastmod
+// is newer than our last fetch right away.
+func (worker *Worker) handleSitemap(sitemapURL string, entries []sitemapEntry) error {
+	links := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		links[entry.Loc] = struct{}{}
+	}
+	foundLinksChan <- links
+	worker.enqueueLinks(sitemapURL, links)
+
+	if worker.cfg.Schedule == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.LastMod.IsZero() {
+			continue
+		}
+		record, err := worker.cfg.History.Get(entry.Loc)
+		if err != nil {
+			return fmt.Errorf("fetch history get: %w", err)
+		}
+		if record != nil && !entry.LastMod.After(record.FetchedAt) {
+			continue
+		}
+		if err := worker.cfg.Schedule.Add(entry.Loc, now); err != nil {
+			return fmt.Errorf("schedule add: %w", err)
+		}
+		metrics.SitemapBoostCount.Inc()
+	}
+	return nil
+}
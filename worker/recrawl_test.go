@@ -0,0 +1,15 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureInterval(t *testing.T) {
+	policy := RecrawlPolicy{Min: time.Hour, Max: time.Hour * 720}
+	for failures, want := range map[int]time.Duration{1: time.Hour, 2: time.Hour * 2, 4: time.Hour * 8, 20: time.Hour * 720} {
+		if got := policy.FailureInterval(failures); got != want {
+			t.Errorf("FailureInterval(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
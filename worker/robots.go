@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/musabgultekin/quantumscraper/http"
+)
+
+// RobotsCache fetches and caches robots.txt rules per host. It holds at most maxHosts hosts.
+type RobotsCache struct {
+	fetcher  http.Fetcher
+	agent    string
+	ttl      time.Duration
+	maxHosts int
+
+	mu    sync.Mutex
+	hosts map[string]*robotsRules
+}
+
+type robotsRules struct {
+	rules     []robotsRule // Of the group matching our agent
+	expiresAt time.Time
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+func NewRobotsCache(fetcher http.Fetcher, agent string, ttl time.Duration, maxHosts int) *RobotsCache {
+	return &RobotsCache{
+		fetcher:  fetcher,
+		agent:    strings.ToLower(agent),
+		ttl:      ttl,
+		maxHosts: maxHosts,
+		hosts:    make(map[string]*robotsRules),
+	}
+}
+
+// Cached checks the URL against the cached rules of its host, without fetching.
+// known is false if the rules aren't cached.
+func (robots *RobotsCache) Cached(targetURL *url.URL) (allowed, known bool) {
+	robots.mu.Lock()
+	rules, ok := robots.hosts[robotsHostKey(targetURL)]
+	robots.mu.Unlock()
+	if !ok || time.Now().After(rules.expiresAt) {
+		return false, false
+	}
+	return rules.allowed(targetURL.RequestURI()), true
+}
+
+// Allowed checks the URL against the rules of its host, fetching its robots.txt if needed.
+func (robots *RobotsCache) Allowed(targetURL *url.URL) bool {
+	if allowed, known := robots.Cached(targetURL); known {
+		return allowed
+	}
+
+	rules := robots.fetch(targetURL)
+	robots.mu.Lock()
+	if len(robots.hosts) >= robots.maxHosts {
+		for host := range robots.hosts {
+			delete(robots.hosts, host) // Evict any
+			break
+		}
+	}
+	robots.hosts[robotsHostKey(targetURL)] = rules
+	robots.mu.Unlock()
+
+	return rules.allowed(targetURL.RequestURI())
+}
+
+// fetch gets the rules of the host. As in RFC 9309, a missing robots.txt allows everything,
+// and an unreachable one disallows everything.
+func (robots *RobotsCache) fetch(targetURL *url.URL) *robotsRules {
+	robotsURL := url.URL{Scheme: targetURL.Scheme, Host: targetURL.Host, Path: "/robots.txt"}
+	result, err := robots.fetcher.Fetch(&http.FetchRequest{URL: robotsURL.String(), AnyContentType: true})
+	expiresAt := time.Now().Add(robots.ttl)
+	switch {
+	case err == nil:
+		return &robotsRules{rules: parseRobots(result.Body, robots.agent), expiresAt: expiresAt}
+	case result.StatusCode >= 400 && result.StatusCode < 500:
+		return &robotsRules{expiresAt: expiresAt}
+	default:
+		return &robotsRules{rules: []robotsRule{{allow: false, pattern: "/"}}, expiresAt: expiresAt}
+	}
+}
+
+func robotsHostKey(targetURL *url.URL) string {
+	return targetURL.Scheme + "://" + targetURL.Host
+}
+
+// parseRobots returns the rules of the groups matching the agent, or of the * groups if none do.
+func parseRobots(body []byte, agent string) []robotsRule {
+	type group struct {
+		agents []string
+		rules  []robotsRule
+	}
+	var groups []*group
+	var current *group
+	inAgents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = &group{}
+				groups = append(groups, current)
+				inAgents = true
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			if current == nil || value == "" {
+				continue
+			}
+			current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+		}
+	}
+
+	var matched, wildcard []robotsRule
+	for _, group := range groups {
+		for _, groupAgent := range group.agents {
+			if groupAgent == agent {
+				matched = append(matched, group.rules...)
+			} else if groupAgent == "*" {
+				wildcard = append(wildcard, group.rules...)
+			}
+		}
+	}
+	if matched != nil {
+		return matched
+	}
+	return wildcard
+}
+
+// allowed applies the longest matching rule. On a tie, allow wins.
+func (rules *robotsRules) allowed(path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+	allowed, longest := true, -1
+	for _, rule := range rules.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			allowed, longest = rule.allow, len(rule.pattern)
+		}
+	}
+	return allowed
+}
+
+// robotsMatch matches a path against a pattern, where * matches anything and a trailing $ anchors the end.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	position := len(parts[0])
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(path[position:], part)
+		}
+		index := strings.Index(path[position:], part)
+		if index < 0 {
+			return false
+		}
+		position += index + len(part)
+	}
+	return !anchored || position == len(path)
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+type sitemapEntry struct {
+	Loc     string
+	LastMod time.Time // Zero if the sitemap doesn't say
+}
+
+type sitemapDocument struct {
+	URLs []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	} `xml:"sitemap"`
+}
+
+// extractSitemapEntries parses <urlset> and <sitemapindex> documents.
+// It reports false if the body isn't a sitemap.
+func extractSitemapEntries(body []byte) ([]sitemapEntry, bool) {
+	head := body
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if !bytes.Contains(head, []byte("<urlset")) && !bytes.Contains(head, []byte("<sitemapindex")) {
+		return nil, false
+	}
+
+	var document sitemapDocument
+	if err := xml.Unmarshal(body, &document); err != nil {
+		return nil, false
+	}
+
+	entries := make([]sitemapEntry, 0, len(document.URLs)+len(document.Sitemaps))
+	for _, u := range document.URLs {
+		entries = append(entries, sitemapEntry{Loc: strings.TrimSpace(u.Loc), LastMod: parseLastMod(u.LastMod)})
+	}
+	for _, s := range document.Sitemaps {
+		entries = append(entries, sitemapEntry{Loc: strings.TrimSpace(s.Loc), LastMod: parseLastMod(s.LastMod)})
+	}
+	return entries, true
+}
+
+// parseLastMod parses the W3C datetime formats sitemaps use.
+func parseLastMod(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
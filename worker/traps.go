@@ -0,0 +1,321 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"math/bits"
+	nethttp "net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/musabgultekin/quantumscraper/metrics"
+)
+
+// Trap reasons
+const (
+	TrapRepeatedSegments = "repeated_segments" // /a/b/a/b/a/b/...
+	TrapURLGrowth        = "url_growth"        // Much longer than the URL of the page linking it, e.g. appended paths
+	TrapParams           = "params"            // Too many query parameters
+	TrapPatternExplosion = "pattern_explosion" // Too many URLs of one pattern with repeating content, e.g. calendars or faceted search
+	TrapDuplicateContent = "duplicate_content" // Many URLs of one pattern with near-identical content, e.g. session IDs
+	TrapHostCapped       = "host_capped"       // Host hit too many traps, no more links from it
+)
+
+// TrapPolicy holds the trap detection thresholds.
+type TrapPolicy struct {
+	MaxURLGrowth        int // Characters a link may add to the URL of the page linking it
+	MaxRepeatedSegments int // Occurrences of the same path segment
+	MaxParams           int
+	MaxPatternURLs      int // Distinct URLs per pattern, once its fetched pages mostly repeat each other
+	DuplicatePages      int // Near-identical pages per pattern
+	HostTrapLimit       int // Trap URLs per host before it's capped
+	MaxHosts            int // Hosts tracked in memory
+}
+
+// TrapDetector spots crawler traps per host with URL heuristics and content similarity.
+// Patterns replace path segments with digits by *, and drop query values, so
+// /calendar/2023/05?view=day becomes /calendar/*/*?view.
+type TrapDetector struct {
+	policy TrapPolicy
+
+	mu    sync.Mutex
+	hosts map[string]*hostTraps
+}
+
+type hostTraps struct {
+	trapURLs    int
+	capped      bool
+	patterns    map[string]*patternStats
+	quarantined map[string]string // Pattern to reason
+}
+
+type patternStats struct {
+	urls       int
+	fetched    int
+	duplicates int              // Fetched pages near-identical to an earlier one
+	clusters   []contentCluster // Near-identical content groups
+}
+
+type contentCluster struct {
+	simhash uint64
+	pages   int
+}
+
+const (
+	maxPatternsPerHost    = 10_000
+	maxClustersPerPattern = 8
+	nearDuplicateBits     = 3 // Simhashes this close are near-identical
+)
+
+func NewTrapDetector(policy TrapPolicy) *TrapDetector {
+	return &TrapDetector{policy: policy, hosts: make(map[string]*hostTraps)}
+}
+
+// Check returns why the URL, linked from the parent page, looks like a trap, or an empty string if it doesn't.
+func (detector *TrapDetector) Check(u, parent *url.URL) string {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	host := detector.host(u.Host)
+	if host.capped {
+		return TrapHostCapped
+	}
+	reason := detector.urlTrap(u, parent)
+	if reason == "" {
+		reason = host.quarantined[urlPattern(u)]
+	}
+	if reason == "" {
+		return ""
+	}
+
+	host.trapURLs++
+	if detector.policy.HostTrapLimit > 0 && host.trapURLs >= detector.policy.HostTrapLimit {
+		host.capped = true
+		metrics.TrapHostsCapped.Inc()
+	}
+	return reason
+}
+
+// Discovered counts a new URL towards its pattern, quarantining the pattern if it explodes
+// with repeating content.
+func (detector *TrapDetector) Discovered(u *url.URL) {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	host := detector.host(u.Host)
+	pattern := urlPattern(u)
+	stats := host.pattern(pattern)
+	if stats == nil {
+		return
+	}
+	stats.urls++
+	if detector.exploded(stats) {
+		host.quarantine(pattern, TrapPatternExplosion)
+	}
+}
+
+// Fetched compares the content with the pages of the same pattern, quarantining the pattern
+// if too many of them are near-identical.
+func (detector *TrapDetector) Fetched(u *url.URL, body []byte) {
+	fingerprint := simhash(body)
+
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	host := detector.host(u.Host)
+	pattern := urlPattern(u)
+	stats := host.pattern(pattern)
+	if stats == nil {
+		return
+	}
+	stats.fetched++
+	defer func() {
+		if detector.exploded(stats) {
+			host.quarantine(pattern, TrapPatternExplosion)
+		}
+	}()
+	for i := range stats.clusters {
+		if bits.OnesCount64(stats.clusters[i].simhash^fingerprint) <= nearDuplicateBits {
+			stats.clusters[i].pages++
+			stats.duplicates++
+			if detector.policy.DuplicatePages > 0 && stats.clusters[i].pages >= detector.policy.DuplicatePages {
+				host.quarantine(pattern, TrapDuplicateContent)
+			}
+			return
+		}
+	}
+	if len(stats.clusters) < maxClustersPerPattern {
+		stats.clusters = append(stats.clusters, contentCluster{simhash: fingerprint, pages: 1})
+	}
+}
+
+// exploded tells whether the pattern has too many URLs while at least half of its fetched pages
+// repeat an earlier one. Large sites have many URLs per pattern too, but with distinct content.
+func (detector *TrapDetector) exploded(stats *patternStats) bool {
+	return detector.policy.MaxPatternURLs > 0 && stats.urls > detector.policy.MaxPatternURLs &&
+		stats.fetched > 0 && stats.duplicates*2 >= stats.fetched
+}
+
+func (detector *TrapDetector) urlTrap(u, parent *url.URL) string {
+	policy := detector.policy
+	if policy.MaxURLGrowth > 0 && parent != nil && len(u.String())-len(parent.String()) > policy.MaxURLGrowth {
+		return TrapURLGrowth
+	}
+	if policy.MaxParams > 0 && strings.Count(u.RawQuery, "&")+1 > policy.MaxParams {
+		return TrapParams
+	}
+	if policy.MaxRepeatedSegments > 0 {
+		counts := make(map[string]int)
+		for _, segment := range strings.Split(u.Path, "/") {
+			if segment == "" {
+				continue
+			}
+			counts[segment]++
+			if counts[segment] >= policy.MaxRepeatedSegments {
+				return TrapRepeatedSegments
+			}
+		}
+	}
+	return ""
+}
+
+// host returns the stats of the host, evicting another host if there are too many.
+func (detector *TrapDetector) host(name string) *hostTraps {
+	host, ok := detector.hosts[name]
+	if ok {
+		return host
+	}
+	if len(detector.hosts) >= detector.policy.MaxHosts {
+		for evicted, evictedHost := range detector.hosts {
+			if evictedHost.capped {
+				metrics.TrapHostsCapped.Dec()
+			}
+			metrics.TrapPatternsQuarantined.Sub(float64(len(evictedHost.quarantined)))
+			delete(detector.hosts, evicted)
+			break
+		}
+	}
+	host = &hostTraps{patterns: make(map[string]*patternStats), quarantined: make(map[string]string)}
+	detector.hosts[name] = host
+	return host
+}
+
+// pattern returns the stats of the pattern, or nil if the host has too many patterns to track.
+func (host *hostTraps) pattern(pattern string) *patternStats {
+	stats, ok := host.patterns[pattern]
+	if !ok {
+		if len(host.patterns) >= maxPatternsPerHost {
+			return nil
+		}
+		stats = &patternStats{}
+		host.patterns[pattern] = stats
+	}
+	return stats
+}
+
+func (host *hostTraps) quarantine(pattern, reason string) {
+	if _, ok := host.quarantined[pattern]; ok {
+		return
+	}
+	host.quarantined[pattern] = reason
+	metrics.TrapPatternsQuarantined.Inc()
+}
+
+// urlPattern returns the URL with path segments containing digits replaced by *, and only the query keys.
+func urlPattern(u *url.URL) string {
+	var pattern strings.Builder
+	pattern.WriteString(u.Host)
+	for _, segment := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+		pattern.WriteByte('/')
+		if strings.ContainsAny(segment, "0123456789") {
+			pattern.WriteByte('*')
+		} else {
+			pattern.WriteString(segment)
+		}
+	}
+	if u.RawQuery != "" {
+		keys := make([]string, 0)
+		for key := range u.Query() {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pattern.WriteByte('?')
+		pattern.WriteString(strings.Join(keys, "&"))
+	}
+	return pattern.String()
+}
+
+// simhash fingerprints the words of the body, similar content gets fingerprints a few bits apart.
+// Markup is left out, short pages differing only in their links would be far apart otherwise.
+func simhash(body []byte) uint64 {
+	var weights [64]int
+	hasher := fnv.New64a()
+	for _, word := range bytes.Fields(pageText(body)) {
+		hasher.Reset()
+		hasher.Write(word)
+		hash := hasher.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if hash&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var fingerprint uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			fingerprint |= 1 << bit
+		}
+	}
+	return fingerprint
+}
+
+// pageText returns the body with its tags replaced by spaces.
+func pageText(body []byte) []byte {
+	text := make([]byte, 0, len(body))
+	inTag := false
+	for _, c := range body {
+		switch {
+		case c == '<':
+			inTag = true
+			text = append(text, ' ')
+		case c == '>':
+			inTag = false
+		case !inTag:
+			text = append(text, c)
+		}
+	}
+	return text
+}
+
+type trapReport struct {
+	Host        string            `json:"host"`
+	TrapURLs    int               `json:"trap_urls"`
+	Capped      bool              `json:"capped"`
+	Quarantined map[string]string `json:"quarantined,omitempty"`
+}
+
+// ServeHTTP lists the hosts with traps as JSON.
+func (detector *TrapDetector) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	detector.mu.Lock()
+	reports := make([]trapReport, 0)
+	for name, host := range detector.hosts {
+		if host.trapURLs == 0 && len(host.quarantined) == 0 {
+			continue
+		}
+		quarantined := make(map[string]string, len(host.quarantined))
+		for pattern, reason := range host.quarantined {
+			quarantined[pattern] = reason
+		}
+		reports = append(reports, trapReport{Host: name, TrapURLs: host.trapURLs, Capped: host.capped, Quarantined: quarantined})
+	}
+	detector.mu.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].TrapURLs > reports[j].TrapURLs })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
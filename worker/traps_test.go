@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTrapDetector(t *testing.T) {
+	detector := NewTrapDetector(TrapPolicy{
+		MaxURLGrowth:        100,
+		MaxRepeatedSegments: 3,
+		MaxParams:           3,
+		MaxPatternURLs:      5,
+		DuplicatePages:      3,
+		HostTrapLimit:       100,
+		MaxHosts:            10,
+	})
+	parent, _ := url.Parse("https://a.com/docs/")
+	check := func(rawURL string) string {
+		t.Helper()
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return detector.Check(u, parent)
+	}
+
+	tests := map[string]string{
+		"https://a.com/docs/guide":                  "",
+		"https://a.com/a/b/a/b/a/":                  TrapRepeatedSegments,
+		"https://a.com/?a=1&b=2&c=3&d=4":            TrapParams,
+		"https://a.com/" + strings.Repeat("x", 120): TrapURLGrowth,
+	}
+	for rawURL, want := range tests {
+		if got := check(rawURL); got != want {
+			t.Errorf("Check(%q) = %q, want %q", rawURL, got, want)
+		}
+	}
+
+	// Long links are fine from pages with long URLs
+	parent, _ = url.Parse("https://a.com/" + strings.Repeat("x", 100))
+	if got := check("https://a.com/" + strings.Repeat("x", 100) + "/next"); got != "" {
+		t.Errorf("Check of a long link from a long page = %q", got)
+	}
+	parent, _ = url.Parse("https://a.com/docs/")
+
+	// Products keep producing new URLs of one pattern, with distinct content
+	for id := 1; id <= 6; id++ {
+		u, _ := url.Parse(fmt.Sprintf("https://a.com/product/%d", id))
+		detector.Discovered(u)
+		detector.Fetched(u, []byte(fmt.Sprintf("<html><body><h1>Product %d</h1><p>%s</p></body></html>", id, strings.Repeat(fmt.Sprintf("w%d ", id), id))))
+	}
+	if got := check("https://a.com/product/7"); got != "" {
+		t.Errorf("product Check = %q, want no trap", got)
+	}
+
+	// A calendar keeps producing new URLs of one pattern, with the same page
+	for day := 1; day <= 6; day++ {
+		u, _ := url.Parse(fmt.Sprintf("https://a.com/calendar/2023/%d", day))
+		detector.Discovered(u)
+	}
+	calendar, _ := url.Parse("https://a.com/calendar/2023/1")
+	detector.Fetched(calendar, []byte("<html><body><p>No events</p><a>Next month</a></body></html>"))
+	if got := check("https://a.com/calendar/2024/1"); got != "" {
+		t.Errorf("calendar Check with one page fetched = %q, want no trap yet", got)
+	}
+	calendar, _ = url.Parse("https://a.com/calendar/2023/2")
+	detector.Fetched(calendar, []byte("<html><body><p>No events</p><a>Next month</a></body></html>"))
+	if got := check("https://a.com/calendar/2024/1"); got != TrapPatternExplosion {
+		t.Errorf("calendar Check = %q, want %q", got, TrapPatternExplosion)
+	}
+
+	// Session IDs in the path serve the same page
+	body := []byte("<html><body><h1>Welcome</h1><p>The same page for every session</p></body></html>")
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse(fmt.Sprintf("https://a.com/sid%d/home", i))
+		detector.Fetched(u, body)
+	}
+	if got := check("https://a.com/sid9/home"); got != TrapDuplicateContent {
+		t.Errorf("session Check = %q, want %q", got, TrapDuplicateContent)
+	}
+	if got := check("https://a.com/docs/other"); got != "" {
+		t.Errorf("Check of a normal URL on a trap host = %q", got)
+	}
+}
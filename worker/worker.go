@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/musabgultekin/quantumscraper/http"
 	"github.com/musabgultekin/quantumscraper/metrics"
+	"github.com/musabgultekin/quantumscraper/storage"
 	"github.com/musabgultekin/quantumscraper/urlloader"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/valyala/fasthttp"
@@ -18,34 +20,84 @@ import (
 	"golang.org/x/time/rate"
 )
 
-var hostURLsQueue = make(chan []string, 1000)
 var foundLinks = make(map[string]struct{})
 var foundLinksChan = make(chan map[string]struct{}, 5000)
 var logger, _ = zap.NewDevelopment()
 
+// Config holds the dependencies and settings shared by all workers.
+type Config struct {
+	URLListURL       string
+	URLListCachePath string
+	ParquetDir       string
+	Concurrency      int
+	Fetcher          http.Fetcher
+	History          *storage.FetchHistory // Optional, enables conditional revisits
+	Schedule         *storage.Schedule     // Optional, enables continuous recrawling. Needs History and Frontier.
+	Frontier         *storage.Frontier
+	Seen             *storage.SeenSet // Optional, enables enqueuing discovered links into the Frontier
+	Robots           *RobotsCache     // Optional, enables robots.txt checks
+	Traps            *TrapDetector    // Optional, enables crawler trap detection
+	Budgets          *Budgets         // Optional, enables per host and domain budgets
+	Health           *HostHealth      // Optional, enables circuit breaking of failing hosts
+	IPLimits         *IPLimiter       // Optional, enables limits per server IP and subnet
+	Recrawl          RecrawlPolicy
+	Links            LinkPolicy
+}
+
 type Worker struct {
-	id          int
-	rateLimiter *rate.Limiter
-	wg          *sync.WaitGroup
+	id           int
+	rateLimiter  *rate.Limiter
+	wg           *sync.WaitGroup
+	cfg          *Config
+	fetchedBytes int           // Body bytes of the last HandleUrl, for budgets
+	fetchFailed  bool          // Whether the last HandleUrl failed to fetch or got a server error, for budgets
+	retryAfter   time.Duration // How long the response of the last HandleUrl asked to wait before retrying
 }
 
-func NewWorker(id int, wg *sync.WaitGroup) (*Worker, error) {
+// Hosts asking to retry within this long are waited for within their batch, others are deferred.
+const maxRetryAfter = time.Second * 30
+
+func NewWorker(id int, wg *sync.WaitGroup, cfg *Config) (*Worker, error) {
 	rateLimiter := rate.NewLimiter(0.5, 1)
 
-	return &Worker{id: id, rateLimiter: rateLimiter, wg: wg}, nil
+	return &Worker{id: id, rateLimiter: rateLimiter, wg: wg, cfg: cfg}, nil
 }
 
-func (worker *Worker) Work() error {
+// Work crawls the host batches from the queue until it's closed.
+func (worker *Worker) Work(queue <-chan []string) error {
 	defer worker.wg.Done()
 
-	for hostUrlList := range hostURLsQueue {
-		for _, targetURL := range hostUrlList {
-			if err := worker.HandleUrl(targetURL); err != nil {
+	for hostUrlList := range queue {
+		if len(hostUrlList) > 0 {
+			http.HoldCookies(hostUrlList[0])
+		}
+		for i, targetURL := range hostUrlList {
+			if worker.deferIfUnhealthy(hostUrlList[i:]) {
+				break
+			}
+			if worker.deferIfExhausted(hostUrlList[i:]) {
+				break
+			}
+			err := worker.fetch(targetURL)
+			if errors.Is(err, errIPBusy) {
+				worker.deferHost(urlHost(targetURL), hostUrlList[i:], time.Now().Add(maxIPWait))
+				break
+			}
+			if worker.retryAfter > maxRetryAfter {
+				worker.deferHost(urlHost(targetURL), hostUrlList[i:], time.Now().Add(worker.retryAfter))
+				break
+			}
+			worker.ack(targetURL)
+			if err != nil {
+				worker.rescheduleFailed(targetURL)
 				if strings.Contains(err.Error(), "no such host") {
+					for _, skippedURL := range hostUrlList[i+1:] {
+						worker.rescheduleFailed(skippedURL)
+					}
 					break // Since we dont have the host anymore, no need to continue
 				}
-				if strings.Contains(err.Error(), "could not connect to proxy:") &&
-					strings.Contains(err.Error(), "status code: 403") {
+				var proxyErr *http.ProxyConnectError
+				if errors.As(err, &proxyErr) && proxyErr.StatusCode == fasthttp.StatusForbidden {
 					continue
 				}
 				if strings.Contains(err.Error(), "status not 200") {
@@ -63,11 +115,35 @@ func (worker *Worker) Work() error {
 				continue
 			}
 		}
+		if len(hostUrlList) > 0 {
+			http.ForgetCookies(hostUrlList[0]) // Cookies only last the host batches of a site in progress
+		}
 	}
 	return nil
 }
 
+// fetch handles the URL within the IP limits and budgets. A 429 or 503 asking to come back within
+// maxRetryAfter is waited out and retried once.
+func (worker *Worker) fetch(targetURL string) error {
+	for attempt := 0; ; attempt++ {
+		release, err := worker.acquireIP(targetURL)
+		if err != nil {
+			return err
+		}
+		handleStartTime := time.Now()
+		err = worker.HandleUrl(targetURL)
+		release()
+		worker.spend(targetURL, time.Since(handleStartTime))
+		if worker.retryAfter == 0 || worker.retryAfter > maxRetryAfter || attempt > 0 {
+			return err
+		}
+		time.Sleep(worker.retryAfter)
+	}
+}
+
 func (worker *Worker) HandleUrl(targetURL string) error {
+	worker.fetchedBytes, worker.fetchFailed, worker.retryAfter = 0, false, 0
+
 	// if err := worker.rateLimiter.Wait(context.TODO()); err != nil {
 	// 	panic(err) // This should never happen, but we need to know if it happens.
 	// }
@@ -75,14 +151,53 @@ func (worker *Worker) HandleUrl(targetURL string) error {
 	// log.Println("Fetching", targetURL)
 	// logger.Debug("Fetching", zap.String("url", targetURL))
 
+	if worker.cfg.Robots != nil {
+		targetURLParsed, err := url.Parse(targetURL)
+		if err != nil {
+			return fmt.Errorf("target url parse err: %w", err)
+		}
+		if !worker.cfg.Robots.Allowed(targetURLParsed) {
+			metrics.RobotsDisallowCount.Inc()
+			return errors.New("disallowed by robots.txt")
+		}
+	}
+
+	// Make it a conditional request if we fetched it before
+	fetchReq := &http.FetchRequest{URL: targetURL}
+	var previous *storage.FetchRecord
+	if worker.cfg.History != nil {
+		var err error
+		previous, err = worker.cfg.History.Get(targetURL)
+		if err != nil {
+			return fmt.Errorf("fetch history get: %w", err)
+		}
+		if previous != nil {
+			fetchReq.ETag, fetchReq.LastModified = previous.ETag, previous.LastModified
+		}
+	}
+
 	requestStartTime := time.Now()
 	metrics.RequestInFlightCount.Inc()
 
-	resp, status, err := http.GetFast(targetURL)
+	result, err := worker.cfg.Fetcher.Fetch(fetchReq)
+	worker.fetchedBytes = len(result.Body)
+	worker.fetchFailed = (err != nil && result.StatusCode == 0) || result.StatusCode >= 500
+	worker.retryAfter = result.RetryAfter
+	worker.reportHealth(targetURL, result, err, time.Since(requestStartTime))
+	worker.dialedIP(targetURL, result)
 
+	family := result.Family
+	if family == "" {
+		family = "unknown" // Proxied, or no connection
+	}
+	labels := prometheus.Labels{"code": strconv.Itoa(result.StatusCode), "protocol": result.Protocol, "family": family}
 	metrics.RequestInFlightCount.Dec()
-	metrics.RequestCount.With(prometheus.Labels{"code": strconv.Itoa(status)}).Inc()
-	metrics.RequestLatency.With(prometheus.Labels{"code": strconv.Itoa(status)}).Observe(time.Since(requestStartTime).Seconds())
+	metrics.RequestCount.With(labels).Inc()
+	metrics.RequestLatency.With(labels).Observe(time.Since(requestStartTime).Seconds())
+
+	if result.TLS != nil && result.TLS.VerifyError != "" {
+		logger.Debug("tls verify", zap.String("url", targetURL), zap.String("error", result.TLS.VerifyError))
+	}
 
 	// if status == fasthttp.StatusTooManyRequests {
 	// 	time.Sleep(time.Second * 5)
@@ -92,43 +207,75 @@ func (worker *Worker) HandleUrl(targetURL string) error {
 		return fmt.Errorf("http get err: %w", err)
 	}
 
-	links, err := extractLinksFromHTML(targetURL, resp)
+	var record *storage.FetchRecord
+	if worker.cfg.History != nil {
+		record, err = worker.cfg.History.Record(targetURL, result.ETag, result.LastModified, result.NotModified, result.Body, time.Now())
+		if err != nil {
+			return fmt.Errorf("fetch history record: %w", err)
+		}
+		if previous != nil {
+			switch {
+			case result.NotModified:
+				metrics.RevisitCount.With(prometheus.Labels{"result": "not_modified"}).Inc()
+			case record.Changed:
+				metrics.RevisitCount.With(prometheus.Labels{"result": "changed"}).Inc()
+			default:
+				metrics.RevisitCount.With(prometheus.Labels{"result": "unchanged"}).Inc()
+			}
+		}
+	}
+	if result.NotModified {
+		return worker.reschedule(targetURL, record, 0) // Nothing new to extract
+	}
+
+	if entries, ok := extractSitemapEntries(result.Body); ok {
+		if err := worker.handleSitemap(targetURL, entries); err != nil {
+			return fmt.Errorf("handle sitemap: %w", err)
+		}
+		return worker.reschedule(targetURL, record, len(entries))
+	}
+
+	if worker.cfg.Traps != nil {
+		if targetURLParsed, err := url.Parse(targetURL); err == nil {
+			worker.cfg.Traps.Fetched(targetURLParsed, result.Body)
+		}
+	}
+
+	links, err := extractLinksFromHTML(targetURL, result.Body)
 	if err != nil {
 		return fmt.Errorf("error extract links from html: %w", err)
 	}
 
 	foundLinksChan <- links
+	worker.enqueueLinks(targetURL, links)
+
+	if err := worker.reschedule(targetURL, record, len(links)); err != nil {
+		return err
+	}
 
 	// if err := worker.SaveLinks(links); err != nil {
 	// 	return fmt.Errorf("save links: %w", err)
 	// }
 
-	// Queue new links
-	// _ = resp
-	_ = links
 	return nil
 }
 
-func StartWorkers(urlListURL string, urlListCachePath string, parquetDir string, wg *sync.WaitGroup, concurrency int) error {
-	// urlLoader, err := urlloader.New(urlListURL, urlListCachePath)
+func StartWorkers(cfg *Config, wg *sync.WaitGroup) error {
+	// urlLoader, err := urlloader.New(cfg.URLListURL, cfg.URLListCachePath)
 	// if err != nil {
 	// 	return fmt.Errorf("url loader: %w", err)
 	// }
 	// defer urlLoader.Close()
-	urlLoader, err := urlloader.NewParquet(parquetDir)
+	urlLoader, err := urlloader.NewParquet(cfg.ParquetDir)
 	if err != nil {
 		return fmt.Errorf("url loader: %w", err)
 	}
 	defer urlLoader.Close()
 
 	log.Println("Starting workers")
-	wg.Add(concurrency)
-	for i := 0; i < concurrency; i++ {
-		worker, err := NewWorker(i, wg)
-		if err != nil {
-			return fmt.Errorf("new worker: %w", err)
-		}
-		go worker.Work()
+	queue := make(chan []string, 1000)
+	if err := startWorkerPool(cfg, wg, queue); err != nil {
+		return err
 	}
 
 	// Save loaded URLs
@@ -148,6 +295,14 @@ func StartWorkers(urlListURL string, urlListCachePath string, parquetDir string,
 		}
 	}()
 
+	if cfg.Schedule != nil {
+		if cfg.History == nil || cfg.Frontier == nil {
+			return errors.New("recrawling needs fetch history and frontier")
+		}
+		go feedFromFrontier(cfg.Frontier, queue, nil)
+		return recrawl(cfg, urlLoader)
+	}
+
 	log.Println("Queuing URLs for each host")
 	for {
 		urlStrings, err := urlLoader.LoadNextHostURLs()
@@ -157,12 +312,58 @@ func StartWorkers(urlListURL string, urlListCachePath string, parquetDir string,
 		if len(urlStrings) == 0 {
 			break // end of file
 		}
-		hostURLsQueue <- urlStrings
+		markSeeds(cfg, urlStrings)
+		queue <- urlStrings
 	}
 	log.Println("All URLs queued")
 
 	// All hosts queued, we can close the queue
-	close(hostURLsQueue)
+	close(queue)
+
+	// Links found in a pass are crawled from the frontier after it, and hosts out of budget
+	// were deferred, crawl them in further passes
+	for pass := 2; ; pass++ {
+		wg.Wait()
+		if cfg.Frontier != nil {
+			log.Println("Crawling discovered links")
+			if err := drainFrontier(cfg, wg); err != nil {
+				return err
+			}
+		}
+		if cfg.Budgets == nil {
+			return nil
+		}
+		deferred, next := cfg.Budgets.NextPass(time.Now())
+		for len(deferred) == 0 && !next.IsZero() {
+			// Only hosts with open circuits are left, wait for the first to cool off
+			log.Printf("Waiting until %s for deferred hosts", next.Format(time.RFC3339))
+			time.Sleep(time.Until(next))
+			deferred, next = cfg.Budgets.NextPass(time.Now())
+		}
+		if len(deferred) == 0 {
+			return nil
+		}
+		log.Printf("Starting pass %d with %d deferred hosts", pass, len(deferred))
+		queue := make(chan []string, 1000)
+		if err := startWorkerPool(cfg, wg, queue); err != nil {
+			return err
+		}
+		for _, urlStrings := range deferred {
+			queue <- urlStrings
+		}
+		close(queue)
+	}
+}
 
+// startWorkerPool starts cfg.Concurrency workers crawling the host batches from the queue.
+func startWorkerPool(cfg *Config, wg *sync.WaitGroup, queue <-chan []string) error {
+	wg.Add(cfg.Concurrency)
+	for i := 0; i < cfg.Concurrency; i++ {
+		worker, err := NewWorker(i, wg, cfg)
+		if err != nil {
+			return fmt.Errorf("new worker: %w", err)
+		}
+		go worker.Work(queue)
+	}
 	return nil
 }